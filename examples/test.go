@@ -1,14 +1,34 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"math/bits"
 	"math/rand"
+	"net/http"
+	"os"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+	"unsafe"
 )
 
 type Account struct {
@@ -19,168 +39,5868 @@ type Account struct {
 type Balance struct {
 	Asset   string  `json:"asset"`
 	Balance float64 `json:"balance"`
+	Sign    Sign    `json:"sign,omitempty"`
+	Weight  float64 `json:"weight,omitempty"`
 }
 
+type Sign string
+
+const (
+	Credit Sign = ""
+	Debit  Sign = "debit"
+)
+
 type MerkleNode struct {
-	Hash  []byte
+	Hash  [32]byte
 	Left  *MerkleNode
 	Right *MerkleNode
 }
 
-// createMerkleTreeForAccounts constructs a Merkle tree from a slice of accounts
+// Leaf and internal node hashes are domain-separated as in RFC 6962, so an
+// internal node's preimage can never be presented as a leaf. Roots and proofs
+// produced before the prefixes were introduced will no longer verify.
+const (
+	leafPrefix     byte = 0x00
+	internalPrefix byte = 0x01
+)
+
+type Hasher interface {
+	Hash(data []byte) [32]byte
+}
+
+type SHA256Hasher struct{}
+
+// Hash computes the SHA-256 digest of the given data.
+//
+// It is the default Hasher used by the tree builders.
+//
+// Parameters:
+//   - data: the bytes to hash
+//
+// Returns:
+//   the 32-byte SHA-256 digest of data
+func (SHA256Hasher) Hash(data []byte) [32]byte {
+	return sha256.Sum256(data)
+}
+
+// Name returns the name SHA256Hasher is recorded under in exported builder options.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   "sha256"
+func (SHA256Hasher) Name() string {
+	return "sha256"
+}
+
+type NamedHasher interface {
+	Hasher
+	Name() string
+}
+
+var (
+	hashersMu sync.RWMutex
+	hashers   = map[string]Hasher{SHA256Hasher{}.Name(): SHA256Hasher{}}
+)
+
+// RegisterHasher makes a hasher available to TreeBuilder.UnmarshalJSON under its name.
+//
+// SHA256Hasher is registered by default. Registering another hasher under the same name replaces it.
+//
+// Parameters:
+//   - h: the hasher to register
+//
+// Returns:
+//   None
+func RegisterHasher(h NamedHasher) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+	hashers[h.Name()] = h
+}
+
+// lookupHasher returns the hasher registered under a name.
+//
+// Parameters:
+//   - name: the name the hasher was registered under
+//
+// Returns:
+//   the registered Hasher, or an error if no hasher has that name
+func lookupHasher(name string) (Hasher, error) {
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hasher %q", name)
+	}
+	return h, nil
+}
+
+// Errors returned by the builders and proof functions. They are wrapped with the account, asset or hash involved, so callers should match them with errors.Is.
+var (
+	ErrNegativeBalance  = errors.New("negative balance")
+	ErrDuplicateAccount = errors.New("duplicate account identifier")
+	ErrLeafNotFound     = errors.New("leaf not found in tree")
+	ErrEmptyTree        = errors.New("empty tree")
+	ErrWorkerPanic      = errors.New("worker panicked")
+	ErrInvalidSign      = errors.New("invalid balance sign")
+	ErrInvalidTree      = errors.New("inconsistent tree")
+	ErrRootMismatch     = errors.New("root mismatch")
+	ErrLeafCount        = errors.New("leaf count mismatch")
+	ErrNoSnapshot       = errors.New("no snapshot at or before time")
+)
+
+type ProgressFunc func(processed, total int)
+
+// progressInterval is how many hash operations are completed between progress reports.
+const progressInterval = 4096
+
+type TreeBuilder struct {
+	hasher             Hasher
+	Workers            int
+	AllowNegative      bool
+	AllowDuplicates    bool
+	Progress           ProgressFunc
+	Observer           BuildObserver
+	AssetCanonicalizer func(string) string
+	PolicyHash         []byte
+	ReserveAddresses   []string
+	ApplyWeights       bool
+	PairWithZero       bool
+	SelfVerifyProofs   bool
+	progressMu         sync.Mutex
+}
+
+type BuildObserver interface {
+	ObserveBuild(duration time.Duration, leaves, depth int)
+}
+
+type NopObserver struct{}
+
+// ObserveBuild discards the measurements of a completed build.
+//
+// Parameters:
+//   - duration: how long the build took
+//   - leaves: the number of leaves in the tree
+//   - depth: the height of the tree
+//
+// Returns:
+//   None
+func (NopObserver) ObserveBuild(duration time.Duration, leaves, depth int) {}
+
+// NewTreeBuilder creates a tree builder that routes all leaf and internal node hashing through the given hasher.
+//
+// It falls back to SHA-256 when no hasher is supplied, which is what the package-level constructors use.
+//
+// Parameters:
+//   - h: the Hasher used for every leaf and internal node, or nil for SHA-256
+//
+// Returns:
+//   a pointer to the configured TreeBuilder
+func NewTreeBuilder(h Hasher) *TreeBuilder {
+	if h == nil {
+		h = SHA256Hasher{}
+	}
+	return &TreeBuilder{hasher: h, Observer: NopObserver{}}
+}
+
+// h returns the hasher the builder routes all hashing through.
+//
+// It falls back to SHA-256 when no hasher is set, so a TreeBuilder declared as a zero value behaves like NewTreeBuilder(nil) apart from its Observer.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the builder's Hasher
+func (b *TreeBuilder) h() Hasher {
+	if b.hasher == nil {
+		return SHA256Hasher{}
+	}
+	return b.hasher
+}
+
+type TreeBuilderJSON struct {
+	Hasher           string   `json:"hasher"`
+	AllowNegative    bool     `json:"allowNegative,omitempty"`
+	AllowDuplicates  bool     `json:"allowDuplicates,omitempty"`
+	PolicyHash       string   `json:"policyHash,omitempty"`
+	ReserveAddresses []string `json:"reserveAddresses,omitempty"`
+	ApplyWeights     bool     `json:"applyWeights,omitempty"`
+	PairWithZero     bool     `json:"pairWithZero,omitempty"`
+}
+
+// MarshalJSON records the options that determine the roots the builder produces.
+//
+// It writes the hasher's name, the validation flags, the hex-encoded PolicyHash, the ReserveAddresses, ApplyWeights and PairWithZero, so a verifier can load them with UnmarshalJSON and rebuild or verify the same root. Workers, Progress, Observer and SelfVerifyProofs do not affect the root and are left out. AssetCanonicalizer does, but a function cannot be serialized, so a verifier has to set the same mapping again after loading. The leaf and internal prefixes, leaf order and binary arity are fixed for every builder, and padding is chosen by calling BuildPadded rather than by an option, so none of them are recorded.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the JSON encoding of the options, or an error if the hasher does not implement NamedHasher
+func (b *TreeBuilder) MarshalJSON() ([]byte, error) {
+	named, ok := b.h().(NamedHasher)
+	if !ok {
+		return nil, fmt.Errorf("hasher %T has no name", b.h())
+	}
+	return json.Marshal(TreeBuilderJSON{
+		Hasher:           named.Name(),
+		AllowNegative:    b.AllowNegative,
+		AllowDuplicates:  b.AllowDuplicates,
+		PolicyHash:       hex.EncodeToString(b.PolicyHash),
+		ReserveAddresses: b.ReserveAddresses,
+		ApplyWeights:     b.ApplyWeights,
+		PairWithZero:     b.PairWithZero,
+	})
+}
+
+// UnmarshalJSON loads options written by MarshalJSON into the builder.
+//
+// The hasher is looked up by name among those registered with RegisterHasher. Workers, Progress and Observer are left as they are.
+//
+// Parameters:
+//   - data: the JSON encoding of the options
+//
+// Returns:
+//   an error if the JSON is malformed, names an unregistered hasher or holds a policy hash that is not valid hex
+func (b *TreeBuilder) UnmarshalJSON(data []byte) error {
+	var opts TreeBuilderJSON
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return err
+	}
+	h, err := lookupHasher(opts.Hasher)
+	if err != nil {
+		return err
+	}
+	policyHash, err := hex.DecodeString(opts.PolicyHash)
+	if err != nil {
+		return fmt.Errorf("invalid policy hash: %w", err)
+	}
+	if len(policyHash) == 0 {
+		policyHash = nil
+	}
+	b.hasher, b.AllowNegative, b.AllowDuplicates = h, opts.AllowNegative, opts.AllowDuplicates
+	b.PolicyHash, b.ReserveAddresses, b.ApplyWeights = policyHash, opts.ReserveAddresses, opts.ApplyWeights
+	b.PairWithZero = opts.PairWithZero
+	return nil
+}
+
+// checkBalance rejects a balance with an unknown sign, and a negative balance unless the builder allows them.
+//
+// A negative amount in a proof-of-reserves leaf is almost always a bug or an attempt to cancel out another user's balance and hide a shortfall. Liabilities should be recorded as a positive amount with the Debit sign instead.
+//
+// Parameters:
+//   - identifier: the identifier of the account holding the balance
+//   - balance: the balance to check
+//
+// Returns:
+//   an error naming the account and asset if the sign is unknown or the balance is negative and AllowNegative is not set, or nil otherwise
+func (b *TreeBuilder) checkBalance(identifier string, balance Balance) error {
+	return validateBalance(identifier, balance, b.AllowNegative)
+}
+
+// validateBalance applies the leaf rules shared by every tree type to a balance.
+//
+// The sign is hashed into the leaf as written, so anything other than Credit or Debit is rejected rather than committed to a value that the totals would read differently.
+//
+// Parameters:
+//   - identifier: the identifier of the account holding the balance
+//   - balance: the balance to check
+//   - allowNegative: whether negative amounts are accepted
+//
+// Returns:
+//   an error wrapping ErrInvalidSign or ErrNegativeBalance that names the account and asset, or nil if the balance is valid
+func validateBalance(identifier string, balance Balance, allowNegative bool) error {
+	if !validSign(balance.Sign) {
+		return fmt.Errorf("account %s asset %s: %w %q", identifier, balance.Asset, ErrInvalidSign, balance.Sign)
+	}
+	if balance.Balance < 0 && !allowNegative {
+		return fmt.Errorf("account %s asset %s: %w %v", identifier, balance.Asset, ErrNegativeBalance, balance.Balance)
+	}
+	return nil
+}
+
+// leafBalance returns a balance as it is committed to a leaf.
+//
+// A balance's Weight is never hashed itself. With applyWeights set, the amount is multiplied by the weight, so the leaf commits to the risk-weighted amount; an unset weight counts as 1. Otherwise the weight is dropped and the leaf commits to the amount as written, which keeps the roots of unweighted builds independent of any weights in the input.
+//
+// Parameters:
+//   - balance: the balance to commit to
+//   - applyWeights: whether to fold the weight into the amount
+//
+// Returns:
+//   the balance to encode, with Weight cleared, or an error naming the asset if the weight is applied and is negative or not a finite number
+func leafBalance(balance Balance, applyWeights bool) (Balance, error) {
+	weight := balance.Weight
+	balance.Weight = 0
+	if !applyWeights || weight == 0 {
+		return balance, nil
+	}
+	if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return Balance{}, fmt.Errorf("asset %s: invalid weight %v", balance.Asset, weight)
+	}
+	balance.Balance *= weight
+	return balance, nil
+}
+
+// validSign reports whether a sign is one of the defined liability signs.
+//
+// Parameters:
+//   - sign: the sign to check
+//
+// Returns:
+//   true for Credit and Debit, false otherwise
+func validSign(sign Sign) bool {
+	return sign == Credit || sign == Debit
+}
+
+// prepareAccounts canonicalizes asset symbols and runs the account-level checks every builder applies before hashing.
+//
+// With an AssetCanonicalizer set, it returns a copy of the accounts with every asset mapped to its canonical id, so sorting, sign checks and leaves all see the canonical symbol and synonyms such as "USDT.ERC20" and "USDT" produce the same root; the caller's accounts are left untouched. Leaf hashing applies the canonicalizer again, so it must be idempotent. It then rejects duplicated identifiers through checkDuplicates and ambiguous signs through ValidateSigns, so a build fails before any leaf is hashed rather than part-way through.
+//
+// Parameters:
+//   - accounts: the accounts about to be built
+//
+// Returns:
+//   the accounts to build from, or the first error found
+func (b *TreeBuilder) prepareAccounts(accounts []Account) ([]Account, error) {
+	if b.AssetCanonicalizer != nil {
+		canonical := make([]Account, len(accounts))
+		for i, account := range accounts {
+			balances := make([]Balance, len(account.Balances))
+			for j, balance := range account.Balances {
+				balance.Asset = b.AssetCanonicalizer(balance.Asset)
+				balances[j] = balance
+			}
+			canonical[i] = Account{Identifier: account.Identifier, Balances: balances}
+		}
+		accounts = canonical
+	}
+
+	if err := b.checkDuplicates(len(accounts), func(i int) string { return accounts[i].Identifier }); err != nil {
+		return nil, err
+	}
+	if err := ValidateSigns(accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// canonicalAsset maps an asset symbol through the builder's AssetCanonicalizer.
+//
+// Parameters:
+//   - asset: the asset symbol
+//
+// Returns:
+//   the canonical id, or asset unchanged if no canonicalizer is set
+func (b *TreeBuilder) canonicalAsset(asset string) string {
+	if b.AssetCanonicalizer == nil {
+		return asset
+	}
+	return b.AssetCanonicalizer(asset)
+}
+
+// checkDuplicates rejects account identifiers that appear more than once unless the builder allows them.
+//
+// A repeated identifier usually means an upstream merge went wrong, and building anyway would silently count that account's balances twice in the root. Set AllowDuplicates when accounts are deliberately sharded under one identifier.
+//
+// Parameters:
+//   - count: the number of accounts
+//   - identifier: returns the identifier of the account at an index
+//
+// Returns:
+//   an error listing every duplicated identifier in sorted order if any are found and AllowDuplicates is not set, or nil otherwise
+func (b *TreeBuilder) checkDuplicates(count int, identifier func(int) string) error {
+	if b.AllowDuplicates {
+		return nil
+	}
+
+	seen := make(map[string]int, count)
+	var duplicates []string
+	for i := 0; i < count; i++ {
+		id := identifier(i)
+		seen[id]++
+		if seen[id] == 2 {
+			duplicates = append(duplicates, id)
+		}
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	sort.Strings(duplicates)
+	return fmt.Errorf("%w: %s", ErrDuplicateAccount, strings.Join(duplicates, ", "))
+}
+
+// reportProgress passes build progress to the builder's Progress callback, if one is set.
+//
+// Progress is measured in hash operations out of the total the build will perform, HashOpCount for the leaf count in a single tree, so a report with processed equal to total means the build is done. Calls are serialized with a mutex, so the callback never runs concurrently with itself even when reports come from several workers, though reports from concurrent leaf workers may arrive slightly out of order.
+//
+// Parameters:
+//   - processed: the number of hash operations completed so far
+//   - total: the total number of hash operations in the build
+//
+// Returns:
+//   None
+func (b *TreeBuilder) reportProgress(processed, total int) {
+	if b.Progress == nil {
+		return
+	}
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	b.Progress(processed, total)
+}
+
+type buildProgress struct {
+	builder *TreeBuilder
+	done    int
+	total   int
+}
+
+// newProgress starts tracking the progress of a sequential build.
+//
+// Parameters:
+//   - total: the number of hash operations the build will perform
+//
+// Returns:
+//   a tracker that reports through the builder's Progress callback
+func (b *TreeBuilder) newProgress(total int) *buildProgress {
+	return &buildProgress{builder: b, total: total}
+}
+
+// advance records completed hash operations and reports each time the count passes a multiple of progressInterval.
+//
+// It is safe to call on a nil tracker, which records nothing, so helpers shared with untracked callers can report unconditionally.
+//
+// Parameters:
+//   - ops: the number of hash operations just completed
+//
+// Returns:
+//   None
+func (p *buildProgress) advance(ops int) {
+	if p == nil {
+		return
+	}
+	before := p.done
+	p.done += ops
+	if p.done/progressInterval != before/progressInterval {
+		p.report()
+	}
+}
+
+// report passes the hash operations completed so far to the builder's Progress callback.
+//
+// Builders call it at the start of each tree level and once the tree is complete. It is safe to call on a nil tracker.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   None
+func (p *buildProgress) report() {
+	if p == nil {
+		return
+	}
+	p.builder.reportProgress(p.done, p.total)
+}
+
+// observeBuild passes the measurements of a completed build to the builder's Observer, if one is set.
+//
+// Parameters:
+//   - duration: how long the build took
+//   - leaves: the number of leaves hashed into the tree
+//   - depth: the height of the tree that was built, before finishRoot
+//
+// Returns:
+//   None
+func (b *TreeBuilder) observeBuild(duration time.Duration, leaves, depth int) {
+	if b.Observer == nil {
+		return
+	}
+	b.Observer.ObserveBuild(duration, leaves, depth+treeDepth(1+b.rootExtraCount())-1)
+}
+
+// treeDepth returns the height of a tree built by buildTree over the given number of leaves.
+//
+// The depth is derived from the leaf count rather than by walking the tree, which is exact because unpaired nodes are carried up and every level halves the node count, rounding up. The empty tree has a single root node and so a depth of 1.
+//
+// Parameters:
+//   - leaves: the number of leaves in the tree
+//
+// Returns:
+//   the number of nodes on the longest path from the root down to a leaf
+func treeDepth(leaves int) int {
+	depth := 1
+	if leaves > 1 {
+		depth += bits.Len(uint(leaves - 1))
+	}
+	return depth
+}
+
+// workerCount returns how many goroutines the concurrent builder may run at once.
+//
+// It uses the Workers field when it is positive and falls back to runtime.NumCPU() otherwise.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the size of the worker pool
+func (b *TreeBuilder) workerCount() int {
+	if b.Workers > 0 {
+		return b.Workers
+	}
+	return runtime.NumCPU()
+}
+
+type accountBalance struct {
+	identifier string
+	balance    Balance
+}
+
+// createMerkleTreeForAccounts constructs a Merkle tree from a slice of accounts
+//
+// It takes a slice of Account structs and returns a pointer to the root MerkleNode of the constructed tree, hashing with SHA-256. Balances are float64 and leaves are their JSON encoding, so two systems that arrive at the same balance through different arithmetic (0.1+0.2 versus 0.3) commit to different roots; use createMerkleTreeForFixedAccounts where the commitment must be canonical.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree
+//
+// Returns:
+//   a pointer to the root MerkleNode representing the Merkle tree built from the account balances, or an error if a balance is negative or cannot be marshalled
+func createMerkleTreeForAccounts(accounts []Account) (*MerkleNode, error) {
+	return NewTreeBuilder(nil).Build(accounts)
+}
+
+// Build constructs a Merkle tree from a slice of accounts using the builder's hasher.
+//
+// It takes a slice of Account structs and returns a pointer to the root MerkleNode of the constructed tree. Balances are ordered by account identifier and then asset before hashing, so the root does not depend on input order. Progress is reported every progressInterval hash operations, at the start of each tree level and once the tree is complete, after which the builder's Observer receives the build's duration, leaf count and depth. The other builders report progress the same way.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree
+//
+// Returns:
+//   a pointer to the root MerkleNode representing the Merkle tree built from the account balances, or an error if a balance is negative or cannot be marshalled
+func (b *TreeBuilder) Build(accounts []Account) (*MerkleNode, error) {
+	start := time.Now()
+	accounts, err := b.prepareAccounts(accounts)
+	if err != nil {
+		return nil, err
+	}
+	allBalances := flattenBalances(accounts)
+	progress := b.newProgress(HashOpCount(len(allBalances)))
+
+	arena := newNodeArena(len(allBalances))
+	leaves := make([]*MerkleNode, len(allBalances))
+	var enc leafEncoder
+	for i, entry := range allBalances {
+		hash, err := b.hashBalanceWith(entry, &enc)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = arena.alloc()
+		leaves[i].Hash = hash
+		progress.advance(1)
+	}
+
+	root := b.finishRoot(b.buildTree(leaves, progress))
+	progress.report()
+	b.observeBuild(time.Since(start), len(leaves), treeDepth(len(leaves)))
+	return root, nil
+}
+
+// paddingLeafByte is the preimage of every padding leaf added by BuildPadded. A padding leaf hashes this single byte under the leaf prefix, which no serialized balance can equal since those are JSON objects.
+const paddingLeafByte = 0x00
+
+// policyLeafByte tags the leaf that commits a root to the builder's PolicyHash. Like the padding leaf, its preimage can never equal a serialized balance.
+const policyLeafByte = 0x01
+
+// reserveLeafByte tags the leaves of the reserve address sub-tree that finishRoot adds for ReserveAddresses.
+const reserveLeafByte = 0x02
+
+// createPaddedMerkleTree constructs a perfectly balanced Merkle tree, padding the leaves up to a power of two.
+//
+// It hashes with SHA-256; see TreeBuilder.BuildPadded.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree
+//
+// Returns:
+//   a pointer to the root MerkleNode, or an error if a balance is negative, an identifier is duplicated or a balance cannot be marshalled
+func createPaddedMerkleTree(accounts []Account) (*MerkleNode, error) {
+	return NewTreeBuilder(nil).BuildPadded(accounts)
+}
+
+// BuildPadded constructs a perfectly balanced Merkle tree, padding the leaves up to a power of two, using the builder's hasher.
+//
+// The balance leaves come first, in the order Build uses, and are followed by padding leaves until the count reaches the next power of two, so every leaf sits ceil(log2 n) levels below the root. This suits verifiers that expect a fixed proof length. Each padding leaf hashes paddingLeafByte; PaddingLeaf returns its hash so verifiers can tell padding from real leaves. Proofs come from GenerateProof and verify with VerifyProof as usual.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree
+//
+// Returns:
+//   a pointer to the root MerkleNode, or an error if a balance is negative, an identifier is duplicated or a balance cannot be marshalled
+func (b *TreeBuilder) BuildPadded(accounts []Account) (*MerkleNode, error) {
+	start := time.Now()
+	accounts, err := b.prepareAccounts(accounts)
+	if err != nil {
+		return nil, err
+	}
+	allBalances := flattenBalances(accounts)
+
+	width := 0
+	if len(allBalances) > 0 {
+		width = 1 << bits.Len(uint(len(allBalances)-1))
+	}
+	progress := b.newProgress(HashOpCount(width))
+	arena := newNodeArena(width)
+	leaves := make([]*MerkleNode, width)
+	var enc leafEncoder
+	for i, entry := range allBalances {
+		hash, err := b.hashBalanceWith(entry, &enc)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = arena.alloc()
+		leaves[i].Hash = hash
+		progress.advance(1)
+	}
+	if width > len(allBalances) {
+		padding := b.PaddingLeaf()
+		for i := len(allBalances); i < width; i++ {
+			leaves[i] = arena.alloc()
+			leaves[i].Hash = padding
+			progress.advance(1)
+		}
+	}
+
+	root := b.finishRoot(b.buildTree(leaves, progress))
+	progress.report()
+	b.observeBuild(time.Since(start), len(leaves), treeDepth(len(leaves)))
+	return root, nil
+}
+
+// PaddingLeaf returns the hash of the padding leaves that BuildPadded adds.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the padding leaf hash under the builder's hasher
+func (b *TreeBuilder) PaddingLeaf() [32]byte {
+	return hashLeaf(b.h(), []byte{paddingLeafByte})
+}
+
+// PolicyLeaf returns the hash of the leaf that binds a root to the builder's PolicyHash.
+//
+// A verifier who knows the policy document's hash can prove that a root commits to it with GenerateProof and VerifyProof on this leaf, just as with any balance leaf.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the policy leaf hash under the builder's hasher
+func (b *TreeBuilder) PolicyLeaf() [32]byte {
+	return hashLeaf(b.h(), append([]byte{policyLeafByte}, b.PolicyHash...))
+}
+
+// ReserveLeaf returns the hash of the leaf that commits a reserve address into a root built with ReserveAddresses.
+//
+// Parameters:
+//   - address: the reserve address
+//
+// Returns:
+//   the reserve leaf hash under the builder's hasher
+func (b *TreeBuilder) ReserveLeaf(address string) [32]byte {
+	return hashLeaf(b.h(), append([]byte{reserveLeafByte}, address...))
+}
+
+// reserveTree builds the sub-tree of the builder's reserve addresses.
+//
+// The addresses are sorted first, so the same set always gives the same sub-tree regardless of the order it was configured in.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the root of the reserve address sub-tree
+func (b *TreeBuilder) reserveTree() *MerkleNode {
+	addresses := append([]string(nil), b.ReserveAddresses...)
+	sort.Strings(addresses)
+	leaves := make([]*MerkleNode, len(addresses))
+	for i, address := range addresses {
+		leaves[i] = &MerkleNode{Hash: b.ReserveLeaf(address)}
+	}
+	return b.buildTree(leaves, nil)
+}
+
+// finishRoot combines a built tree's root with the builder's root-level commitments.
+//
+// Every Build method passes its root through it. With a PolicyHash set, the policy leaf is added beside the built tree, and with ReserveAddresses set, so is the sub-tree of reserve address leaves; the three are then combined like any other nodes, so the published root binds to the policy document and the declared reserve wallets as well as to the balances. Balance proofs gain a step or two and are still produced by GenerateProof and checked by VerifyProof, and the policy and reserve leaves are proven the same way. Without either option, the root is returned unchanged.
+//
+// Parameters:
+//   - root: the root of the built tree
+//
+// Returns:
+//   the root to publish
+func (b *TreeBuilder) finishRoot(root *MerkleNode) *MerkleNode {
+	nodes := []*MerkleNode{root}
+	if len(b.PolicyHash) > 0 {
+		nodes = append(nodes, &MerkleNode{Hash: b.PolicyLeaf()})
+	}
+	if len(b.ReserveAddresses) > 0 {
+		nodes = append(nodes, b.reserveTree())
+	}
+	if len(nodes) == 1 {
+		return root
+	}
+	return b.buildTree(nodes, nil)
+}
+
+// rootExtraCount returns how many leaves finishRoot combines with a built tree's root.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the number of root-level commitments the builder adds
+func (b *TreeBuilder) rootExtraCount() int {
+	count := 0
+	if len(b.PolicyHash) > 0 {
+		count++
+	}
+	if len(b.ReserveAddresses) > 0 {
+		count++
+	}
+	return count
+}
+
+// BuildTreeFromLeafBytes constructs a Merkle tree from leaf data that is already serialized.
+//
+// It hashes with SHA-256; see TreeBuilder.BuildFromLeafBytes.
+//
+// Parameters:
+//   - leaves: the canonical bytes of each leaf, in tree order
+//
+// Returns:
+//   a pointer to the root MerkleNode
+func BuildTreeFromLeafBytes(leaves [][]byte) *MerkleNode {
+	return NewTreeBuilder(nil).BuildFromLeafBytes(leaves)
+}
+
+// BuildFromLeafBytes constructs a Merkle tree from leaf data that is already serialized using the builder's hasher.
+//
+// Each slice is taken as the leaf preimage as is: it is prefixed and hashed, but never parsed, validated or reordered, so callers that store canonical balance bytes skip marshalling entirely. Passing the canonical JSON of each balance in the order Build sorts them reproduces Build's root. One buffer is reused for the prefixed data across all leaves.
+//
+// Parameters:
+//   - leaves: the canonical bytes of each leaf, in tree order
+//
+// Returns:
+//   a pointer to the root MerkleNode
+func (b *TreeBuilder) BuildFromLeafBytes(leaves [][]byte) *MerkleNode {
+	start := time.Now()
+	progress := b.newProgress(HashOpCount(len(leaves)))
+	arena := newNodeArena(len(leaves))
+	nodes := make([]*MerkleNode, len(leaves))
+	var buf []byte
+	for i, data := range leaves {
+		buf = append(append(buf[:0], leafPrefix), data...)
+		nodes[i] = arena.alloc()
+		nodes[i].Hash = b.h().Hash(buf)
+		progress.advance(1)
+	}
+
+	root := b.finishRoot(b.buildTree(nodes, progress))
+	progress.report()
+	b.observeBuild(time.Since(start), len(nodes), treeDepth(len(nodes)))
+	return root
+}
+
+type Attestation struct {
+	Root   string             `json:"root"`
+	Totals map[string]float64 `json:"totals"`
+}
+
+// createMerkleTreeWithTotals constructs a Merkle tree and the committed total of each asset in one pass.
+//
+// It hashes with SHA-256; see TreeBuilder.BuildWithTotals.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree
+//
+// Returns:
+//   a pointer to the root MerkleNode, the signed total of each asset, or an error if a balance is negative or cannot be marshalled
+func createMerkleTreeWithTotals(accounts []Account) (*MerkleNode, map[string]float64, error) {
+	return NewTreeBuilder(nil).BuildWithTotals(accounts)
+}
+
+// BuildWithTotals constructs a Merkle tree and the committed total of each asset in one pass using the builder's hasher.
+//
+// It works like Build and adds each balance's signed amount, weighted if ApplyWeights is set, to its asset's total as the leaf is hashed. Balances are summed in the tree's canonical leaf order, so the totals are bit-for-bit identical for the same inputs regardless of account order.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree
+//
+// Returns:
+//   a pointer to the root MerkleNode, the signed total of each asset, or an error if a balance is negative or cannot be marshalled
+func (b *TreeBuilder) BuildWithTotals(accounts []Account) (*MerkleNode, map[string]float64, error) {
+	start := time.Now()
+	accounts, err := b.prepareAccounts(accounts)
+	if err != nil {
+		return nil, nil, err
+	}
+	allBalances := flattenBalances(accounts)
+	progress := b.newProgress(HashOpCount(len(allBalances)))
+
+	leaves := make([]*MerkleNode, len(allBalances))
+	totals := make(map[string]float64)
+	for i, entry := range allBalances {
+		leaf, err := b.hashBalanceLeaf(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		leaves[i] = leaf
+		progress.advance(1)
+		balance, err := leafBalance(entry.balance, b.ApplyWeights)
+		if err != nil {
+			return nil, nil, err
+		}
+		amount, err := balance.SignedAmount()
+		if err != nil {
+			return nil, nil, err
+		}
+		totals[entry.balance.Asset] += amount
+	}
+
+	root := b.finishRoot(b.buildTree(leaves, progress))
+	progress.report()
+	b.observeBuild(time.Since(start), len(leaves), treeDepth(len(leaves)))
+	return root, totals, nil
+}
+
+// AttestAccounts builds the Merkle tree for a set of accounts and packages its root with the per-asset totals for publication.
+//
+// It is meant for proof-of-reserves reports, where auditors compare the committed totals against on-chain holdings. The result marshals directly to JSON.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to attest to
+//
+// Returns:
+//   an Attestation holding the hex-encoded root and the signed total of each asset, or an error if a balance is negative or cannot be marshalled
+func AttestAccounts(accounts []Account) (Attestation, error) {
+	root, totals, err := createMerkleTreeWithTotals(accounts)
+	if err != nil {
+		return Attestation{}, err
+	}
+	return Attestation{Root: root.RootHex(), Totals: totals}, nil
+}
+
+// VerifyAttestedTotals compares the per-asset totals a tree commits to against externally attested totals, such as on-chain holdings.
+//
+// Every asset in either map is checked, and an asset missing from one side counts as zero there. Floating-point sums rarely agree to the last bit, so a difference of up to tolerance is accepted.
+//
+// Parameters:
+//   - committed: the totals returned by BuildWithTotals or published in an Attestation
+//   - attested: the totals to check them against
+//   - tolerance: the largest absolute difference accepted for an asset
+//
+// Returns:
+//   whether every asset is within tolerance, and the difference attested minus committed for each asset that is not
+func VerifyAttestedTotals(committed, attested map[string]float64, tolerance float64) (bool, map[string]float64) {
+	discrepancies := TotalsDelta(committed, attested)
+	for asset, diff := range discrepancies {
+		if math.Abs(diff) <= tolerance {
+			delete(discrepancies, asset)
+		}
+	}
+	return len(discrepancies) == 0, discrepancies
+}
+
+// TotalsDelta computes how each asset's total changed between two sets of per-asset totals, such as the totals of consecutive attestations.
+//
+// Every asset in either map is included, and an asset missing from one side counts as zero there, so an asset listed for the first time in b shows its full total and one dropped from a shows its negated total.
+//
+// Parameters:
+//   - a: the earlier totals
+//   - b: the later totals
+//
+// Returns:
+//   the difference b minus a for every asset in either map
+func TotalsDelta(a, b map[string]float64) map[string]float64 {
+	delta := make(map[string]float64, len(b))
+	for asset, total := range b {
+		delta[asset] = total - a[asset]
+	}
+	for asset, total := range a {
+		if _, ok := b[asset]; !ok {
+			delta[asset] = -total
+		}
+	}
+	return delta
+}
+
+type TreeMetadata struct {
+	Timestamp int64        `json:"timestamp"`
+	Version   uint32       `json:"version"`
+	Label     string       `json:"label,omitempty"`
+	Options   *TreeBuilder `json:"options,omitempty"`
+}
+
+// createMerkleTreeWithMetadata constructs a Merkle tree whose first leaf commits to the snapshot's metadata.
+//
+// It hashes with SHA-256; see TreeBuilder.BuildWithMetadata.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree
+//   - meta: the metadata to commit to
+//
+// Returns:
+//   a pointer to the root MerkleNode, or an error if a balance is negative, an identifier is duplicated or a leaf cannot be marshalled
+func createMerkleTreeWithMetadata(accounts []Account, meta TreeMetadata) (*MerkleNode, error) {
+	return NewTreeBuilder(nil).BuildWithMetadata(accounts, meta)
+}
+
+// BuildWithMetadata constructs a Merkle tree whose first leaf commits to the snapshot's metadata using the builder's hasher.
+//
+// The header leaf is the canonical JSON of meta, with Timestamp in Unix seconds, and is followed by the balance leaves in the order Build uses. The root therefore changes whenever the timestamp, version or label does, even for identical balances, and auditors can check which snapshot a root belongs to with GenerateMetadataProof and VerifyMetadata. Setting meta.Options to the builder publishes its options in the header as well, so a verifier that unmarshals the metadata gets a builder with the same hasher and flags.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree
+//   - meta: the metadata to commit to
+//
+// Returns:
+//   a pointer to the root MerkleNode, or an error if a balance is negative, an identifier is duplicated or a leaf cannot be marshalled
+func (b *TreeBuilder) BuildWithMetadata(accounts []Account, meta TreeMetadata) (*MerkleNode, error) {
+	start := time.Now()
+	accounts, err := b.prepareAccounts(accounts)
+	if err != nil {
+		return nil, err
+	}
+	allBalances := flattenBalances(accounts)
+
+	progress := b.newProgress(HashOpCount(len(allBalances) + 1))
+
+	header, err := b.hashMetadata(meta)
+	if err != nil {
+		return nil, err
+	}
+	progress.advance(1)
+	leaves := make([]*MerkleNode, 0, len(allBalances)+1)
+	leaves = append(leaves, &MerkleNode{Hash: header})
+	for _, entry := range allBalances {
+		leaf, err := b.hashBalanceLeaf(entry)
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, leaf)
+		progress.advance(1)
+	}
+
+	root := b.finishRoot(b.buildTree(leaves, progress))
+	progress.report()
+	b.observeBuild(time.Since(start), len(leaves), treeDepth(len(leaves)))
+	return root, nil
+}
+
+// hashMetadata computes the header leaf hash for a snapshot's metadata.
+//
+// Parameters:
+//   - meta: the metadata to hash
+//
+// Returns:
+//   the header leaf hash, or an error if the metadata cannot be marshalled
+func (b *TreeBuilder) hashMetadata(meta TreeMetadata) ([32]byte, error) {
+	data, err := marshalCanonical(meta)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("marshal tree metadata: %w", err)
+	}
+	return hashLeaf(b.h(), data), nil
+}
+
+// GenerateMetadataProof builds a proof that a tree built by createMerkleTreeWithMetadata commits to the given metadata.
+//
+// Parameters:
+//   - root: the root of the tree
+//   - meta: the metadata the tree was built with
+//
+// Returns:
+//   the proof steps from the header leaf up to the root, or an error if the metadata cannot be marshalled or its leaf is not in the tree
+func GenerateMetadataProof(root *MerkleNode, meta TreeMetadata) ([]ProofStep, error) {
+	header, err := NewTreeBuilder(nil).hashMetadata(meta)
+	if err != nil {
+		return nil, err
+	}
+	return GenerateProof(root, header)
+}
+
+// VerifyMetadata checks that a SHA-256 root commits to the given metadata as its header leaf.
+//
+// It verifies the proof with the default SHA-256 tree builder; see TreeBuilder.VerifyMetadata.
+//
+// Parameters:
+//   - root: the published root hash
+//   - meta: the claimed metadata
+//   - proof: the proof from GenerateMetadataProof
+//
+// Returns:
+//   true if meta is the tree's header leaf, false otherwise
+func VerifyMetadata(root [32]byte, meta TreeMetadata, proof []ProofStep) bool {
+	return NewTreeBuilder(nil).VerifyMetadata(root, meta, proof)
+}
+
+// VerifyMetadata checks that a root built with this builder's hasher commits to the given metadata as its header leaf.
+//
+// Besides verifying inclusion, it requires every sibling to sit on the right, which places the leaf at position 0. A balance leaf that happened to encode the same bytes elsewhere in the tree therefore cannot pass as the header.
+//
+// Parameters:
+//   - root: the published root hash
+//   - meta: the claimed metadata
+//   - proof: the proof from GenerateMetadataProof
+//
+// Returns:
+//   true if meta is the tree's header leaf, false otherwise
+func (b *TreeBuilder) VerifyMetadata(root [32]byte, meta TreeMetadata, proof []ProofStep) bool {
+	for _, step := range proof {
+		if step.IsLeft {
+			return false
+		}
+	}
+	header, err := b.hashMetadata(meta)
+	if err != nil {
+		return false
+	}
+	return b.VerifyProof(header, proof, root)
+}
+
+// flattenBalances collects every balance of every account into a single, canonically ordered slice.
+//
+// It keeps each balance paired with the identifier of the account that holds it, so errors can name the offending account, and sorts the result by account identifier and then asset so the same data always produces the same root regardless of input order.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to flatten
+//
+// Returns:
+//   a slice of accountBalance entries sorted by identifier, asset, amount and sign
+func flattenBalances(accounts []Account) []accountBalance {
+	var allBalances []accountBalance
+	for _, account := range accounts {
+		for _, balance := range account.Balances {
+			allBalances = append(allBalances, accountBalance{identifier: account.Identifier, balance: balance})
+		}
+	}
+
+	sort.Slice(allBalances, func(i, j int) bool {
+		a, b := allBalances[i], allBalances[j]
+		if a.identifier != b.identifier {
+			return a.identifier < b.identifier
+		}
+		if a.balance.Asset != b.balance.Asset {
+			return a.balance.Asset < b.balance.Asset
+		}
+		if a.balance.Balance != b.balance.Balance {
+			return a.balance.Balance < b.balance.Balance
+		}
+		return a.balance.Sign < b.balance.Sign
+	})
+
+	return allBalances
+}
+
+// hashBalanceLeaf marshals a single balance and hashes it into a leaf node.
+//
+// It JSON-encodes the balance and hashes the result with the builder's hasher under the leaf prefix.
+//
+// Parameters:
+//   - entry: the balance to hash, paired with its account identifier
+//
+// Returns:
+//   a pointer to the leaf MerkleNode, or an error naming the account and asset if the balance is negative or cannot be marshalled
+func (b *TreeBuilder) hashBalanceLeaf(entry accountBalance) (*MerkleNode, error) {
+	hash, err := b.hashBalance(entry)
+	if err != nil {
+		return nil, err
+	}
+	return &MerkleNode{Hash: hash}, nil
+}
+
+// hashBalance computes the leaf hash of a single balance.
+//
+// It is hashBalanceLeaf without the node allocation, so builders can place the hash into nodes from an arena.
+//
+// Parameters:
+//   - entry: the balance to hash, paired with its account identifier
+//
+// Returns:
+//   the leaf hash, or an error naming the account and asset if the balance is negative or cannot be marshalled
+func (b *TreeBuilder) hashBalance(entry accountBalance) ([32]byte, error) {
+	return b.hashBalanceWith(entry, &leafEncoder{})
+}
+
+// hashBalanceWith computes the leaf hash of a single balance, serializing it into a reusable encoder.
+//
+// Builders that hash many balances on one goroutine pass the same encoder for each, so the serialization buffer is allocated once per worker rather than once per leaf. The asset is mapped through AssetCanonicalizer first, so proofs for a synonym verify against a canonicalized root, and the amount is weighted if ApplyWeights is set.
+//
+// Parameters:
+//   - entry: the balance to hash, paired with its account identifier
+//   - enc: the encoder to serialize with, owned by the calling goroutine
+//
+// Returns:
+//   the leaf hash, or an error naming the account and asset if the balance is negative or cannot be marshalled
+func (b *TreeBuilder) hashBalanceWith(entry accountBalance, enc *leafEncoder) ([32]byte, error) {
+	data, err := b.leafData(entry, enc)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return b.h().Hash(data), nil
+}
+
+// leafData serializes a single balance into the exact bytes its leaf hash is computed over.
+//
+// It applies AssetCanonicalizer, the balance checks and ApplyWeights, then writes the leaf prefix and the canonical balance into the encoder's buffer.
+//
+// Parameters:
+//   - entry: the balance to serialize, paired with its account identifier
+//   - enc: the encoder to serialize with, owned by the calling goroutine
+//
+// Returns:
+//   the leaf bytes, valid until the encoder's next use, or an error naming the account and asset if the balance is negative or cannot be marshalled
+func (b *TreeBuilder) leafData(entry accountBalance, enc *leafEncoder) ([]byte, error) {
+	entry.balance.Asset = b.canonicalAsset(entry.balance.Asset)
+	if err := b.checkBalance(entry.identifier, entry.balance); err != nil {
+		return nil, err
+	}
+	balance, err := leafBalance(entry.balance, b.ApplyWeights)
+	if err != nil {
+		return nil, fmt.Errorf("account %s: %w", entry.identifier, err)
+	}
+	data, err := enc.encode(balance)
+	if err != nil {
+		return nil, fmt.Errorf("marshal balance for account %s asset %s: %w", entry.identifier, entry.balance.Asset, err)
+	}
+	return data, nil
+}
+
+type leafEncoder struct {
+	buf []byte
+}
+
+// encode serializes a balance into the encoder's buffer as the bytes of its leaf.
+//
+// The bytes are the leaf prefix followed by exactly what marshalCanonical produces for the balance, but written directly instead of through encoding/json, and the buffer is kept for the next call.
+//
+// Parameters:
+//   - balance: the balance to encode
+//
+// Returns:
+//   the leaf bytes, valid until the next call, or an error if the amount is not a finite number
+func (e *leafEncoder) encode(balance Balance) ([]byte, error) {
+	buf, err := appendCanonicalBalance(append(e.buf[:0], leafPrefix), balance)
+	if err != nil {
+		return nil, err
+	}
+	e.buf = buf
+	return buf, nil
+}
+
+// LeafPreimage returns the exact bytes hashed into a leaf of a tree built by createMerkleTreeForAccounts.
+//
+// It uses the default SHA-256 tree builder; see TreeBuilder.LeafPreimage.
+//
+// Parameters:
+//   - accounts: the accounts the tree was built from
+//   - index: the position of the leaf, as in Leaves
+//
+// Returns:
+//   the leaf's preimage, or an error wrapping ErrLeafNotFound if index is out of range, or the error Build would return for the accounts
+func LeafPreimage(accounts []Account, index int) ([]byte, error) {
+	return NewTreeBuilder(nil).LeafPreimage(accounts, index)
+}
+
+// LeafPreimage returns the exact bytes hashed into a leaf of the tree Build produces for a set of accounts.
+//
+// The preimage is the leaf prefix followed by the balance's canonical JSON, after the builder's asset canonicalization and weighting, so an auditor can hash it with the builder's hasher and compare the result with Leaves()[index] without trusting the encoder. The accounts are ordered as Build orders them, so the index matches the tree's leaf positions.
+//
+// Parameters:
+//   - accounts: the accounts the tree was built from
+//   - index: the position of the leaf, as in Leaves
+//
+// Returns:
+//   the leaf's preimage, or an error wrapping ErrLeafNotFound if index is out of range, or the error Build would return for the accounts
+func (b *TreeBuilder) LeafPreimage(accounts []Account, index int) ([]byte, error) {
+	accounts, err := b.prepareAccounts(accounts)
+	if err != nil {
+		return nil, err
+	}
+	allBalances := flattenBalances(accounts)
+	if index < 0 || index >= len(allBalances) {
+		return nil, fmt.Errorf("%w: leaf %d of %d", ErrLeafNotFound, index, len(allBalances))
+	}
+	return b.leafData(allBalances[index], &leafEncoder{})
+}
+
+// appendCanonicalBalance appends the RFC 8785 encoding of a balance.
+//
+// Its keys are already in JCS order, and the sign is left out for credits to match the omitempty tag on Balance.
+//
+// Parameters:
+//   - buf: the buffer to append to
+//   - balance: the balance to encode
+//
+// Returns:
+//   the extended buffer, or an error if the amount is not a finite number
+func appendCanonicalBalance(buf []byte, balance Balance) ([]byte, error) {
+	buf = append(buf, `{"asset":`...)
+	buf = appendCanonicalString(buf, balance.Asset)
+	buf = append(buf, `,"balance":`...)
+	buf, err := appendCanonicalNumber(buf, balance.Balance)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Sign != Credit {
+		buf = append(buf, `,"sign":`...)
+		buf = appendCanonicalString(buf, string(balance.Sign))
+	}
+	return append(buf, '}'), nil
+}
+
+// marshalCanonical serializes a value as RFC 8785 (JCS) canonical JSON.
+//
+// It encodes the value with encoding/json and re-emits the result with object keys sorted by UTF-16 code units, numbers in the ECMAScript shortest form and strings with only the escapes JCS requires. Leaf bytes therefore depend only on the data, not on struct field order or on encoding/json's choices in a given Go version.
+//
+// Parameters:
+//   - v: the value to serialize
+//
+// Returns:
+//   the canonical JSON bytes, or an error if the value cannot be marshalled or holds a non-finite number
+func marshalCanonical(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	return appendCanonicalJSON(nil, decoded)
+}
+
+// appendCanonicalJSON appends the JCS encoding of a decoded JSON value.
+//
+// Parameters:
+//   - buf: the buffer to append to
+//   - v: a value produced by json.Unmarshal into an any
+//
+// Returns:
+//   the extended buffer, or an error if the value holds a non-finite number or an unexpected type
+func appendCanonicalJSON(buf []byte, v any) ([]byte, error) {
+	switch value := v.(type) {
+	case nil:
+		return append(buf, "null"...), nil
+	case bool:
+		return strconv.AppendBool(buf, value), nil
+	case float64:
+		return appendCanonicalNumber(buf, value)
+	case string:
+		return appendCanonicalString(buf, value), nil
+	case []any:
+		buf = append(buf, '[')
+		for i, element := range value {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			var err error
+			if buf, err = appendCanonicalJSON(buf, element); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, ']'), nil
+	case map[string]any:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return lessUTF16(keys[i], keys[j])
+		})
+
+		buf = append(buf, '{')
+		for i, key := range keys {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendCanonicalString(buf, key)
+			buf = append(buf, ':')
+			var err error
+			if buf, err = appendCanonicalJSON(buf, value[key]); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, '}'), nil
+	default:
+		return nil, fmt.Errorf("unsupported JSON value of type %T", v)
+	}
+}
+
+// appendCanonicalNumber appends a number in the ECMAScript Number.prototype.toString form that JCS requires.
+//
+// It writes plain decimals for magnitudes in [1e-6, 1e21) and exponent notation without a leading-zero exponent otherwise, always using the shortest representation that round-trips.
+//
+// Parameters:
+//   - buf: the buffer to append to
+//   - x: the number to encode
+//
+// Returns:
+//   the extended buffer, or an error if x is NaN or infinite
+func appendCanonicalNumber(buf []byte, x float64) ([]byte, error) {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return nil, fmt.Errorf("non-finite number %v", x)
+	}
+	if x == 0 {
+		return append(buf, '0'), nil
+	}
+
+	abs := math.Abs(x)
+	if abs >= 1e-6 && abs < 1e21 {
+		return strconv.AppendFloat(buf, x, 'f', -1, 64), nil
+	}
+
+	formatted := strconv.FormatFloat(x, 'e', -1, 64)
+	mantissa, exponent, _ := strings.Cut(formatted, "e")
+	sign, digits := exponent[:1], strings.TrimLeft(exponent[1:], "0")
+	buf = append(buf, mantissa...)
+	buf = append(buf, 'e')
+	buf = append(buf, sign...)
+	return append(buf, digits...), nil
+}
+
+// appendCanonicalString appends a quoted string with the escaping JCS requires.
+//
+// It escapes only the quote, the backslash and control characters, using the short forms where JSON has them and lowercase \u00xx otherwise. Every other character, including <, > and &, is written as UTF-8, and invalid UTF-8 bytes become U+FFFD as they do in encoding/json.
+//
+// Parameters:
+//   - buf: the buffer to append to
+//   - s: the string to encode
+//
+// Returns:
+//   the extended buffer
+func appendCanonicalString(buf []byte, s string) []byte {
+	const hexDigits = "0123456789abcdef"
+
+	buf = append(buf, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				buf = append(buf, "\ufffd"...)
+			} else {
+				buf = append(buf, s[i:i+size]...)
+			}
+			i += size
+			continue
+		}
+
+		switch {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c == '\b':
+			buf = append(buf, '\\', 'b')
+		case c == '\t':
+			buf = append(buf, '\\', 't')
+		case c == '\n':
+			buf = append(buf, '\\', 'n')
+		case c == '\f':
+			buf = append(buf, '\\', 'f')
+		case c == '\r':
+			buf = append(buf, '\\', 'r')
+		case c < 0x20:
+			buf = append(buf, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			buf = append(buf, c)
+		}
+		i++
+	}
+	return append(buf, '"')
+}
+
+// lessUTF16 orders two strings by their UTF-16 code units, as JCS requires for object keys.
+//
+// Parameters:
+//   - a: the first string
+//   - b: the second string
+//
+// Returns:
+//   true if a sorts before b
+func lessUTF16(a, b string) bool {
+	x, y := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if x[i] != y[i] {
+			return x[i] < y[i]
+		}
+	}
+	return len(x) < len(y)
+}
+
+// hashLeaf hashes leaf data with the leaf domain prefix.
+//
+// It prepends the 0x00 leaf prefix to the data and hashes it with the given hasher.
+//
+// Parameters:
+//   - h: the Hasher to use
+//   - data: the serialized leaf data
+//
+// Returns:
+//   the hash of 0x00 || data
+func hashLeaf(h Hasher, data []byte) [32]byte {
+	buf := make([]byte, 0, 1+len(data))
+	buf = append(buf, leafPrefix)
+	buf = append(buf, data...)
+	return h.Hash(buf)
+}
+
+// hashChildren hashes two child hashes into their parent hash with the internal node domain prefix.
+//
+// It copies the 0x01 internal prefix and both child hashes into a fixed local buffer and hashes the result with the given hasher, so neither input is ever written to.
+//
+// Parameters:
+//   - h: the Hasher to use
+//   - left: the hash of the left child
+//   - right: the hash of the right child
+//
+// Returns:
+//   the hash of 0x01 || left || right
+func hashChildren(h Hasher, left, right [32]byte) [32]byte {
+	var buf [65]byte
+	buf[0] = internalPrefix
+	copy(buf[1:33], left[:])
+	copy(buf[33:], right[:])
+	return h.Hash(buf[:])
+}
+
+// equalHashes compares two hashes in constant time.
+//
+// Verifiers compare attacker-supplied proofs against published roots, and an early-exit comparison would reveal through its timing how many leading bytes matched. Every hash comparison in proof verification and validation goes through this function.
+//
+// Parameters:
+//   - a: the first hash
+//   - b: the second hash
+//
+// Returns:
+//   true if the hashes are equal, false otherwise
+func equalHashes(a, b [32]byte) bool {
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// buildTree constructs a Merkle tree from a slice of MerkleNode pointers.
+//
+// It takes a slice of MerkleNode pointers and builds a Merkle tree by combining the hashes of the nodes with SHA-256.
+//
+// Parameters:
+//   - nodes: a slice of pointers to MerkleNode, representing the leaf nodes of the tree.
+//
+// Returns:
+//   a pointer to the root MerkleNode of the constructed Merkle tree, or the empty-tree root if the input slice is empty.
+func buildTree(nodes []*MerkleNode) *MerkleNode {
+	return NewTreeBuilder(nil).buildTree(nodes, nil)
+}
+
+// buildTree constructs a Merkle tree from a slice of MerkleNode pointers using the builder's hasher.
+//
+// It takes a slice of MerkleNode pointers and builds a Merkle tree by combining the hashes of the nodes with a hash accumulator, pairing nodes level by level as BuildAccumulatorTree does. Progress is reported at the start of each level and every progressInterval combined pairs.
+//
+// Parameters:
+//   - nodes: a slice of pointers to MerkleNode, representing the leaf nodes of the tree.
+//   - progress: the tracker for the build, or nil to report nothing
+//
+// Returns:
+//   a pointer to the root MerkleNode of the constructed Merkle tree, or the empty-tree root if the input slice is empty.
+func (b *TreeBuilder) buildTree(nodes []*MerkleNode, progress *buildProgress) *MerkleNode {
+	if len(nodes) == 0 {
+		return b.emptyRoot()
+	}
+
+	acc := hashAccumulator{hasher: b.h(), arena: newNodeArena(len(nodes) - 1), zeroPair: b.PairWithZero}
+	for len(nodes) > 1 {
+		progress.report()
+		nextLevel := make([]*MerkleNode, 0, (len(nodes)+1)/2)
+		for i := 0; i < len(nodes); i += 2 {
+			var right *MerkleNode
+			if i+1 < len(nodes) {
+				right = nodes[i+1]
+			}
+			nextLevel = append(nextLevel, acc.Combine(nodes[i], right))
+			if right != nil {
+				progress.advance(1)
+			}
+		}
+		nodes = nextLevel
+	}
+	return nodes[0]
+}
+
+// emptyRoot returns the canonical root of a tree with no leaves.
+//
+// It is the hash of empty input, SHA-256("") by default. Every leaf and internal node is hashed with a domain prefix, so the empty root can never collide with the root of a non-empty tree. Constructors return it instead of nil so callers can always rely on a non-nil root.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   a pointer to a childless MerkleNode holding the empty-tree hash
+func (b *TreeBuilder) emptyRoot() *MerkleNode {
+	return &MerkleNode{Hash: b.h().Hash(nil)}
+}
+
+// RootOnly computes the root of a SHA-256 tree over the given leaf hashes without building the tree.
+//
+// It hashes with SHA-256; see TreeBuilder.RootOnly.
+//
+// Parameters:
+//   - leaves: the leaf hashes in tree order, as returned by Leaves
+//
+// Returns:
+//   the root hash, or an error if a leaf is not 32 bytes long
+func RootOnly(leaves [][]byte) ([32]byte, error) {
+	return NewTreeBuilder(nil).RootOnly(leaves)
+}
+
+// RootOnly computes the root of a tree over the given leaf hashes with the builder's hasher, without building the tree.
+//
+// It keeps a single slice of hashes and overwrites it in place as each level is combined, carrying an unpaired last hash up unchanged or, with PairWithZero, pairing it with the zero hash, so no MerkleNode is allocated and the only memory held is one hash per leaf. The result equals the Hash of the root buildTree would return for the same leaves.
+//
+// Parameters:
+//   - leaves: the leaf hashes in tree order, as returned by Leaves
+//
+// Returns:
+//   the root hash, or the empty-tree root if there are no leaves, or an error if a leaf is not 32 bytes long
+func (b *TreeBuilder) RootOnly(leaves [][]byte) ([32]byte, error) {
+	if len(leaves) == 0 {
+		return b.emptyRoot().Hash, nil
+	}
+
+	level := make([][32]byte, len(leaves))
+	for i, leaf := range leaves {
+		if len(leaf) != len(level[i]) {
+			return [32]byte{}, fmt.Errorf("leaf %d: got %d bytes, expected %d", i, len(leaf), len(level[i]))
+		}
+		copy(level[i][:], leaf)
+	}
+
+	for len(level) > 1 {
+		half := len(level) / 2
+		for i := 0; i < half; i++ {
+			level[i] = hashChildren(b.h(), level[2*i], level[2*i+1])
+		}
+		if len(level)%2 == 1 {
+			level[half] = level[len(level)-1]
+			if b.PairWithZero {
+				level[half] = hashChildren(b.h(), level[half], [32]byte{})
+			}
+		}
+		level = level[:(len(level)+1)/2]
+	}
+	return level[0], nil
+}
+
+type Accumulator[N any] interface {
+	Combine(left, right N) N
+}
+
+// BuildAccumulatorTree builds a binary tree bottom-up using a custom accumulator to combine nodes.
+//
+// It pairs adjacent nodes level by level and recursively combines them until a single root remains. An unpaired last node is passed to Combine with the zero value as its right sibling.
+//
+// Parameters:
+//   - nodes: the leaf nodes of the tree
+//   - acc: the accumulator that combines two child nodes into their parent
+//
+// Returns:
+//   the root node of the constructed tree, or the zero value if the input slice is empty
+func BuildAccumulatorTree[N any](nodes []N, acc Accumulator[N]) N {
+	if len(nodes) == 0 {
+		var zero N
+		return zero
+	}
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+
+	nextLevel := make([]N, 0, (len(nodes)+1)/2)
+
+	for i := 0; i < len(nodes); i += 2 {
+		var right N
+		if i+1 < len(nodes) {
+			right = nodes[i+1]
+		}
+		nextLevel = append(nextLevel, acc.Combine(nodes[i], right))
+	}
+
+	return BuildAccumulatorTree(nextLevel, acc)
+}
+
+type hashAccumulator struct {
+	hasher   Hasher
+	arena    *nodeArena
+	zeroPair bool
+}
+
+// Combine hashes two MerkleNodes into their parent node.
+//
+// It hashes the left and right hashes together under the internal node prefix. An unpaired last node is carried up to the next level unchanged rather than paired with a duplicate of itself, which would let two different leaf sets share a root. With zeroPair set it is instead paired with a childless sibling holding the all-zero hash, the convention of verifiers that expect every level to be hashed; the sibling is a real node, so proofs through it are generated and verified as usual, and Leaves and LeafCount include it.
+//
+// Parameters:
+//   - left: the left child node
+//   - right: the right child node, or nil if left is the unpaired last node
+//
+// Returns:
+//   a pointer to the parent MerkleNode, or left itself if it has no sibling and zeroPair is not set
+func (a hashAccumulator) Combine(left, right *MerkleNode) *MerkleNode {
+	if right == nil {
+		if !a.zeroPair {
+			return left
+		}
+		right = &MerkleNode{}
+	}
+
+	var node *MerkleNode
+	if a.arena != nil {
+		node = a.arena.alloc()
+	} else {
+		node = &MerkleNode{}
+	}
+	node.Hash = hashChildren(a.hasher, left.Hash, right.Hash)
+	node.Left = left
+	node.Right = right
+	return node
+}
+
+const nodeArenaBlockSize = 1024
+
+type nodeArena struct {
+	block []MerkleNode
+}
+
+// newNodeArena creates an arena with room for the given number of nodes in one contiguous block.
+//
+// Building a tree of n leaves needs exactly n-1 internal nodes, so sizing the arena up front turns millions of small allocations into one. The whole block stays alive as long as any node in it does, which is fine for trees that are kept or dropped as a unit.
+//
+// Parameters:
+//   - size: the number of nodes to reserve
+//
+// Returns:
+//   a pointer to the arena
+func newNodeArena(size int) *nodeArena {
+	if size < 0 {
+		size = 0
+	}
+	return &nodeArena{block: make([]MerkleNode, size)}
+}
+
+// alloc hands out the next zeroed node from the arena.
+//
+// It starts a new block of nodeArenaBlockSize nodes when the current one is used up. An arena is not safe for concurrent use.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   a pointer to a zeroed MerkleNode
+func (a *nodeArena) alloc() *MerkleNode {
+	if len(a.block) == 0 {
+		a.block = make([]MerkleNode, nodeArenaBlockSize)
+	}
+	node := &a.block[0]
+	a.block = a.block[1:]
+	return node
+}
+
+// levelPool recycles the scratch slices the parallel builder uses for each level between builds.
+var levelPool = sync.Pool{
+	New: func() any { return new([]*MerkleNode) },
+}
+
+type SumNode struct {
+	Hash  [32]byte
+	Sum   float64
+	Left  *SumNode
+	Right *SumNode
+}
+
+type hashSumAccumulator struct {
+	hasher Hasher
+}
+
+// Combine hashes two SumNodes into a parent that commits to both child hashes and their subtree totals.
+//
+// It hashes each child's hash together with its big-endian encoded sum under the internal node prefix, and sets the parent's sum to the total of both children. An unpaired last node is carried up unchanged.
+//
+// Parameters:
+//   - left: the left child node
+//   - right: the right child node, or nil if left is the unpaired last node
+//
+// Returns:
+//   a pointer to the parent SumNode, or left itself if it has no sibling
+func (a hashSumAccumulator) Combine(left, right *SumNode) *SumNode {
+	if right == nil {
+		return left
+	}
+
+	var buf [81]byte
+	buf[0] = internalPrefix
+	copy(buf[1:33], left.Hash[:])
+	binary.BigEndian.PutUint64(buf[33:41], math.Float64bits(left.Sum))
+	copy(buf[41:73], right.Hash[:])
+	binary.BigEndian.PutUint64(buf[73:], math.Float64bits(right.Sum))
+
+	return &SumNode{
+		Hash:  a.hasher.Hash(buf[:]),
+		Sum:   left.Sum + right.Sum,
+		Left:  left,
+		Right: right,
+	}
+}
+
+// createSumTreeForAsset constructs a hash+sum tree over every balance of a single asset.
+//
+// It hashes each matching balance into a leaf that also carries its signed amount, so every internal node stores the total of its subtree and the root holds the asset's total.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing the balances to include
+//   - asset: the asset symbol whose balances are committed to
+//
+// Returns:
+//   a pointer to the root SumNode, or an empty-tree root with a zero sum if no account holds the asset, or an error if a balance is negative or cannot be marshalled
+func createSumTreeForAsset(accounts []Account, asset string) (*SumNode, error) {
+	b := NewTreeBuilder(nil)
+	if err := ValidateSigns(accounts); err != nil {
+		return nil, err
+	}
+
+	var leaves []*SumNode
+	for _, entry := range flattenBalances(accounts) {
+		if entry.balance.Asset != asset {
+			continue
+		}
+		leaf, err := b.hashBalanceLeaf(entry)
+		if err != nil {
+			return nil, err
+		}
+		amount, err := entry.balance.SignedAmount()
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, &SumNode{Hash: leaf.Hash, Sum: amount})
+	}
+
+	if len(leaves) == 0 {
+		return &SumNode{Hash: b.emptyRoot().Hash}, nil
+	}
+	return BuildAccumulatorTree[*SumNode](leaves, hashSumAccumulator{hasher: b.h()}), nil
+}
+
+// createMerkleTreeForAccountsConcurrent creates a Merkle tree from a slice of accounts concurrently.
+//
+// It takes a slice of Account structs and returns a pointer to the root MerkleNode of the constructed tree, hashing with SHA-256.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree.
+//
+// Returns:
+//   a pointer to the root MerkleNode representing the constructed Merkle tree, or the first error encountered while validating or marshalling a balance.
+func createMerkleTreeForAccountsConcurrent(accounts []Account) (*MerkleNode, error) {
+	return NewTreeBuilder(nil).BuildConcurrent(accounts)
+}
+
+// createMerkleTreeForAccountsConcurrentCtx creates a Merkle tree from a slice of accounts concurrently, stopping early if the context is cancelled.
+//
+// It hashes with SHA-256; see TreeBuilder.BuildConcurrentCtx.
+//
+// Parameters:
+//   - ctx: the context that bounds the build
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree.
+//
+// Returns:
+//   a pointer to the root MerkleNode representing the constructed Merkle tree, or ctx.Err() if the context is cancelled, or the first error encountered while validating or marshalling a balance.
+func createMerkleTreeForAccountsConcurrentCtx(ctx context.Context, accounts []Account) (*MerkleNode, error) {
+	return NewTreeBuilder(nil).BuildConcurrentCtx(ctx, accounts)
+}
+
+// ConcurrentThreshold is the leaf count at which BuildAuto switches from the sequential builder to the concurrent one.
+//
+// Below it, goroutine start-up and coordination cost more than hashing the leaves on one core.
+var ConcurrentThreshold = 1024
+
+// CreateMerkleTreeAuto creates a Merkle tree from a slice of accounts, building concurrently only when the input is large enough to benefit.
+//
+// It hashes with SHA-256; see TreeBuilder.BuildAuto.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree.
+//
+// Returns:
+//   a pointer to the root MerkleNode representing the constructed Merkle tree, or the first error encountered while validating or marshalling a balance.
+func CreateMerkleTreeAuto(accounts []Account) (*MerkleNode, error) {
+	return NewTreeBuilder(nil).BuildAuto(accounts)
+}
+
+// BuildAuto creates a Merkle tree from a slice of accounts, choosing between Build and BuildConcurrent by leaf count.
+//
+// It counts the balances across all accounts, which is cheap compared to hashing them, and uses the concurrent builder once the count reaches ConcurrentThreshold. Both builders produce the same root.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree.
+//
+// Returns:
+//   a pointer to the root MerkleNode representing the constructed Merkle tree, or the first error encountered while validating or marshalling a balance.
+func (b *TreeBuilder) BuildAuto(accounts []Account) (*MerkleNode, error) {
+	leafCount := 0
+	for _, account := range accounts {
+		leafCount += len(account.Balances)
+	}
+
+	if leafCount < ConcurrentThreshold {
+		return b.Build(accounts)
+	}
+	return b.BuildConcurrent(accounts)
+}
+
+// BuildConcurrent creates a Merkle tree from a slice of accounts concurrently using the builder's hasher.
+//
+// It takes a slice of Account structs and returns a pointer to the root MerkleNode of the constructed tree. The first marshalling error from any worker cancels the remaining workers.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree.
+//
+// Returns:
+//   a pointer to the root MerkleNode representing the constructed Merkle tree, or the first error encountered while validating or marshalling a balance.
+func (b *TreeBuilder) BuildConcurrent(accounts []Account) (*MerkleNode, error) {
+	return b.BuildConcurrentCtx(context.Background(), accounts)
+}
+
+// BuildConcurrentCtx creates a Merkle tree from a slice of accounts concurrently, stopping early if the context is cancelled.
+//
+// It works like BuildConcurrent, but every worker checks the context between leaves and the tree is not built further once it is done, so a cancelled or timed-out caller gets its goroutines back promptly instead of waiting for every chunk to finish. A panic inside a worker, for example from a faulty Hasher, is recovered and returned as an error wrapping ErrWorkerPanic that names the chunk and account, and cancels the other workers like any other error. Progress is reported every progressInterval leaves across all workers, at the start of each tree level and once the tree is complete. The Observer is only called for builds that finish.
+//
+// Parameters:
+//   - ctx: the context that bounds the build
+//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree.
+//
+// Returns:
+//   a pointer to the root MerkleNode representing the constructed Merkle tree, or ctx.Err() if the context is cancelled, or the first error encountered while validating or marshalling a balance.
+func (b *TreeBuilder) BuildConcurrentCtx(ctx context.Context, accounts []Account) (*MerkleNode, error) {
+	start := time.Now()
+	accounts, err := b.prepareAccounts(accounts)
+	if err != nil {
+		return nil, err
+	}
+	allBalances := flattenBalances(accounts)
+
+	total := HashOpCount(len(allBalances))
+	leafBlock := make([]MerkleNode, len(allBalances))
+	leaves := make([]*MerkleNode, len(allBalances))
+	numWorkers := b.workerCount()
+	chunkSize := (len(allBalances) + numWorkers - 1) / numWorkers
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		hashed   atomic.Int64
+	)
+
+	for lo := 0; lo < len(allBalances); lo += chunkSize {
+		hi := lo + chunkSize
+		if hi > len(allBalances) {
+			hi = len(allBalances)
+		}
+
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			j := lo
+			defer func() {
+				if r := recover(); r != nil {
+					err := fmt.Errorf("%w: leaf worker for balances %d-%d at account %s: %v", ErrWorkerPanic, lo, hi-1, allBalances[j].identifier, r)
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}()
+			var enc leafEncoder
+			for ; j < hi; j++ {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				hash, err := b.hashBalanceWith(allBalances[j], &enc)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+				leafBlock[j].Hash = hash
+				leaves[j] = &leafBlock[j]
+				if n := hashed.Add(1); n%progressInterval == 0 {
+					b.reportProgress(int(n), total)
+				}
+			}
+		}(lo, hi)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	root, err := b.buildTreeParallel(ctx, leaves)
+	if err != nil {
+		return nil, err
+	}
+	b.observeBuild(time.Since(start), len(leaves), treeDepth(len(leaves)))
+	return b.finishRoot(root), nil
+}
+
+// buildTreeParallel constructs a Merkle tree from a slice of Merkle nodes in parallel.
+//
+// It takes a slice of MerkleNode pointers and returns the root MerkleNode of the constructed tree, combining nodes with the builder's hasher. Each level's pairs are split into contiguous batches across a fixed pool of workers rather than one goroutine per pair, so a large tree does not flood the scheduler. Each level's nodes come from one contiguous block and its scratch slice from levelPool. The context is checked before each level is built.
+//
+// Parameters:
+//   - ctx: the context that bounds the build
+//   - nodes: a slice of pointers to MerkleNode that represent the leaf nodes of the tree.
+//
+// Returns:
+//   a pointer to the root MerkleNode of the constructed tree, or the empty-tree root if no nodes are provided, or ctx.Err() if the context is cancelled.
+func (b *TreeBuilder) buildTreeParallel(ctx context.Context, nodes []*MerkleNode) (*MerkleNode, error) {
+	done, total := len(nodes), HashOpCount(len(nodes))
+
+	var scratch *[]*MerkleNode
+	defer func() {
+		if scratch != nil {
+			clear(*scratch)
+			levelPool.Put(scratch)
+		}
+	}()
+
+	for len(nodes) > 1 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		b.reportProgress(done, total)
+
+		levelSize := (len(nodes) + 1) / 2
+		buf := levelPool.Get().(*[]*MerkleNode)
+		if cap(*buf) < levelSize {
+			*buf = make([]*MerkleNode, levelSize)
+		}
+		nextLevel := (*buf)[:levelSize]
+		block := make([]MerkleNode, levelSize)
+
+		numWorkers := b.workerCount()
+		if numWorkers > len(nextLevel) {
+			numWorkers = len(nextLevel)
+		}
+		batchSize := (len(nextLevel) + numWorkers - 1) / numWorkers
+
+		var (
+			wg       sync.WaitGroup
+			errOnce  sync.Once
+			panicErr error
+		)
+		for start := 0; start < len(nextLevel); start += batchSize {
+			end := start + batchSize
+			if end > len(nextLevel) {
+				end = len(nextLevel)
+			}
+
+			wg.Add(1)
+			go func(start, end int) {
+				defer wg.Done()
+				defer func() {
+					if r := recover(); r != nil {
+						errOnce.Do(func() {
+							panicErr = fmt.Errorf("%w: node worker for pairs %d-%d: %v", ErrWorkerPanic, start, end-1, r)
+						})
+					}
+				}()
+				acc := hashAccumulator{hasher: b.h(), arena: &nodeArena{block: block[start:end]}, zeroPair: b.PairWithZero}
+				for k := start; k < end; k++ {
+					var right *MerkleNode
+					if 2*k+1 < len(nodes) {
+						right = nodes[2*k+1]
+					}
+					nextLevel[k] = acc.Combine(nodes[2*k], right)
+				}
+			}(start, end)
+		}
+
+		wg.Wait()
+		if panicErr != nil {
+			clear(*buf)
+			levelPool.Put(buf)
+			return nil, panicErr
+		}
+		done += len(nodes) / 2
+		nodes = nextLevel
+		if scratch != nil {
+			clear(*scratch)
+			levelPool.Put(scratch)
+		}
+		scratch = buf
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	b.reportProgress(done, total)
+	if len(nodes) == 0 {
+		return b.emptyRoot(), nil
+	}
+	return nodes[0], nil
+}
+
+// createMerkleTreeByAccount constructs a Merkle tree with one leaf per account.
+//
+// It hashes with SHA-256; see TreeBuilder.BuildByAccount.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to commit to
+//
+// Returns:
+//   a pointer to the root MerkleNode, or an error if an account holds a negative balance or cannot be marshalled
+func createMerkleTreeByAccount(accounts []Account) (*MerkleNode, error) {
+	return NewTreeBuilder(nil).BuildByAccount(accounts)
+}
+
+// BuildByAccount constructs a Merkle tree with one leaf per account using the builder's hasher.
+//
+// It commits to each account's identifier together with all of its balances in canonical order, so an inclusion proof shows that an account holds exactly those balances rather than that a single balance exists somewhere in the tree. Accounts are ordered by identifier before hashing.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to commit to
+//
+// Returns:
+//   a pointer to the root MerkleNode, or an error if an account holds a negative balance or cannot be marshalled
+func (b *TreeBuilder) BuildByAccount(accounts []Account) (*MerkleNode, error) {
+	start := time.Now()
+	accounts, err := b.prepareAccounts(accounts)
+	if err != nil {
+		return nil, err
+	}
+	sorted := sortedAccounts(accounts)
+
+	progress := b.newProgress(HashOpCount(len(sorted)))
+	leaves := make([]*MerkleNode, len(sorted))
+	for i, account := range sorted {
+		leaf, err := b.hashAccountLeaf(account, nil)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = leaf
+		progress.advance(1)
+	}
+
+	root := b.finishRoot(b.buildTree(leaves, progress))
+	progress.report()
+	b.observeBuild(time.Since(start), len(leaves), treeDepth(len(leaves)))
+	return root, nil
+}
+
+// hashAccountLeaf marshals a whole account and hashes it into a leaf node.
+//
+// It JSON-encodes the account with its assets mapped through AssetCanonicalizer and its balances in canonical order, prepends the nonce if one is given and hashes the result with the builder's hasher under the leaf prefix.
+//
+// Parameters:
+//   - account: the account to hash
+//   - nonce: the account's secret nonce, or nil for an unsalted leaf
+//
+// Returns:
+//   a pointer to the leaf MerkleNode, or an error naming the account if it holds a negative balance or cannot be marshalled
+func (b *TreeBuilder) hashAccountLeaf(account Account, nonce []byte) (*MerkleNode, error) {
+	balances := make([]Balance, len(account.Balances))
+	for i, balance := range account.Balances {
+		balance.Asset = b.canonicalAsset(balance.Asset)
+		if err := b.checkBalance(account.Identifier, balance); err != nil {
+			return nil, err
+		}
+		weighted, err := leafBalance(balance, b.ApplyWeights)
+		if err != nil {
+			return nil, fmt.Errorf("account %s: %w", account.Identifier, err)
+		}
+		balances[i] = weighted
+	}
+	data, err := marshalCanonical(Account{Identifier: account.Identifier, Balances: sortedBalances(balances)})
+	if err != nil {
+		return nil, fmt.Errorf("marshal account %s: %w", account.Identifier, err)
+	}
+	return &MerkleNode{Hash: hashLeaf(b.h(), append(append([]byte{}, nonce...), data...))}, nil
+}
+
+// FindLeaf returns the first leaf, left to right, that satisfies a predicate.
+//
+// It walks the tree depth-first and only passes childless nodes to the predicate.
+//
+// Parameters:
+//   - root: the root of the tree to search
+//   - predicate: reports whether a leaf is the one being looked for
+//
+// Returns:
+//   a pointer to the first matching leaf, or nil if none matches
+func FindLeaf(root *MerkleNode, predicate func(*MerkleNode) bool) *MerkleNode {
+	if root == nil {
+		return nil
+	}
+	if root.Left == nil && root.Right == nil {
+		if predicate(root) {
+			return root
+		}
+		return nil
+	}
+	if leaf := FindLeaf(root.Left, predicate); leaf != nil {
+		return leaf
+	}
+	return FindLeaf(root.Right, predicate)
+}
+
+// FindAccountLeaf locates an account's leaf in a tree built by createMerkleTreeByAccount.
+//
+// It looks the account up by identifier, recomputes its expected leaf hash and searches the tree for it, so a user who only knows their identifier can get to the leaf needed for GenerateProof.
+//
+// Parameters:
+//   - root: the root of the per-account tree
+//   - accounts: the accounts the tree was built from
+//   - identifier: the identifier of the account to find
+//
+// Returns:
+//   a pointer to the account's leaf, or nil if the account is unknown or its leaf is not in the tree
+func FindAccountLeaf(root *MerkleNode, accounts []Account, identifier string) *MerkleNode {
+	for _, account := range accounts {
+		if account.Identifier != identifier {
+			continue
+		}
+		leaf, err := NewTreeBuilder(nil).hashAccountLeaf(account, nil)
+		if err != nil {
+			return nil
+		}
+		return FindLeaf(root, func(node *MerkleNode) bool {
+			return node.Hash == leaf.Hash
+		})
+	}
+	return nil
+}
+
+// createMerkleTreeWithNonces constructs a per-account Merkle tree whose leaves are salted with a secret nonce.
+//
+// It hashes with SHA-256; see TreeBuilder.BuildWithNonces.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to commit to
+//   - nonces: the secret nonce for each account, keyed by identifier
+//
+// Returns:
+//   a pointer to the root MerkleNode, or an error if an account has no nonce, holds a negative balance or cannot be marshalled
+func createMerkleTreeWithNonces(accounts []Account, nonces map[string][]byte) (*MerkleNode, error) {
+	return NewTreeBuilder(nil).BuildWithNonces(accounts, nonces)
+}
+
+// BuildWithNonces constructs a per-account Merkle tree whose leaves are salted with a secret nonce using the builder's hasher.
+//
+// It works like BuildByAccount but prepends each account's nonce to its serialized balances before hashing, so a user who is handed a proof cannot brute-force the sibling hashes to learn who their neighbours are or what they hold.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to commit to
+//   - nonces: the secret nonce for each account, keyed by identifier
+//
+// Returns:
+//   a pointer to the root MerkleNode, or an error if an account has no nonce, holds a negative balance or cannot be marshalled
+func (b *TreeBuilder) BuildWithNonces(accounts []Account, nonces map[string][]byte) (*MerkleNode, error) {
+	start := time.Now()
+	accounts, err := b.prepareAccounts(accounts)
+	if err != nil {
+		return nil, err
+	}
+	sorted := sortedAccounts(accounts)
+
+	progress := b.newProgress(HashOpCount(len(sorted)))
+	leaves := make([]*MerkleNode, len(sorted))
+	for i, account := range sorted {
+		nonce, ok := nonces[account.Identifier]
+		if !ok || len(nonce) == 0 {
+			return nil, fmt.Errorf("no nonce for account %s", account.Identifier)
+		}
+		leaf, err := b.hashAccountLeaf(account, nonce)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = leaf
+		progress.advance(1)
+	}
+
+	root := b.finishRoot(b.buildTree(leaves, progress))
+	progress.report()
+	b.observeBuild(time.Since(start), len(leaves), treeDepth(len(leaves)))
+	return root, nil
+}
+
+// GenerateNonceProof builds an inclusion proof for an account in a tree built by createMerkleTreeWithNonces.
+//
+// It recomputes the account's salted leaf and returns the nonce alongside the proof, so the user can rebuild their own leaf hash and verify it against the published root.
+//
+// Parameters:
+//   - root: the root of the salted per-account tree
+//   - account: the account to prove
+//   - nonces: the secret nonce for each account, keyed by identifier
+//
+// Returns:
+//   the proof steps from the leaf up to the root, the account's nonce, or an error if the account has no nonce or is not in the tree
+func GenerateNonceProof(root *MerkleNode, account Account, nonces map[string][]byte) ([]ProofStep, []byte, error) {
+	nonce, ok := nonces[account.Identifier]
+	if !ok || len(nonce) == 0 {
+		return nil, nil, fmt.Errorf("no nonce for account %s", account.Identifier)
+	}
+
+	leaf, err := NewTreeBuilder(nil).hashAccountLeaf(account, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proof, err := GenerateProof(root, leaf.Hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proof, nonce, nil
+}
+
+type TwoLevelProof struct {
+	AccountRoot  [32]byte
+	BalanceProof []ProofStep
+	AccountProof []ProofStep
+}
+
+// createTwoLevelTree constructs a tree of accounts whose leaves commit to a per-account sub-tree of balances.
+//
+// It hashes with SHA-256; see TreeBuilder.BuildTwoLevel.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to commit to
+//
+// Returns:
+//   a pointer to the root MerkleNode of the top tree, or an error if an account holds a negative balance or cannot be marshalled
+func createTwoLevelTree(accounts []Account) (*MerkleNode, error) {
+	return NewTreeBuilder(nil).BuildTwoLevel(accounts)
+}
+
+// BuildTwoLevel constructs a tree of accounts whose leaves commit to a per-account sub-tree of balances using the builder's hasher.
+//
+// Each account's balances, in canonical order, form their own tree, and the account's leaf in the top tree hashes its identifier together with that sub-tree's root. Proving one asset then reveals a path through the account's sub-tree instead of every balance the account holds. Accounts are ordered by identifier before hashing.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to commit to
+//
+// Returns:
+//   a pointer to the root MerkleNode of the top tree, or an error if an account holds a negative balance or cannot be marshalled
+func (b *TreeBuilder) BuildTwoLevel(accounts []Account) (*MerkleNode, error) {
+	start := time.Now()
+	accounts, err := b.prepareAccounts(accounts)
+	if err != nil {
+		return nil, err
+	}
+	sorted := sortedAccounts(accounts)
+	total := HashOpCount(len(sorted))
+	for _, account := range sorted {
+		total += HashOpCount(len(account.Balances))
+	}
+	progress := b.newProgress(total)
+
+	leaves := make([]*MerkleNode, len(sorted))
+	balanceCount, accountDepth := 0, 0
+	for i, account := range sorted {
+		accountRoot, err := b.buildAccountSubTree(account, progress)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = &MerkleNode{Hash: namedRootHash(b.h(), account.Identifier, accountRoot.Hash)}
+		progress.advance(1)
+		balanceCount += len(account.Balances)
+		if depth := treeDepth(len(account.Balances)); depth > accountDepth {
+			accountDepth = depth
+		}
+	}
+
+	root := b.finishRoot(b.buildTree(leaves, progress))
+	progress.report()
+	b.observeBuild(time.Since(start), balanceCount, accountDepth+treeDepth(len(leaves)))
+	return root, nil
+}
+
+// buildAccountSubTree builds the tree over a single account's balances.
+//
+// The sub-tree's hash operations are added to the build's progress without a report per level, since one build holds a sub-tree for every account.
+//
+// Parameters:
+//   - account: the account whose balances to commit to
+//   - progress: the tracker for the build, or nil to report nothing
+//
+// Returns:
+//   a pointer to the root of the account's sub-tree, or an error if a balance is negative or cannot be marshalled
+func (b *TreeBuilder) buildAccountSubTree(account Account, progress *buildProgress) (*MerkleNode, error) {
+	balances := sortedBalances(account.Balances)
+	leaves := make([]*MerkleNode, len(balances))
+	for i, balance := range balances {
+		leaf, err := b.hashBalanceLeaf(accountBalance{identifier: account.Identifier, balance: balance})
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = leaf
+	}
+	root := b.buildTree(leaves, nil)
+	progress.advance(HashOpCount(len(leaves)))
+	return root, nil
+}
+
+// namedRootHash computes the leaf that commits a sub-tree to an upper tree under a name.
+//
+// The name, an account identifier or an asset, is hashed together with the sub-tree root so that a sub-tree cannot be claimed under another name. The root has a fixed length, so the concatenation is unambiguous.
+//
+// Parameters:
+//   - h: the hasher to use
+//   - name: the name the sub-tree is committed under
+//   - subRoot: the root of the sub-tree
+//
+// Returns:
+//   the sub-tree's leaf hash in the upper tree
+func namedRootHash(h Hasher, name string, subRoot [32]byte) [32]byte {
+	return hashLeaf(h, append([]byte(name), subRoot[:]...))
+}
+
+// GenerateTwoLevelProof builds a proof that an account holds a balance of one asset in a tree built by createTwoLevelTree.
+//
+// It rebuilds the account's sub-tree to prove the balance against the account's root, then proves the account's leaf against the top root. The account's other balances appear only as sibling hashes.
+//
+// Parameters:
+//   - root: the root of the top tree
+//   - account: the account holding the balance
+//   - asset: the asset to prove
+//
+// Returns:
+//   the two-level proof, or an error if the account has no balance in the asset, cannot be hashed or is not in the tree
+func GenerateTwoLevelProof(root *MerkleNode, account Account, asset string) (TwoLevelProof, error) {
+	b := NewTreeBuilder(nil)
+	accountRoot, err := b.buildAccountSubTree(account, nil)
+	if err != nil {
+		return TwoLevelProof{}, err
+	}
+
+	for _, balance := range account.Balances {
+		if balance.Asset != asset {
+			continue
+		}
+		leaf, err := b.hashBalanceLeaf(accountBalance{identifier: account.Identifier, balance: balance})
+		if err != nil {
+			return TwoLevelProof{}, err
+		}
+		balanceProof, err := GenerateProof(accountRoot, leaf.Hash)
+		if err != nil {
+			return TwoLevelProof{}, err
+		}
+		accountProof, err := GenerateProof(root, namedRootHash(b.h(), account.Identifier, accountRoot.Hash))
+		if err != nil {
+			return TwoLevelProof{}, err
+		}
+		return TwoLevelProof{AccountRoot: accountRoot.Hash, BalanceProof: balanceProof, AccountProof: accountProof}, nil
+	}
+
+	return TwoLevelProof{}, fmt.Errorf("account %s asset %s: %w", account.Identifier, asset, ErrLeafNotFound)
+}
+
+// VerifyTwoLevelProof checks a two-level proof against a root built with SHA-256.
+//
+// It verifies the proof with the default SHA-256 tree builder; see TreeBuilder.VerifyTwoLevelProof.
+//
+// Parameters:
+//   - root: the published root of the top tree
+//   - identifier: the account identifier
+//   - balance: the balance being proven
+//   - proof: the two-level proof
+//
+// Returns:
+//   true if both levels of the proof verify, false otherwise
+func VerifyTwoLevelProof(root [32]byte, identifier string, balance Balance, proof TwoLevelProof) bool {
+	return NewTreeBuilder(nil).VerifyTwoLevelProof(root, identifier, balance, proof)
+}
+
+// VerifyTwoLevelProof checks a two-level proof against a root built with this builder's hasher.
+//
+// It verifies the balance against the account root carried in the proof, then verifies the account leaf derived from the identifier and that root against the top root.
+//
+// Parameters:
+//   - root: the published root of the top tree
+//   - identifier: the account identifier
+//   - balance: the balance being proven
+//   - proof: the two-level proof
+//
+// Returns:
+//   true if both levels of the proof verify, false otherwise
+func (b *TreeBuilder) VerifyTwoLevelProof(root [32]byte, identifier string, balance Balance, proof TwoLevelProof) bool {
+	leaf, err := b.hashBalance(accountBalance{identifier: identifier, balance: balance})
+	if err != nil {
+		return false
+	}
+	if !b.VerifyProof(leaf, proof.BalanceProof, proof.AccountRoot) {
+		return false
+	}
+	return b.VerifyProof(namedRootHash(b.h(), identifier, proof.AccountRoot), proof.AccountProof, root)
+}
+
+type PerAssetProof struct {
+	AssetRoot    [32]byte
+	BalanceProof []ProofStep
+	AssetProof   []ProofStep
+}
+
+// createPerAssetTrees constructs one Merkle tree per asset and a super-root binding them together.
+//
+// It hashes with SHA-256; see TreeBuilder.BuildPerAsset.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the trees
+//
+// Returns:
+//   the root of each asset's tree keyed by asset, the super-root, or an error if a balance is negative, an identifier is duplicated or a balance cannot be marshalled
+func createPerAssetTrees(accounts []Account) (map[string]*MerkleNode, *MerkleNode, error) {
+	return NewTreeBuilder(nil).BuildPerAsset(accounts)
+}
+
+// BuildPerAsset constructs one Merkle tree per asset and a super-root binding them together using the builder's hasher.
+//
+// Each asset's tree holds that asset's balances in the order Build uses, so an auditor for one asset can check its root without seeing any other asset's data. The super-root is a tree over the asset roots, sorted by asset, with each leaf hashing the asset name together with its root. A balance is proven with GeneratePerAssetProof.
+//
+// Parameters:
+//   - accounts: a slice of Account structs containing balances to be included in the trees
+//
+// Returns:
+//   the root of each asset's tree keyed by asset, the super-root, or an error if a balance is negative, an identifier is duplicated or a balance cannot be marshalled
+func (b *TreeBuilder) BuildPerAsset(accounts []Account) (map[string]*MerkleNode, *MerkleNode, error) {
+	start := time.Now()
+	accounts, err := b.prepareAccounts(accounts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	allBalances := flattenBalances(accounts)
+	assetCounts := make(map[string]int)
+	for _, entry := range allBalances {
+		assetCounts[entry.balance.Asset]++
+	}
+	total := HashOpCount(len(assetCounts))
+	for _, count := range assetCounts {
+		total += HashOpCount(count)
+	}
+	progress := b.newProgress(total)
+
+	leavesByAsset := make(map[string][]*MerkleNode, len(assetCounts))
+	var enc leafEncoder
+	for _, entry := range allBalances {
+		hash, err := b.hashBalanceWith(entry, &enc)
+		if err != nil {
+			return nil, nil, err
+		}
+		leavesByAsset[entry.balance.Asset] = append(leavesByAsset[entry.balance.Asset], &MerkleNode{Hash: hash})
+		progress.advance(1)
+	}
+
+	assets := make([]string, 0, len(leavesByAsset))
+	for asset := range leavesByAsset {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+
+	roots := make(map[string]*MerkleNode, len(assets))
+	assetLeaves := make([]*MerkleNode, len(assets))
+	assetDepth := 0
+	for i, asset := range assets {
+		roots[asset] = b.buildTree(leavesByAsset[asset], progress)
+		assetLeaves[i] = &MerkleNode{Hash: namedRootHash(b.h(), asset, roots[asset].Hash)}
+		progress.advance(1)
+		if depth := treeDepth(len(leavesByAsset[asset])); depth > assetDepth {
+			assetDepth = depth
+		}
+	}
+
+	superRoot := b.finishRoot(b.buildTree(assetLeaves, progress))
+	progress.report()
+	b.observeBuild(time.Since(start), len(allBalances), assetDepth+treeDepth(len(assetLeaves)))
+	return roots, superRoot, nil
+}
+
+// GeneratePerAssetProof builds a proof that an account holds a balance of one asset in trees built by createPerAssetTrees.
+//
+// It proves the balance against its asset's root, then proves the asset's leaf against the super-root.
+//
+// Parameters:
+//   - roots: the per-asset roots keyed by asset
+//   - superRoot: the super-root
+//   - account: the account holding the balance
+//   - asset: the asset to prove
+//
+// Returns:
+//   the two-part proof, or an error wrapping ErrLeafNotFound if the account has no balance in the asset or the asset has no tree, or an error if the balance cannot be hashed or is not in the trees
+func GeneratePerAssetProof(roots map[string]*MerkleNode, superRoot *MerkleNode, account Account, asset string) (PerAssetProof, error) {
+	assetRoot, ok := roots[asset]
+	if !ok {
+		return PerAssetProof{}, fmt.Errorf("asset %s: %w", asset, ErrLeafNotFound)
+	}
+
+	b := NewTreeBuilder(nil)
+	for _, balance := range account.Balances {
+		if balance.Asset != asset {
+			continue
+		}
+		leaf, err := b.hashBalanceLeaf(accountBalance{identifier: account.Identifier, balance: balance})
+		if err != nil {
+			return PerAssetProof{}, err
+		}
+		balanceProof, err := GenerateProof(assetRoot, leaf.Hash)
+		if err != nil {
+			return PerAssetProof{}, err
+		}
+		assetProof, err := GenerateProof(superRoot, namedRootHash(b.h(), asset, assetRoot.Hash))
+		if err != nil {
+			return PerAssetProof{}, err
+		}
+		return PerAssetProof{AssetRoot: assetRoot.Hash, BalanceProof: balanceProof, AssetProof: assetProof}, nil
+	}
+
+	return PerAssetProof{}, fmt.Errorf("account %s asset %s: %w", account.Identifier, asset, ErrLeafNotFound)
+}
+
+// VerifyPerAssetProof checks a per-asset proof against a super-root built with SHA-256.
+//
+// It verifies the proof with the default SHA-256 tree builder; see TreeBuilder.VerifyPerAssetProof.
+//
+// Parameters:
+//   - superRoot: the published super-root
+//   - balance: the balance being proven
+//   - proof: the per-asset proof
+//
+// Returns:
+//   true if both levels of the proof verify, false otherwise
+func VerifyPerAssetProof(superRoot [32]byte, balance Balance, proof PerAssetProof) bool {
+	return NewTreeBuilder(nil).VerifyPerAssetProof(superRoot, balance, proof)
+}
+
+// VerifyPerAssetProof checks a per-asset proof against a super-root built with this builder's hasher.
+//
+// It verifies the balance against the asset root carried in the proof, then verifies the leaf derived from the balance's asset and that root against the super-root. An auditor of one asset can stop after the first step and compare AssetRoot with the published asset root instead.
+//
+// Parameters:
+//   - superRoot: the published super-root
+//   - balance: the balance being proven
+//   - proof: the per-asset proof
+//
+// Returns:
+//   true if both levels of the proof verify, false otherwise
+func (b *TreeBuilder) VerifyPerAssetProof(superRoot [32]byte, balance Balance, proof PerAssetProof) bool {
+	leaf, err := b.hashBalance(accountBalance{balance: balance})
+	if err != nil {
+		return false
+	}
+	if !b.VerifyProof(leaf, proof.BalanceProof, proof.AssetRoot) {
+		return false
+	}
+	return b.VerifyProof(namedRootHash(b.h(), b.canonicalAsset(balance.Asset), proof.AssetRoot), proof.AssetProof, superRoot)
+}
+
+type FixedBalance struct {
+	Asset    string `json:"asset"`
+	Amount   int64  `json:"amount"`
+	Decimals uint8  `json:"decimals"`
+	Sign     Sign   `json:"sign,omitempty"`
+}
+
+type FixedAccount struct {
+	Identifier string         `json:"identifier"`
+	Balances   []FixedBalance `json:"balances"`
+}
+
+// createMerkleTreeForFixedAccounts constructs a Merkle tree over balances held as integer base units.
+//
+// It hashes with SHA-256; see TreeBuilder.BuildFixed.
+//
+// Parameters:
+//   - accounts: a slice of FixedAccount structs containing balances to be included in the Merkle tree
+//
+// Returns:
+//   a pointer to the root MerkleNode, or an error if a balance is negative
+func createMerkleTreeForFixedAccounts(accounts []FixedAccount) (*MerkleNode, error) {
+	return NewTreeBuilder(nil).BuildFixed(accounts)
+}
+
+// BuildFixed constructs a Merkle tree over balances held as integer base units using the builder's hasher.
+//
+// It is the canonical counterpart of Build: amounts are integers with an explicit number of decimals, and each leaf is a fixed byte encoding rather than JSON, so the same balances always produce the same root on every system. Balances are ordered by account identifier, asset, amount, decimals and sign before hashing.
+//
+// Parameters:
+//   - accounts: a slice of FixedAccount structs containing balances to be included in the Merkle tree
+//
+// Returns:
+//   a pointer to the root MerkleNode, or an error if a balance is negative
+func (b *TreeBuilder) BuildFixed(accounts []FixedAccount) (*MerkleNode, error) {
+	start := time.Now()
+	if err := b.checkDuplicates(len(accounts), func(i int) string { return accounts[i].Identifier }); err != nil {
+		return nil, err
+	}
+	type entry struct {
+		identifier string
+		balance    FixedBalance
+	}
+
+	var all []entry
+	seen := make(map[string]Sign)
+	for _, account := range accounts {
+		balances := account.Balances
+		if err := checkSigns(account.Identifier, len(balances), func(i int) (string, Sign) { return b.canonicalAsset(balances[i].Asset), balances[i].Sign }, seen); err != nil {
+			return nil, err
+		}
+		for _, balance := range balances {
+			balance.Asset = b.canonicalAsset(balance.Asset)
+			if balance.Amount < 0 && !b.AllowNegative {
+				return nil, fmt.Errorf("account %s asset %s: %w %d", account.Identifier, balance.Asset, ErrNegativeBalance, balance.Amount)
+			}
+			all = append(all, entry{identifier: account.Identifier, balance: balance})
+		}
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		x, y := all[i], all[j]
+		if x.identifier != y.identifier {
+			return x.identifier < y.identifier
+		}
+		if x.balance.Asset != y.balance.Asset {
+			return x.balance.Asset < y.balance.Asset
+		}
+		if x.balance.Amount != y.balance.Amount {
+			return x.balance.Amount < y.balance.Amount
+		}
+		if x.balance.Decimals != y.balance.Decimals {
+			return x.balance.Decimals < y.balance.Decimals
+		}
+		return x.balance.Sign < y.balance.Sign
+	})
+
+	progress := b.newProgress(HashOpCount(len(all)))
+	leaves := make([]*MerkleNode, len(all))
+	for i, e := range all {
+		leaves[i] = &MerkleNode{Hash: hashLeaf(b.h(), encodeFixedBalance(e.balance))}
+		progress.advance(1)
+	}
+
+	root := b.finishRoot(b.buildTree(leaves, progress))
+	progress.report()
+	b.observeBuild(time.Since(start), len(leaves), treeDepth(len(leaves)))
+	return root, nil
+}
+
+// encodeFixedBalance encodes a fixed-point balance into its canonical leaf bytes.
+//
+// It writes the length-prefixed asset, the amount as a big-endian int64, the decimals byte and the length-prefixed sign, so every field is unambiguous and the encoding never depends on a JSON or float formatter.
+//
+// Parameters:
+//   - balance: the balance to encode
+//
+// Returns:
+//   the canonical byte encoding of the balance
+func encodeFixedBalance(balance FixedBalance) []byte {
+	buf := make([]byte, 0, 2*binary.MaxVarintLen64+len(balance.Asset)+len(balance.Sign)+9)
+	buf = binary.AppendUvarint(buf, uint64(len(balance.Asset)))
+	buf = append(buf, balance.Asset...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(balance.Amount))
+	buf = append(buf, balance.Decimals)
+	buf = binary.AppendUvarint(buf, uint64(len(balance.Sign)))
+	buf = append(buf, balance.Sign...)
+	return buf
+}
+
+type IncrementalTree struct {
+	hasher        Hasher
+	frontier      [][32]byte
+	size          int
+	AllowNegative bool
+}
+
+// NewIncrementalTree creates an empty append-only tree that hashes with the given hasher.
+//
+// It falls back to SHA-256 when no hasher is supplied.
+//
+// Parameters:
+//   - h: the Hasher used for every leaf and internal node, or nil for SHA-256
+//
+// Returns:
+//   a pointer to an empty IncrementalTree
+func NewIncrementalTree(h Hasher) *IncrementalTree {
+	if h == nil {
+		h = SHA256Hasher{}
+	}
+	return &IncrementalTree{hasher: h}
+}
+
+// Append adds a balance as the next leaf of the tree.
+//
+// It keeps only the root of each perfect subtree along the right edge of the tree (one per set bit of the leaf count), merging equal-height subtrees as the new leaf carries upward, so each append costs O(log n) hashes instead of a full rebuild.
+//
+// Parameters:
+//   - balance: the balance to append
+//
+// Returns:
+//   an error wrapping ErrInvalidSign if the sign is unknown or ErrNegativeBalance if the balance is negative and AllowNegative is not set, naming the balance by its leaf position, or an error if it cannot be marshalled
+func (t *IncrementalTree) Append(balance Balance) error {
+	if err := validateBalance(fmt.Sprintf("at leaf %d", t.size), balance, t.AllowNegative); err != nil {
+		return err
+	}
+	balance, _ = leafBalance(balance, false)
+	data, err := marshalCanonical(balance)
+	if err != nil {
+		return fmt.Errorf("marshal balance for asset %s: %w", balance.Asset, err)
+	}
+
+	hash := hashLeaf(t.hasher, data)
+	level := 0
+	for ; t.size&(1<<level) != 0; level++ {
+		hash = hashChildren(t.hasher, t.frontier[level], hash)
+	}
+	if level == len(t.frontier) {
+		t.frontier = append(t.frontier, [32]byte{})
+	}
+	t.frontier[level] = hash
+	t.size++
+	return nil
+}
+
+// Root returns the current root hash of the tree.
+//
+// It folds the perfect-subtree roots from the smallest up to the largest, each larger subtree on the left, which matches how buildTree carries an unpaired node up a level. The root after appending n balances equals the root createMerkleTreeForAccounts produces for the same n balances in the same order.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the root hash, or the empty-tree root if nothing has been appended
+func (t *IncrementalTree) Root() [32]byte {
+	if t.size == 0 {
+		return t.hasher.Hash(nil)
+	}
+
+	var root [32]byte
+	first := true
+	for level, hash := range t.frontier {
+		if t.size&(1<<level) == 0 {
+			continue
+		}
+		if first {
+			root, first = hash, false
+		} else {
+			root = hashChildren(t.hasher, hash, root)
+		}
+	}
+	return root
+}
+
+type MMR struct {
+	hasher Hasher
+	levels [][][32]byte
+}
+
+// NewMMR creates an empty Merkle Mountain Range that hashes with the given hasher.
+//
+// It falls back to SHA-256 when no hasher is supplied.
+//
+// Parameters:
+//   - h: the Hasher used for every leaf and internal node, or nil for SHA-256
+//
+// Returns:
+//   a pointer to an empty MMR
+func NewMMR(h Hasher) *MMR {
+	if h == nil {
+		h = SHA256Hasher{}
+	}
+	return &MMR{hasher: h}
+}
+
+// Append adds a leaf to the range and returns its position.
+//
+// The leaf is hashed under the leaf prefix and merged with equal-height mountains as it carries upward, so each append costs O(log n) hashes. Every node ever formed is kept, which is what lets RootAt and ProveAt answer for any earlier size.
+//
+// Parameters:
+//   - leaf: the leaf data
+//
+// Returns:
+//   the zero-based position of the leaf
+func (m *MMR) Append(leaf []byte) uint64 {
+	pos := m.Size()
+	hash := hashLeaf(m.hasher, leaf)
+	for level := 0; ; level++ {
+		if level == len(m.levels) {
+			m.levels = append(m.levels, nil)
+		}
+		m.levels[level] = append(m.levels[level], hash)
+		nodes := m.levels[level]
+		if len(nodes)%2 != 0 {
+			break
+		}
+		hash = hashChildren(m.hasher, nodes[len(nodes)-2], nodes[len(nodes)-1])
+	}
+	return pos
+}
+
+// Size returns the number of leaves appended so far.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the leaf count
+func (m *MMR) Size() uint64 {
+	if len(m.levels) == 0 {
+		return 0
+	}
+	return uint64(len(m.levels[0]))
+}
+
+// Root returns the current root of the range.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the root hash; see RootAt
+func (m *MMR) Root() [32]byte {
+	root, _ := m.RootAt(m.Size())
+	return root
+}
+
+// RootAt returns the root the range had when it held size leaves.
+//
+// The peaks are bagged from right to left, each larger mountain on the left, which makes the root equal to the one buildTree produces over the same leaves. A proof from ProveAt for the same size verifies against it with VerifyProof.
+//
+// Parameters:
+//   - size: the historical leaf count
+//
+// Returns:
+//   the root hash, or the empty-tree root if size is 0, or an error if size exceeds the current size
+func (m *MMR) RootAt(size uint64) ([32]byte, error) {
+	if size > m.Size() {
+		return [32]byte{}, fmt.Errorf("size %d exceeds range size %d", size, m.Size())
+	}
+	if size == 0 {
+		return m.hasher.Hash(nil), nil
+	}
+
+	peaks := m.peaks(size)
+	return m.bagPeaks(peaks), nil
+}
+
+// Prove builds an inclusion proof for a leaf against the current root.
+//
+// Parameters:
+//   - pos: the position returned by Append
+//
+// Returns:
+//   the proof steps from the leaf up to the root; see ProveAt
+func (m *MMR) Prove(pos uint64) ([]ProofStep, error) {
+	return m.ProveAt(pos, m.Size())
+}
+
+// ProveAt builds an inclusion proof for a leaf against the root the range had at a given size.
+//
+// The proof climbs the leaf's mountain, then takes the bagged peaks to its right as one right sibling and each peak to its left as a left sibling. It uses the ordinary ProofStep form, so VerifyProof checks it against RootAt(size).
+//
+// Parameters:
+//   - pos: the position returned by Append
+//   - size: the historical leaf count, which must be greater than pos
+//
+// Returns:
+//   the proof steps from the leaf up to the root, or an error wrapping ErrLeafNotFound if pos is not below size, or an error if size exceeds the current size
+func (m *MMR) ProveAt(pos, size uint64) ([]ProofStep, error) {
+	if size > m.Size() {
+		return nil, fmt.Errorf("size %d exceeds range size %d", size, m.Size())
+	}
+	if pos >= size {
+		return nil, fmt.Errorf("%w: position %d in range of size %d", ErrLeafNotFound, pos, size)
+	}
+
+	peaks := m.peaks(size)
+	var proof []ProofStep
+	var offset uint64
+	for i, peak := range peaks {
+		width := uint64(1) << peak.level
+		if pos >= offset+width {
+			offset += width
+			continue
+		}
+
+		index := pos
+		for level := 0; level < peak.level; level++ {
+			proof = append(proof, ProofStep{Hash: m.levels[level][index^1], IsLeft: index&1 == 1})
+			index >>= 1
+		}
+		if i+1 < len(peaks) {
+			proof = append(proof, ProofStep{Hash: m.bagPeaks(peaks[i+1:]), IsLeft: false})
+		}
+		for j := i - 1; j >= 0; j-- {
+			proof = append(proof, ProofStep{Hash: peaks[j].hash, IsLeft: true})
+		}
+		break
+	}
+	return proof, nil
+}
+
+type mmrPeak struct {
+	level int
+	hash  [32]byte
+}
+
+// peaks returns the mountain peaks of the range at a given size, largest first.
+//
+// Each set bit of size is one perfect mountain, laid out left to right from the highest bit down.
+//
+// Parameters:
+//   - size: the leaf count, which must not exceed the current size
+//
+// Returns:
+//   the peaks from left to right
+func (m *MMR) peaks(size uint64) []mmrPeak {
+	var peaks []mmrPeak
+	var offset uint64
+	for level := bits.Len64(size) - 1; level >= 0; level-- {
+		if size&(1<<level) == 0 {
+			continue
+		}
+		peaks = append(peaks, mmrPeak{level: level, hash: m.levels[level][offset>>level]})
+		offset += 1 << level
+	}
+	return peaks
+}
+
+// bagPeaks folds peaks into a single hash from right to left.
+//
+// Parameters:
+//   - peaks: the peaks to bag, left to right, at least one
+//
+// Returns:
+//   the bagged hash
+func (m *MMR) bagPeaks(peaks []mmrPeak) [32]byte {
+	bag := peaks[len(peaks)-1].hash
+	for i := len(peaks) - 2; i >= 0; i-- {
+		bag = hashChildren(m.hasher, peaks[i].hash, bag)
+	}
+	return bag
+}
+
+// VerifyMMRProof checks that leaf data is included under an MMR root built with SHA-256.
+//
+// Parameters:
+//   - root: the root the proof was built against
+//   - leaf: the leaf data as passed to Append
+//   - proof: the proof from Prove or ProveAt
+//
+// Returns:
+//   true if the proof reconstructs the root, false otherwise
+func VerifyMMRProof(root [32]byte, leaf []byte, proof []ProofStep) bool {
+	return VerifyProof(hashLeaf(SHA256Hasher{}, leaf), proof, root)
+}
+
+const sparseTreeDepth = 256
+
+type sparseNodeKey struct {
+	level  int
+	prefix [32]byte
+}
+
+type SparseTree struct {
+	hasher        Hasher
+	nodes         map[sparseNodeKey][32]byte
+	defaults      [sparseTreeDepth + 1][32]byte
+	AllowNegative bool
+}
+
+type SparseProof struct {
+	Siblings [][32]byte
+}
+
+// NewSparseTree creates an empty sparse Merkle tree keyed by the hash of an account identifier.
+//
+// It precomputes the root of an all-empty subtree at every level: empty leaves are the zero hash, and each level above is the hash of two copies of the level below. Only nodes that differ from these defaults are stored. Proof verification helpers hash with SHA-256, so use nil unless you verify with your own code.
+//
+// Parameters:
+//   - h: the Hasher used for keys, leaves and internal nodes, or nil for SHA-256
+//
+// Returns:
+//   a pointer to an empty SparseTree
+func NewSparseTree(h Hasher) *SparseTree {
+	if h == nil {
+		h = SHA256Hasher{}
+	}
+
+	t := &SparseTree{hasher: h, nodes: make(map[sparseNodeKey][32]byte)}
+	for level := sparseTreeDepth - 1; level >= 0; level-- {
+		t.defaults[level] = hashChildren(h, t.defaults[level+1], t.defaults[level+1])
+	}
+	return t
+}
+
+// Update sets the balance committed to for an account identifier.
+//
+// It hashes the balance into the leaf at the position given by the hash of the identifier and recomputes the 256 nodes on the path to the root. Updating an identifier again replaces its previous balance. Negative balances are rejected unless AllowNegative is set, as they are for every other tree.
+//
+// Parameters:
+//   - id: the account identifier
+//   - balance: the balance to commit to
+//
+// Returns:
+//   an error wrapping ErrNegativeBalance if the balance is negative and AllowNegative is not set, or an error if the balance cannot be marshalled
+func (t *SparseTree) Update(id string, balance Balance) error {
+	if err := validateBalance(id, balance, t.AllowNegative); err != nil {
+		return err
+	}
+	balance, _ = leafBalance(balance, false)
+	data, err := marshalCanonical(balance)
+	if err != nil {
+		return fmt.Errorf("marshal balance for account %s asset %s: %w", id, balance.Asset, err)
+	}
+
+	key := t.hasher.Hash([]byte(id))
+	current := hashLeaf(t.hasher, data)
+	t.nodes[sparseNodeKey{level: sparseTreeDepth, prefix: key}] = current
+
+	for level := sparseTreeDepth; level > 0; level-- {
+		sibling := t.node(level, sparseSiblingPrefix(key, level))
+		if sparseKeyBit(key, level-1) == 0 {
+			current = hashChildren(t.hasher, current, sibling)
+		} else {
+			current = hashChildren(t.hasher, sibling, current)
+		}
+		t.nodes[sparseNodeKey{level: level - 1, prefix: sparsePrefix(key, level-1)}] = current
+	}
+	return nil
+}
+
+// Root returns the current root hash of the sparse tree.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the root hash, which is the all-empty default root if nothing has been set
+func (t *SparseTree) Root() [32]byte {
+	return t.node(0, [32]byte{})
+}
+
+// ProveInclusion builds a proof that an identifier maps to the balance committed in the tree.
+//
+// Parameters:
+//   - id: the account identifier
+//
+// Returns:
+//   the sibling hashes from the leaf up to the root, or an error if the identifier has no balance in the tree
+func (t *SparseTree) ProveInclusion(id string) (SparseProof, error) {
+	key := t.hasher.Hash([]byte(id))
+	if _, ok := t.nodes[sparseNodeKey{level: sparseTreeDepth, prefix: key}]; !ok {
+		return SparseProof{}, fmt.Errorf("account %s: %w", id, ErrLeafNotFound)
+	}
+	return t.prove(key), nil
+}
+
+// ProveNonInclusion builds a proof that an identifier has no balance in the tree.
+//
+// The proof shows that the leaf at the identifier's position is still the empty default.
+//
+// Parameters:
+//   - id: the account identifier
+//
+// Returns:
+//   the sibling hashes from the leaf up to the root, or an error if the identifier does have a balance in the tree
+func (t *SparseTree) ProveNonInclusion(id string) (SparseProof, error) {
+	key := t.hasher.Hash([]byte(id))
+	if _, ok := t.nodes[sparseNodeKey{level: sparseTreeDepth, prefix: key}]; ok {
+		return SparseProof{}, fmt.Errorf("account %s is in the tree", id)
+	}
+	return t.prove(key), nil
+}
+
+// prove collects the sibling hashes along the path of a key.
+//
+// Parameters:
+//   - key: the hashed identifier
+//
+// Returns:
+//   the proof for the key's leaf, whatever it holds
+func (t *SparseTree) prove(key [32]byte) SparseProof {
+	siblings := make([][32]byte, 0, sparseTreeDepth)
+	for level := sparseTreeDepth; level > 0; level-- {
+		siblings = append(siblings, t.node(level, sparseSiblingPrefix(key, level)))
+	}
+	return SparseProof{Siblings: siblings}
+}
+
+// node returns the stored hash of a node, or the default for its level if it is empty.
+//
+// Parameters:
+//   - level: the node's depth, 0 for the root and sparseTreeDepth for leaves
+//   - prefix: the first level bits of the node's keys, the rest zeroed
+//
+// Returns:
+//   the node's hash
+func (t *SparseTree) node(level int, prefix [32]byte) [32]byte {
+	if hash, ok := t.nodes[sparseNodeKey{level: level, prefix: prefix}]; ok {
+		return hash
+	}
+	return t.defaults[level]
+}
+
+// VerifySparseInclusion checks a proof that an identifier maps to a balance under a SHA-256 sparse tree root.
+//
+// Parameters:
+//   - root: the published sparse tree root
+//   - id: the account identifier
+//   - balance: the balance the identifier is claimed to map to
+//   - proof: the proof returned by ProveInclusion
+//
+// Returns:
+//   true if the proof reconstructs the root, false otherwise
+func VerifySparseInclusion(root [32]byte, id string, balance Balance, proof SparseProof) bool {
+	balance, _ = leafBalance(balance, false)
+	data, err := marshalCanonical(balance)
+	if err != nil {
+		return false
+	}
+	return verifySparseProof(root, id, hashLeaf(SHA256Hasher{}, data), proof)
+}
+
+// VerifySparseNonInclusion checks a proof that an identifier has no balance under a SHA-256 sparse tree root.
+//
+// Parameters:
+//   - root: the published sparse tree root
+//   - id: the account identifier
+//   - proof: the proof returned by ProveNonInclusion
+//
+// Returns:
+//   true if the proof shows an empty leaf at the identifier's position, false otherwise
+func VerifySparseNonInclusion(root [32]byte, id string, proof SparseProof) bool {
+	return verifySparseProof(root, id, [32]byte{}, proof)
+}
+
+// verifySparseProof folds a leaf with its siblings and compares the result to the root.
+//
+// Parameters:
+//   - root: the published sparse tree root
+//   - id: the account identifier, which fixes the leaf's position
+//   - leaf: the leaf hash, or the zero hash for an empty leaf
+//   - proof: the sibling hashes from the leaf up to the root
+//
+// Returns:
+//   true if the proof reconstructs the root, false otherwise
+func verifySparseProof(root [32]byte, id string, leaf [32]byte, proof SparseProof) bool {
+	if len(proof.Siblings) != sparseTreeDepth {
+		return false
+	}
+
+	h := SHA256Hasher{}
+	key := h.Hash([]byte(id))
+	current := leaf
+	for i, sibling := range proof.Siblings {
+		if sparseKeyBit(key, sparseTreeDepth-1-i) == 0 {
+			current = hashChildren(h, current, sibling)
+		} else {
+			current = hashChildren(h, sibling, current)
+		}
+	}
+	return equalHashes(current, root)
+}
+
+// sparseKeyBit returns one bit of a key, counting from the most significant bit.
+//
+// Parameters:
+//   - key: the hashed identifier
+//   - i: the bit index, 0 for the bit that chooses the root's child
+//
+// Returns:
+//   0 to go left, 1 to go right
+func sparseKeyBit(key [32]byte, i int) byte {
+	return (key[i/8] >> (7 - i%8)) & 1
+}
+
+// sparsePrefix keeps the first bits of a key and zeroes the rest.
+//
+// Parameters:
+//   - key: the hashed identifier
+//   - bits: how many leading bits to keep
+//
+// Returns:
+//   the masked key, which identifies the node at depth bits on the key's path
+func sparsePrefix(key [32]byte, bits int) [32]byte {
+	var prefix [32]byte
+	copy(prefix[:bits/8], key[:bits/8])
+	if bits%8 != 0 {
+		prefix[bits/8] = key[bits/8] & ^byte(0xff>>(bits%8))
+	}
+	return prefix
+}
+
+// sparseSiblingPrefix identifies the sibling of the node at a given depth on a key's path.
+//
+// Parameters:
+//   - key: the hashed identifier
+//   - level: the depth of the node whose sibling is wanted
+//
+// Returns:
+//   the sibling's prefix
+func sparseSiblingPrefix(key [32]byte, level int) [32]byte {
+	prefix := sparsePrefix(key, level)
+	prefix[(level-1)/8] ^= 0x80 >> ((level - 1) % 8)
+	return prefix
+}
+
+// treeFormatVersion is the first byte of every serialized tree, so the layout can change later without misreading old files.
+const treeFormatVersion byte = 1
+
+const (
+	leafTag     byte = 0x00
+	internalTag byte = 0x01
+)
+
+// MarshalBinary serializes the tree rooted at n into a compact binary form.
+//
+// It writes a version byte and the hash length once, followed by every node in pre-order as a one-byte tag (leaf or internal) and its hash. Child links are implied by the order, since every internal node has exactly two children. The nodes are visited with Walk, so deep trees do not grow the goroutine stack.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the serialized tree, or an error if a node has only one child
+func (n *MerkleNode) MarshalBinary() ([]byte, error) {
+	buf := []byte{treeFormatVersion}
+	buf = binary.AppendUvarint(buf, uint64(len(n.Hash)))
+
+	var err error
+	n.Walk(func(node *MerkleNode, _ int) bool {
+		if err != nil {
+			return false
+		}
+		if node.Left == nil && node.Right == nil {
+			buf = append(buf, leafTag)
+			buf = append(buf, node.Hash[:]...)
+			return false
+		}
+		if node.Left == nil || node.Right == nil {
+			err = fmt.Errorf("node %x has only one child", node.Hash)
+			return false
+		}
+		buf = append(buf, internalTag)
+		buf = append(buf, node.Hash[:]...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// UnmarshalTree rebuilds a tree serialized by MerkleNode.MarshalBinary.
+//
+// It restores every hash and child link exactly as written, so the reloaded tree has the same root and produces the same proofs as the original. Hashes are not recomputed.
+//
+// Parameters:
+//   - data: the serialized tree
+//
+// Returns:
+//   a pointer to the root MerkleNode, or an error if the data is truncated, has trailing bytes, or uses an unknown version, hash length or tag
+func UnmarshalTree(data []byte) (*MerkleNode, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty tree data")
+	}
+	if data[0] != treeFormatVersion {
+		return nil, fmt.Errorf("unsupported tree format version %d", data[0])
+	}
+
+	hashLen, n := binary.Uvarint(data[1:])
+	if n <= 0 || hashLen != 32 {
+		return nil, fmt.Errorf("invalid hash length")
+	}
+
+	root, rest, err := decodeTreeNode(data[1+n:])
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after tree", len(rest))
+	}
+	return root, nil
+}
+
+// decodeTreeNode reads one node and its subtree from the front of data.
+//
+// It is the inverse of MarshalBinary's pre-order encoding. Internal nodes still waiting for a child are kept on an explicit stack rather than the goroutine stack, so a deeply unbalanced tree from untrusted data cannot exhaust it.
+//
+// Parameters:
+//   - data: the remaining serialized bytes
+//
+// Returns:
+//   the decoded node, the bytes following its subtree, or an error if the data is truncated or has an unknown tag
+func decodeTreeNode(data []byte) (*MerkleNode, []byte, error) {
+	var root *MerkleNode
+	var pending []*MerkleNode
+	for root == nil || len(pending) > 0 {
+		node := &MerkleNode{}
+		if len(data) < 1+len(node.Hash) {
+			return nil, nil, fmt.Errorf("truncated tree data")
+		}
+
+		tag := data[0]
+		copy(node.Hash[:], data[1:])
+		data = data[1+len(node.Hash):]
+		if tag != leafTag && tag != internalTag {
+			return nil, nil, fmt.Errorf("unknown node tag %d", tag)
+		}
+
+		if len(pending) == 0 {
+			root = node
+		} else if parent := pending[len(pending)-1]; parent.Left == nil {
+			parent.Left = node
+		} else {
+			parent.Right = node
+			pending = pending[:len(pending)-1]
+		}
+		if tag == internalTag {
+			pending = append(pending, node)
+		}
+	}
+	return root, data, nil
+}
+
+// SerializedSize returns the length of MarshalBinary's encoding of a tree without encoding it.
+//
+// The encoding is a version byte, the uvarint hash length and a tag byte plus a hash per node, so only the nodes need counting. Trees with a single-child node cannot be encoded, and their size counts the node as if it could.
+//
+// Parameters:
+//   - root: the root of the tree, or nil
+//
+// Returns:
+//   the encoded length in bytes, or 0 if root is nil
+func SerializedSize(root *MerkleNode) int64 {
+	if root == nil {
+		return 0
+	}
+	var nodes int64
+	root.Walk(func(*MerkleNode, int) bool {
+		nodes++
+		return true
+	})
+	header := 1 + len(binary.AppendUvarint(nil, uint64(len(root.Hash))))
+	return int64(header) + nodes*int64(1+len(root.Hash))
+}
+
+// SerializedJSONSize returns the length of json.Marshal's encoding of a tree without encoding it.
+//
+// Each node of MarshalJSON's encoding is {"hash":"<hex>"} with ,"left":<node> and ,"right":<node> added before the closing brace for each child it has, so the length follows from the node count and the number of left and right children.
+//
+// Parameters:
+//   - root: the root of the tree, or nil
+//
+// Returns:
+//   the encoded length in bytes, which for nil is the 4 bytes of null
+func SerializedJSONSize(root *MerkleNode) int64 {
+	if root == nil {
+		return int64(len("null"))
+	}
+	node := int64(len(`{"hash":""}`) + hex.EncodedLen(len(root.Hash)))
+	var size int64
+	root.Walk(func(n *MerkleNode, _ int) bool {
+		size += node
+		if n.Left != nil {
+			size += int64(len(`,"left":`))
+		}
+		if n.Right != nil {
+			size += int64(len(`,"right":`))
+		}
+		return true
+	})
+	return size
+}
+
+type merkleNodeJSON struct {
+	Hash  string      `json:"hash"`
+	Left  *MerkleNode `json:"left,omitempty"`
+	Right *MerkleNode `json:"right,omitempty"`
+}
+
+// MarshalJSON encodes the tree rooted at n with every hash as a lowercase hex string.
+//
+// Children are nested under "left" and "right" and omitted for leaves.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the JSON encoding of the tree, or an error if encoding fails
+func (n *MerkleNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(merkleNodeJSON{Hash: hex.EncodeToString(n.Hash[:]), Left: n.Left, Right: n.Right})
+}
+
+// UnmarshalJSON decodes a tree written by MarshalJSON.
+//
+// It restores the stored hashes as-is without recomputing them. Nesting depth is bounded by encoding/json, which rejects input nested more than 10000 levels deep, so a hostile document cannot recurse without limit.
+//
+// Parameters:
+//   - data: the JSON encoding of the tree
+//
+// Returns:
+//   an error if the JSON is malformed or too deeply nested, or a hash is not 32 hex-encoded bytes
+func (n *MerkleNode) UnmarshalJSON(data []byte) error {
+	var node merkleNodeJSON
+	if err := json.Unmarshal(data, &node); err != nil {
+		return err
+	}
+	hash, err := decodeHexHash(node.Hash)
+	if err != nil {
+		return err
+	}
+	n.Hash, n.Left, n.Right = hash, node.Left, node.Right
+	return nil
+}
+
+// Validate checks that every internal node's hash matches the hash of its children under SHA-256.
+//
+// It validates with the default SHA-256 tree builder; see TreeBuilder.Validate.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   an error identifying the first inconsistent node, or nil if the tree is consistent
+func (n *MerkleNode) Validate() error {
+	return NewTreeBuilder(nil).Validate(n)
+}
+
+// Validate checks that every internal node's hash matches the hash of its children under this builder's hasher.
+//
+// It walks the tree with Walk and recomputes each internal node's hash from its children with the internal node prefix. Once a mismatch is found, only that node's subtree is searched further, and the deepest mismatch there is the one reported, so a tampered node is reported rather than each of its ancestors. Leaves are accepted as-is. Use it on trees from an untrusted source, such as UnmarshalTree output, before serving proofs from them.
+//
+// Parameters:
+//   - root: the root of the tree to check
+//
+// Returns:
+//   an error giving the path (L and R steps from the root) and hashes of the first inconsistent node, or nil if the tree is consistent
+func (b *TreeBuilder) Validate(root *MerkleNode) error {
+	var (
+		parents     []*MerkleNode
+		path        []byte
+		failed      *MerkleNode
+		failedDepth int
+		expected    [32]byte
+		oneChild    bool
+	)
+	root.Walk(func(node *MerkleNode, depth int) bool {
+		if oneChild || (failed != nil && depth <= failedDepth) {
+			return false
+		}
+
+		parents = append(parents[:depth], node)
+		if depth > 0 {
+			step := byte('R')
+			if parents[depth-1].Left == node {
+				step = 'L'
+			}
+			path = append(path[:depth-1], step)
+		}
+
+		if node.Left == nil && node.Right == nil {
+			return true
+		}
+		if node.Left == nil || node.Right == nil {
+			failed, failedDepth, oneChild = node, depth, true
+			return false
+		}
+		if hash := hashChildren(b.h(), node.Left.Hash, node.Right.Hash); !equalHashes(hash, node.Hash) {
+			failed, failedDepth, expected = node, depth, hash
+		}
+		return true
+	})
+
+	// Only nodes below the failed one are visited after it is recorded, so its path is still intact.
+	switch {
+	case failed == nil:
+		return nil
+	case oneChild:
+		return fmt.Errorf("node at path %q has only one child", path[:failedDepth])
+	default:
+		return fmt.Errorf("node at path %q: stored hash %x does not match its children %x", path[:failedDepth], failed.Hash, expected)
+	}
+}
+
+type walkFrame struct {
+	node  *MerkleNode
+	depth int
+}
+
+// Walk visits every node under n in pre-order, left before right, without recursion.
+//
+// It keeps pending nodes on an explicit stack that grows with the tree's depth rather than the goroutine stack, so traversals built on it, such as Validate, Leaves, Depth, LeafCount, GenerateProof and MarshalBinary, handle unbalanced or very deep trees without deep recursion. The root has depth 0. Returning false from fn skips the node's children, which lets callers prune subtrees or, by returning false for every later node, stop early. It is safe to call on a nil node.
+//
+// Parameters:
+//   - fn: called for each node with its depth below n; returns whether to visit the node's children
+//
+// Returns:
+//   None
+func (n *MerkleNode) Walk(fn func(node *MerkleNode, depth int) bool) {
+	if n == nil {
+		return
+	}
+
+	stack := []walkFrame{{node: n, depth: 0}}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !fn(top.node, top.depth) {
+			continue
+		}
+		if top.node.Right != nil {
+			stack = append(stack, walkFrame{node: top.node.Right, depth: top.depth + 1})
+		}
+		if top.node.Left != nil {
+			stack = append(stack, walkFrame{node: top.node.Left, depth: top.depth + 1})
+		}
+	}
+}
+
+// Depth returns the height of the tree rooted at n.
+//
+// It counts the nodes on the longest path from n down to a leaf, so a single leaf has depth 1. Carried-up nodes are not duplicated, so they add no extra levels. It is safe to call on a nil node.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the height of the tree, or 0 if n is nil
+func (n *MerkleNode) Depth() int {
+	depth := 0
+	n.Walk(func(_ *MerkleNode, d int) bool {
+		if d+1 > depth {
+			depth = d + 1
+		}
+		return true
+	})
+	return depth
+}
+
+// LeafCount returns the number of leaves in the tree rooted at n.
+//
+// It counts childless nodes, which are exactly the leaves that were hashed into the tree, since unpaired nodes are carried up rather than padded with duplicates. It is safe to call on a nil node.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the number of leaves, or 0 if n is nil
+func (n *MerkleNode) LeafCount() int {
+	count := 0
+	n.Walk(func(node *MerkleNode, _ int) bool {
+		if node.Left == nil && node.Right == nil {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// Leaves returns the hashes of the leaves under n in construction order.
+//
+// It walks the tree left to right and collects the childless nodes. Unpaired nodes are carried up rather than duplicated, so each leaf appears exactly once, and rebuilding a tree from the returned hashes reproduces n's root. It is safe to call on a nil node.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   a copy of each leaf hash, or nil if n is nil
+func (n *MerkleNode) Leaves() [][]byte {
+	hashes := appendLeafHashes(nil, n)
+	if hashes == nil {
+		return nil
+	}
+
+	leaves := make([][]byte, len(hashes))
+	for i := range hashes {
+		leaves[i] = hashes[i][:]
+	}
+	return leaves
+}
+
+// DuplicateLeaves returns the positions of the leaves under n whose hash appears more than once.
+//
+// Positions are indices into Leaves. Since unpaired nodes are carried up rather than duplicated, a repeated hash means the same leaf data was committed twice, such as an account listed twice in a build with AllowDuplicates. The padding leaves of a BuildPadded tree all share one hash and are reported too; compare against PaddingLeaf to tell them apart.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the positions of every leaf whose hash is shared with another leaf, in ascending order, or nil if all leaves are distinct
+func (n *MerkleNode) DuplicateLeaves() []int {
+	hashes := appendLeafHashes(nil, n)
+	counts := make(map[[32]byte]int, len(hashes))
+	for _, hash := range hashes {
+		counts[hash]++
+	}
+
+	var duplicates []int
+	for i, hash := range hashes {
+		if counts[hash] > 1 {
+			duplicates = append(duplicates, i)
+		}
+	}
+	return duplicates
+}
+
+// StreamLevels writes the tree's hashes one level at a time, deepest level first, so a reader can rebuild the root bottom-up.
+//
+// Each level starts with a "level <depth>" line, with the root at depth 0, followed by one "leaf <hex>" or "node <hex>" line per node at that depth, left to right. The children of a level's internal nodes are exactly the next deeper level, in order, so RootFromLevels needs to hold only one level at a time. Each level is collected with its own pruned Walk, so no copy of the tree is made.
+//
+// Parameters:
+//   - w: the writer to stream to
+//   - root: the root of the tree, or nil to write nothing
+//
+// Returns:
+//   an error if writing fails
+func StreamLevels(w io.Writer, root *MerkleNode) error {
+	out := bufio.NewWriter(w)
+	for level := root.Depth() - 1; level >= 0; level-- {
+		fmt.Fprintf(out, "level %d\n", level)
+		root.Walk(func(node *MerkleNode, depth int) bool {
+			if depth < level {
+				return true
+			}
+			kind := "node"
+			if node.Left == nil && node.Right == nil {
+				kind = "leaf"
+			}
+			fmt.Fprintf(out, "%s %x\n", kind, node.Hash)
+			return false
+		})
+	}
+	return out.Flush()
+}
+
+// RootFromLevels rebuilds the SHA-256 root of a tree streamed by StreamLevels.
+//
+// It hashes with SHA-256; see TreeBuilder.RootFromLevels.
+//
+// Parameters:
+//   - r: the reader providing the streamed levels
+//
+// Returns:
+//   the root hash, or an error if the stream is malformed or inconsistent
+func RootFromLevels(r io.Reader) ([32]byte, error) {
+	return NewTreeBuilder(nil).RootFromLevels(r)
+}
+
+// RootFromLevels rebuilds the root of a tree streamed by StreamLevels using the builder's hasher.
+//
+// Leaf hashes are taken as written. Every internal node's hash is recomputed from the two next deeper nodes it covers and checked against the one written, so the returned root is only as trusted as the leaves. Only the previous level is kept in memory.
+//
+// Parameters:
+//   - r: the reader providing the streamed levels
+//
+// Returns:
+//   the root hash, or ErrEmptyTree if the stream has no levels, an error wrapping ErrInvalidTree if a hash does not match its children or the levels do not fit together, or an error if a line is malformed
+func (b *TreeBuilder) RootFromLevels(r io.Reader) ([32]byte, error) {
+	scanner := bufio.NewScanner(r)
+	var previous, current [][32]byte
+	level, used := -1, 0
+	endLevel := func() error {
+		if level >= 0 && used != len(previous) {
+			return fmt.Errorf("%w: level %d covers %d of %d nodes below it", ErrInvalidTree, level, used, len(previous))
+		}
+		previous, current, used = current, previous[:0], 0
+		return nil
+	}
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		kind, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return [32]byte{}, fmt.Errorf("line %d: malformed line %q", lineNumber, scanner.Text())
+		}
+		if kind == "level" {
+			next, err := strconv.Atoi(value)
+			if err != nil || (level >= 0 && next != level-1) {
+				return [32]byte{}, fmt.Errorf("line %d: %w: unexpected level %q", lineNumber, ErrInvalidTree, value)
+			}
+			if err := endLevel(); err != nil {
+				return [32]byte{}, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			level = next
+			continue
+		}
+
+		hash, err := decodeHexHash(value)
+		if err != nil {
+			return [32]byte{}, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		switch {
+		case level < 0:
+			return [32]byte{}, fmt.Errorf("line %d: node before the first level marker", lineNumber)
+		case kind == "node":
+			if used+2 > len(previous) {
+				return [32]byte{}, fmt.Errorf("line %d: %w: node has no children left below it", lineNumber, ErrInvalidTree)
+			}
+			if expected := hashChildren(b.h(), previous[used], previous[used+1]); !equalHashes(expected, hash) {
+				return [32]byte{}, fmt.Errorf("line %d: %w: stored hash %x does not match its children %x", lineNumber, ErrInvalidTree, hash, expected)
+			}
+			used += 2
+		case kind != "leaf":
+			return [32]byte{}, fmt.Errorf("line %d: unknown node kind %q", lineNumber, kind)
+		}
+		current = append(current, hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return [32]byte{}, err
+	}
+
+	if level < 0 {
+		return [32]byte{}, ErrEmptyTree
+	}
+	if err := endLevel(); err != nil {
+		return [32]byte{}, err
+	}
+	if level != 0 || len(previous) != 1 {
+		return [32]byte{}, fmt.Errorf("%w: stream ends at level %d with %d nodes", ErrInvalidTree, level, len(previous))
+	}
+	return previous[0], nil
+}
+
+// UpdateLeaf replaces one leaf of a SHA-256 tree and returns the resulting root.
+//
+// It updates the tree with the default SHA-256 tree builder; see TreeBuilder.UpdateLeaf.
+//
+// Parameters:
+//   - oldHash: the hash of the leaf to replace
+//   - newHash: the hash of the replacement leaf
+//   - inPlace: whether to modify n's nodes rather than copying the changed path
+//
+// Returns:
+//   the root of the updated tree, or an error if no leaf has oldHash
+func (n *MerkleNode) UpdateLeaf(oldHash, newHash [32]byte, inPlace bool) (*MerkleNode, error) {
+	return NewTreeBuilder(nil).UpdateLeaf(n, oldHash, newHash, inPlace)
+}
+
+// UpdateLeaf replaces one leaf of a tree built with this builder's hasher and returns the resulting root.
+//
+// Only the nodes on the path from the leaf to the root are rehashed, so a single balance change costs one hash per level instead of a full rebuild. Finding the leaf still walks the tree, as GenerateProof does. With inPlace unset the changed path is copied and the new root shares every other node with the original, which is left untouched; with inPlace set the path is rewritten and root itself is returned. If several leaves have oldHash, the leftmost is replaced.
+//
+// Parameters:
+//   - root: the root of the tree to update
+//   - oldHash: the hash of the leaf to replace
+//   - newHash: the hash of the replacement leaf
+//   - inPlace: whether to modify root's nodes rather than copying the changed path
+//
+// Returns:
+//   the root of the updated tree, or ErrEmptyTree if root is nil, or an error wrapping ErrLeafNotFound if no leaf has oldHash
+func (b *TreeBuilder) UpdateLeaf(root *MerkleNode, oldHash, newHash [32]byte, inPlace bool) (*MerkleNode, error) {
+	if root == nil {
+		return nil, ErrEmptyTree
+	}
+	updated, ok := b.updatePath(root, oldHash, newHash, inPlace)
+	if !ok {
+		return nil, fmt.Errorf("%w: %x", ErrLeafNotFound, oldHash)
+	}
+	return updated, nil
+}
+
+// updatePath replaces a leaf under node and rehashes the nodes above it.
+//
+// Parameters:
+//   - node: the root of the subtree to search
+//   - oldHash: the hash of the leaf to replace
+//   - newHash: the hash of the replacement leaf
+//   - inPlace: whether to modify nodes rather than copying them
+//
+// Returns:
+//   the updated subtree, and whether the leaf was found
+func (b *TreeBuilder) updatePath(node *MerkleNode, oldHash, newHash [32]byte, inPlace bool) (*MerkleNode, bool) {
+	if node == nil {
+		return nil, false
+	}
+
+	left, right := node.Left, node.Right
+	if left == nil && right == nil {
+		if node.Hash != oldHash {
+			return nil, false
+		}
+	} else if updated, ok := b.updatePath(left, oldHash, newHash, inPlace); ok {
+		left = updated
+	} else if updated, ok := b.updatePath(right, oldHash, newHash, inPlace); ok {
+		right = updated
+	} else {
+		return nil, false
+	}
+
+	updated := node
+	if !inPlace {
+		updated = &MerkleNode{}
+	}
+	updated.Left, updated.Right = left, right
+	if left == nil && right == nil {
+		updated.Hash = newHash
+	} else {
+		updated.Hash = hashChildren(b.h(), left.Hash, right.Hash)
+	}
+	return updated, true
+}
+
+// RootEquals reports whether n and other commit to the same root hash.
+//
+// The hashes are compared in constant time. It is safe to call with either node nil: two nil nodes are equal, and a nil node never equals a non-nil one.
+//
+// Parameters:
+//   - other: the tree to compare against
+//
+// Returns:
+//   true if both trees have the same root hash or both are nil, false otherwise
+func (n *MerkleNode) RootEquals(other *MerkleNode) bool {
+	if n == nil || other == nil {
+		return n == nil && other == nil
+	}
+	return equalHashes(n.Hash, other.Hash)
+}
+
+// RootHex returns the root hash of n as lowercase hex.
+//
+// It is safe to call on a nil node.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the hex-encoded root hash, or an empty string if n is nil
+func (n *MerkleNode) RootHex() string {
+	if n == nil {
+		return ""
+	}
+	return hex.EncodeToString(n.Hash[:])
+}
+
+type DiffResult struct {
+	Index int
+	Old   []byte
+	New   []byte
+}
+
+// DiffTrees reports which leaves differ between two trees.
+//
+// It walks both trees together and stops descending wherever the subtree hashes match, so only changed leaves are compared. Leaf positions come from counting the leaves under each left child it descends past rather than from the tree's shape, so the indices match Leaves for any tree, including ones whose root also commits to a PolicyHash or ReserveAddresses and the super-trees of BuildTwoLevel and BuildPerAsset. Where the shapes diverge, for example because leaves were added or removed, the leaves under that point are compared by position.
+//
+// Parameters:
+//   - a: the root of the old tree
+//   - b: the root of the new tree
+//
+// Returns:
+//   one DiffResult per differing leaf position, in index order, with Old or New nil where the leaf exists in only one tree
+func DiffTrees(a, b *MerkleNode) []DiffResult {
+	var diffs []DiffResult
+	diffSubtrees(a, b, 0, make(map[*MerkleNode]int), &diffs)
+	return diffs
+}
+
+// diffSubtrees compares two subtrees whose first leaf sits at the given index.
+//
+// It descends into both children only when the left children hold the same number of leaves, so the right children's first leaves share an index too. Otherwise the subtrees are compared by position.
+//
+// Parameters:
+//   - a: the old subtree
+//   - b: the new subtree
+//   - offset: the leaf index of the first leaf under both subtrees
+//   - counts: the leaf counts computed so far, shared across the whole diff
+//   - diffs: the results to append to
+//
+// Returns:
+//   None
+func diffSubtrees(a, b *MerkleNode, offset int, counts map[*MerkleNode]int, diffs *[]DiffResult) {
+	if a != nil && b != nil && a.Hash == b.Hash {
+		return
+	}
+
+	if a != nil && b != nil && a.Left != nil && b.Left != nil {
+		leftSize := countLeaves(a.Left, counts)
+		if countLeaves(b.Left, counts) == leftSize {
+			diffSubtrees(a.Left, b.Left, offset, counts, diffs)
+			diffSubtrees(a.Right, b.Right, offset+leftSize, counts, diffs)
+			return
+		}
+	}
+
+	oldLeaves, newLeaves := appendLeafHashes(nil, a), appendLeafHashes(nil, b)
+	for i := 0; i < len(oldLeaves) || i < len(newLeaves); i++ {
+		var oldHash, newHash []byte
+		if i < len(oldLeaves) {
+			oldHash = oldLeaves[i][:]
+		}
+		if i < len(newLeaves) {
+			newHash = newLeaves[i][:]
+		}
+		if !bytes.Equal(oldHash, newHash) {
+			*diffs = append(*diffs, DiffResult{Index: offset + i, Old: oldHash, New: newHash})
+		}
+	}
+}
+
+// countLeaves returns the number of leaves under a node, remembering the count of every node it visits.
+//
+// A diff asks for the left child at every level it descends, so without the memo the same lower subtrees would be counted again at each level.
+//
+// Parameters:
+//   - node: the subtree to count, or nil
+//   - counts: the counts computed so far, updated in place
+//
+// Returns:
+//   the number of leaves under node, or 0 if node is nil
+func countLeaves(node *MerkleNode, counts map[*MerkleNode]int) int {
+	if node == nil {
+		return 0
+	}
+	if count, ok := counts[node]; ok {
+		return count
+	}
+	count := 1
+	if node.Left != nil || node.Right != nil {
+		count = countLeaves(node.Left, counts) + countLeaves(node.Right, counts)
+	}
+	counts[node] = count
+	return count
+}
+
+// appendLeafHashes appends the hashes of every leaf under a node, left to right.
+//
+// Parameters:
+//   - hashes: the slice to append to
+//   - node: the subtree to walk, or nil
+//
+// Returns:
+//   the extended slice
+func appendLeafHashes(hashes [][32]byte, node *MerkleNode) [][32]byte {
+	node.Walk(func(n *MerkleNode, _ int) bool {
+		if n.Left == nil && n.Right == nil {
+			hashes = append(hashes, n.Hash)
+		}
+		return true
+	})
+	return hashes
+}
+
+// HashOpCount computes how many hash invocations a full tree build performs.
+//
+// It counts one hash per leaf plus one combine per pair of nodes at every level. An unpaired last node is carried up without hashing.
+//
+// Parameters:
+//   - leafCount: the number of leaves in the tree
+//
+// Returns:
+//   the total number of hash operations needed to build the tree
+func HashOpCount(leafCount int) int {
+	ops := leafCount
+	for level := leafCount; level > 1; level = (level + 1) / 2 {
+		ops += level / 2
+	}
+
+	return ops
+}
+
+// HashOpCount computes how many hash invocations a Build or BuildPadded call with this builder's options performs.
+//
+// It counts one hash per leaf actually built plus the internal nodes joining them, including those against a zero sibling if PairWithZero is set. A padded build widens the leaves to the next power of two, but the padding leaf is hashed once however many times it is repeated. An empty tree costs the single hash of its empty root. The policy leaf, the reserve address sub-tree and the combines that join them to the built root are added on top. Trees are always binary, so there is no arity to account for.
+//
+// Parameters:
+//   - leafCount: the number of balances in the build
+//   - padded: whether the count is for BuildPadded rather than Build
+//
+// Returns:
+//   the total number of hash operations the build performs
+func (b *TreeBuilder) HashOpCount(leafCount int, padded bool) int {
+	var ops int
+	switch {
+	case leafCount == 0:
+		ops = 1
+	case padded:
+		width := 1 << bits.Len(uint(leafCount-1))
+		ops = leafCount + width - 1
+		if width > leafCount {
+			ops++
+		}
+	default:
+		ops = leafCount + b.combineCount(leafCount)
+	}
+
+	if len(b.PolicyHash) > 0 {
+		ops++
+	}
+	if len(b.ReserveAddresses) > 0 {
+		ops += len(b.ReserveAddresses) + b.combineCount(len(b.ReserveAddresses))
+	}
+	return ops + b.combineCount(1+b.rootExtraCount())
+}
+
+// combineCount returns how many internal nodes buildTree hashes to join the given number of nodes into one.
+//
+// Without PairWithZero that is one per pair at every level, n-1 in all. With it, the unpaired node at each odd level costs one more.
+//
+// Parameters:
+//   - nodes: the number of nodes at the bottom level
+//
+// Returns:
+//   the number of internal node hashes
+func (b *TreeBuilder) combineCount(nodes int) int {
+	count := 0
+	for level := nodes; level > 1; level = (level + 1) / 2 {
+		count += level / 2
+		if b.PairWithZero {
+			count += level % 2
+		}
+	}
+	return count
+}
+
+type TreeEstimate struct {
+	Leaves  int
+	Depth   int
+	Nodes   int
+	HashOps int
+	Bytes   int64
+}
+
+// EstimateTree predicts the shape and memory footprint of a build without hashing anything.
+//
+// Every combine of two nodes creates one parent and unpaired nodes are carried up rather than duplicated, so n leaves always give 2n-1 nodes, and the depth counts levels the same way MerkleNode.Depth does. Bytes covers the nodes plus the flattened balances and the leaf and level pointer slices that Build holds at its peak; it leaves out the accounts themselves and allocator overhead, so treat it as a lower bound. HashOps, from TreeBuilder.HashOpCount for a builder without a policy hash or reserve addresses, is the best proxy for build time and counts the empty root's hash when there are no leaves.
+//
+// Parameters:
+//   - accountCount: the number of accounts
+//   - avgBalancesPerAccount: the average number of balances per account
+//
+// Returns:
+//   the estimated leaf count, depth, node count, hash operations and bytes
+func EstimateTree(accountCount, avgBalancesPerAccount int) TreeEstimate {
+	leaves := accountCount * avgBalancesPerAccount
+	estimate := TreeEstimate{Leaves: leaves, Depth: 1, Nodes: 1, HashOps: NewTreeBuilder(nil).HashOpCount(leaves, false)}
+	if leaves > 1 {
+		estimate.Depth += bits.Len(uint(leaves - 1))
+		estimate.Nodes = 2*leaves - 1
+	}
+
+	perLeaf := int64(unsafe.Sizeof(accountBalance{})) + 2*int64(unsafe.Sizeof((*MerkleNode)(nil)))
+	estimate.Bytes = int64(estimate.Nodes)*int64(unsafe.Sizeof(MerkleNode{})) + int64(leaves)*perLeaf
+	return estimate
+}
+
+type ProofStep struct {
+	Hash   [32]byte
+	IsLeft bool
+}
+
+// MarshalJSON encodes a proof step with its hash as a lowercase hex string.
+//
+// It uses the same shape as ProofStepJSON, so browser-based verifiers receive hex rather than an array of bytes.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the JSON encoding of the step, or an error if encoding fails
+func (s ProofStep) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ProofStepJSON{Hash: hex.EncodeToString(s.Hash[:]), IsLeft: s.IsLeft})
+}
+
+// UnmarshalJSON decodes a proof step written by MarshalJSON.
+//
+// Parameters:
+//   - data: the JSON encoding of the step
+//
+// Returns:
+//   an error if the JSON is malformed or the hash is not 32 hex-encoded bytes
+func (s *ProofStep) UnmarshalJSON(data []byte) error {
+	var step ProofStepJSON
+	if err := json.Unmarshal(data, &step); err != nil {
+		return err
+	}
+	hash, err := decodeHexHash(step.Hash)
+	if err != nil {
+		return err
+	}
+	s.Hash, s.IsLeft = hash, step.IsLeft
+	return nil
+}
+
+// decodeHexHash decodes a hex-encoded 32-byte hash.
+//
+// Parameters:
+//   - encoded: the hex string to decode
+//
+// Returns:
+//   the decoded hash, or an error if the string is not valid hex or not exactly 32 bytes
+func decodeHexHash(encoded string) ([32]byte, error) {
+	var hash [32]byte
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil {
+		return hash, fmt.Errorf("invalid hash %q: %w", encoded, err)
+	}
+	if len(decoded) != len(hash) {
+		return hash, fmt.Errorf("invalid hash %q: got %d bytes, expected %d", encoded, len(decoded), len(hash))
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+type CompactProofStep struct {
+	Hash   string `json:"hash,omitempty"`
+	Ref    int    `json:"ref,omitempty"`
+	IsLeft bool   `json:"isLeft"`
+}
+
+// CompactProofs encodes a batch of proofs so that each distinct sibling hash is written only once.
+//
+// The first occurrence of a hash is written as hex, as in ProofStepJSON; every later occurrence instead carries Ref, the 1-based position of that hash among the distinct hashes written so far across the batch, in proof and step order. Proofs from one tree share their upper siblings, and a tree from BuildPadded repeats the same padding subtree hashes in every proof that passes them, so the batch shrinks considerably when marshalled to JSON. ExpandProofs reverses the encoding.
+//
+// Parameters:
+//   - proofs: the proofs to encode, each ordered from the leaf up to the root
+//
+// Returns:
+//   the compact proofs, in the same order as proofs
+func CompactProofs(proofs [][]ProofStep) [][]CompactProofStep {
+	refs := make(map[[32]byte]int)
+	compact := make([][]CompactProofStep, len(proofs))
+	for i, proof := range proofs {
+		compact[i] = make([]CompactProofStep, len(proof))
+		for j, step := range proof {
+			if ref, ok := refs[step.Hash]; ok {
+				compact[i][j] = CompactProofStep{Ref: ref, IsLeft: step.IsLeft}
+				continue
+			}
+			refs[step.Hash] = len(refs) + 1
+			compact[i][j] = CompactProofStep{Hash: hex.EncodeToString(step.Hash[:]), IsLeft: step.IsLeft}
+		}
+	}
+	return compact
+}
+
+// ExpandProofs resolves the back-references in a batch written by CompactProofs.
+//
+// The expanded proofs verify with VerifyProof exactly like the proofs that were compacted.
+//
+// Parameters:
+//   - compact: the compact proofs, in the order CompactProofs returned them
+//
+// Returns:
+//   the full proofs, or an error if a step has both or neither of a hash and a reference, a hash is malformed or a reference points past the hashes written before it
+func ExpandProofs(compact [][]CompactProofStep) ([][]ProofStep, error) {
+	var hashes [][32]byte
+	proofs := make([][]ProofStep, len(compact))
+	for i, steps := range compact {
+		proofs[i] = make([]ProofStep, len(steps))
+		for j, step := range steps {
+			switch {
+			case step.Hash != "" && step.Ref != 0:
+				return nil, fmt.Errorf("proof %d step %d: both hash and ref set", i, j)
+			case step.Hash != "":
+				hash, err := decodeHexHash(step.Hash)
+				if err != nil {
+					return nil, fmt.Errorf("proof %d step %d: %w", i, j, err)
+				}
+				hashes = append(hashes, hash)
+				proofs[i][j] = ProofStep{Hash: hash, IsLeft: step.IsLeft}
+			case step.Ref >= 1 && step.Ref <= len(hashes):
+				proofs[i][j] = ProofStep{Hash: hashes[step.Ref-1], IsLeft: step.IsLeft}
+			default:
+				return nil, fmt.Errorf("proof %d step %d: ref %d out of range 1..%d", i, j, step.Ref, len(hashes))
+			}
+		}
+	}
+	return proofs, nil
+}
+
+// GenerateProof builds a Merkle inclusion proof for a leaf.
+//
+// It walks the tree to find the leaf whose hash matches leafHash and collects the sibling hash and its position at each level on the way back up to the root.
+//
+// Parameters:
+//   - root: a pointer to the root MerkleNode of the tree
+//   - leafHash: the hash of the leaf to prove
+//
+// Returns:
+//   the proof steps ordered from the leaf up to the root, or ErrEmptyTree if root is nil, or an error wrapping ErrLeafNotFound if the leaf is not present in the tree
+func GenerateProof(root *MerkleNode, leafHash [32]byte) ([]ProofStep, error) {
+	if root == nil {
+		return nil, ErrEmptyTree
+	}
+	proof, ok := findProofPath(root, leafHash)
+	if !ok {
+		return nil, fmt.Errorf("%w: %x", ErrLeafNotFound, leafHash)
+	}
+
+	return proof, nil
+}
+
+// GenerateProof builds a Merkle inclusion proof for a leaf, checking it against the root first if SelfVerifyProofs is set.
+//
+// The check replays the proof with VerifyProof under the builder's hasher. It costs one hash per step and catches a tree whose stored hashes were corrupted after it was built, such as one loaded from disk, before the proof is handed to a user who would find it does not verify.
+//
+// Parameters:
+//   - root: a pointer to the root MerkleNode of the tree
+//   - leafHash: the hash of the leaf to prove
+//
+// Returns:
+//   the proof steps ordered from the leaf up to the root, or the errors of the package-level GenerateProof, or an error wrapping ErrInvalidTree if self-verification is on and the proof does not reproduce the root
+func (b *TreeBuilder) GenerateProof(root *MerkleNode, leafHash [32]byte) ([]ProofStep, error) {
+	proof, err := GenerateProof(root, leafHash)
+	if err != nil {
+		return nil, err
+	}
+	if b.SelfVerifyProofs && !b.VerifyProof(leafHash, proof, root.Hash) {
+		return nil, fmt.Errorf("%w: proof of leaf %x does not reproduce root %x", ErrInvalidTree, leafHash, root.Hash)
+	}
+	return proof, nil
+}
+
+// findProofPath searches a subtree for a leaf and records the siblings along the path.
+//
+// It walks the subtree with Walk, left before right, keeping the nodes on the current path, and stops at the first matching leaf. Nodes with a single child are not descended into, since a proof through them would have no sibling to record.
+//
+// Parameters:
+//   - node: the root of the subtree to search
+//   - leafHash: the hash of the leaf to find
+//
+// Returns:
+//   the proof steps from the leaf up to node, and whether the leaf was found
+func findProofPath(node *MerkleNode, leafHash [32]byte) ([]ProofStep, bool) {
+	var path []*MerkleNode
+	found := false
+	node.Walk(func(current *MerkleNode, depth int) bool {
+		if found {
+			return false
+		}
+		path = append(path[:depth], current)
+		if current.Left == nil && current.Right == nil {
+			found = current.Hash == leafHash
+			return false
+		}
+		return current.Left != nil && current.Right != nil
+	})
+	if !found {
+		return nil, false
+	}
+
+	var proof []ProofStep
+	for i := len(path) - 1; i > 0; i-- {
+		if parent := path[i-1]; parent.Left == path[i] {
+			proof = append(proof, ProofStep{Hash: parent.Right.Hash, IsLeft: false})
+		} else {
+			proof = append(proof, ProofStep{Hash: parent.Left.Hash, IsLeft: true})
+		}
+	}
+	return proof, true
+}
+
+// VerifyProof checks that a leaf is included under an expected Merkle root built with SHA-256.
+//
+// It verifies the proof with the default SHA-256 tree builder.
+//
+// Parameters:
+//   - leafHash: the hash of the leaf being proven
+//   - proof: the proof steps ordered from the leaf up to the root
+//   - expectedRoot: the published root hash
+//
+// Returns:
+//   true if the proof reconstructs the expected root, false otherwise
+func VerifyProof(leafHash [32]byte, proof []ProofStep, expectedRoot [32]byte) bool {
+	return NewTreeBuilder(nil).VerifyProof(leafHash, proof, expectedRoot)
+}
+
+// VerifyProofStream checks a JSON-encoded proof read from r against an expected root built with SHA-256.
+//
+// It verifies the proof with the default SHA-256 tree builder; see TreeBuilder.VerifyProofStream.
+//
+// Parameters:
+//   - leafHash: the hash of the leaf being proven
+//   - r: a reader yielding a JSON array of proof steps ordered from the leaf up to the root
+//   - expectedRoot: the published root hash
+//
+// Returns:
+//   true if the proof reconstructs the expected root, or an error if the proof cannot be decoded
+func VerifyProofStream(leafHash [32]byte, r io.Reader, expectedRoot [32]byte) (bool, error) {
+	return NewTreeBuilder(nil).VerifyProofStream(leafHash, r, expectedRoot)
+}
+
+// VerifyProofStream checks a JSON-encoded proof read from r against an expected root built with this builder's hasher.
+//
+// It decodes the proof one step at a time and folds each step into the running hash as it arrives, so neither the tree nor the decoded proof is held in memory. A JSON null is read as an empty proof, which is how json.Marshal encodes the nil proof of a single-leaf tree. Like VerifyProof it depends only on the leaf hash, the proof and the root.
+//
+// Parameters:
+//   - leafHash: the hash of the leaf being proven
+//   - r: a reader yielding a JSON array of proof steps ordered from the leaf up to the root
+//   - expectedRoot: the published root hash
+//
+// Returns:
+//   true if the proof reconstructs the expected root, or an error if the proof cannot be decoded
+func (b *TreeBuilder) VerifyProofStream(leafHash [32]byte, r io.Reader, expectedRoot [32]byte) (bool, error) {
+	dec := json.NewDecoder(r)
+	current := leafHash
+	if tok, err := dec.Token(); err != nil {
+		return false, err
+	} else if tok == nil {
+		return equalHashes(current, expectedRoot), nil
+	} else if tok != json.Delim('[') {
+		return false, fmt.Errorf("proof must be a JSON array, got %v", tok)
+	}
+
+	for dec.More() {
+		var step ProofStep
+		if err := dec.Decode(&step); err != nil {
+			return false, err
+		}
+		if step.IsLeft {
+			current = hashChildren(b.h(), step.Hash, current)
+		} else {
+			current = hashChildren(b.h(), current, step.Hash)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return false, err
+	}
+
+	return equalHashes(current, expectedRoot), nil
+}
+
+// VerifyProof checks that a leaf is included under an expected Merkle root built with this builder's hasher.
+//
+// It folds the leaf hash with each sibling in order, placing the sibling on the left or right according to IsLeft, hashes each pair under the internal node prefix and compares the result to the expected root in constant time. This is how a verifier checks proofs from a tree built with another Hasher: it creates a builder with the same hasher and verifies through it. The node prefixes and positional pairing are fixed for every builder, so the hasher is the only option that has to match.
+//
+// Parameters:
+//   - leafHash: the hash of the leaf being proven
+//   - proof: the proof steps ordered from the leaf up to the root
+//   - expectedRoot: the published root hash
+//
+// Returns:
+//   true if the proof reconstructs the expected root, false otherwise
+func (b *TreeBuilder) VerifyProof(leafHash [32]byte, proof []ProofStep, expectedRoot [32]byte) bool {
+	return equalHashes(b.proofRoot(leafHash, proof), expectedRoot)
+}
+
+// proofRoot folds a leaf hash with the siblings of a proof to the root the proof leads to.
+//
+// Parameters:
+//   - leafHash: the hash of the leaf being proven
+//   - proof: the proof steps ordered from the leaf up to the root
+//
+// Returns:
+//   the root reconstructed from the leaf and the proof
+func (b *TreeBuilder) proofRoot(leafHash [32]byte, proof []ProofStep) [32]byte {
+	current := leafHash
+	for _, step := range proof {
+		if step.IsLeft {
+			current = hashChildren(b.h(), step.Hash, current)
+		} else {
+			current = hashChildren(b.h(), current, step.Hash)
+		}
+	}
+	return current
+}
+
+// VerifyAgainstAny checks a balance's proof against several candidate SHA-256 roots and reports which one it verifies against.
+//
+// It hashes with SHA-256; see TreeBuilder.VerifyAgainstAny.
+//
+// Parameters:
+//   - rootsHex: the candidate roots, hex encoded
+//   - leaf: the balance being proven
+//   - proof: the proof steps ordered from the leaf up to the root
+//
+// Returns:
+//   the index of the first root the proof verifies against and true, or -1 and false if it verifies against none
+func VerifyAgainstAny(rootsHex []string, leaf Balance, proof []ProofStep) (int, bool) {
+	return NewTreeBuilder(nil).VerifyAgainstAny(rootsHex, leaf, proof)
+}
+
+// VerifyAgainstAny checks a balance's proof against several candidate roots built with this builder's hasher and reports which one it verifies against.
+//
+// During a root rotation a client may hold a proof for either the old or the new root. The leaf is hashed and folded with the proof once, and the result is compared with each root in turn in constant time. Roots that are not valid hex-encoded hashes never match.
+//
+// Parameters:
+//   - rootsHex: the candidate roots, hex encoded
+//   - leaf: the balance being proven
+//   - proof: the proof steps ordered from the leaf up to the root
+//
+// Returns:
+//   the index of the first root the proof verifies against and true, or -1 and false if it verifies against none or the balance cannot be hashed
+func (b *TreeBuilder) VerifyAgainstAny(rootsHex []string, leaf Balance, proof []ProofStep) (int, bool) {
+	leafHash, err := b.hashBalance(accountBalance{balance: leaf})
+	if err != nil {
+		return -1, false
+	}
+	computed := b.proofRoot(leafHash, proof)
+	for i, rootHex := range rootsHex {
+		root, err := decodeHexHash(rootHex)
+		if err != nil {
+			continue
+		}
+		if equalHashes(computed, root) {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+const (
+	multiProofHash byte = 0x00
+	multiProofLeaf byte = 0x01
+	multiProofNode byte = 0x02
+)
+
+type MultiProof struct {
+	Leaves [][32]byte
+	Hashes [][32]byte
+	Flags  []byte
+}
+
+// GenerateMultiProof builds a single inclusion proof covering several leaves at once.
+//
+// It walks the tree in pre-order and records one flag per visited node: subtrees that contain no requested leaf are cut off and contribute only their hash, requested leaves are listed in tree order, and every other node is rebuilt by the verifier from its children. Sibling hashes shared between the requested leaves' paths are therefore included only once, and hashes the verifier can compute are never included. Since a pruned subtree is represented by its own root, the siblings are a mix of leaf-level and subtree-level hashes: a contiguous run of leaves filling an aligned subtree of a 16-leaf tree needs only the hashes of the two subtrees beside its path, where separate proofs would repeat four hashes each.
+//
+// Parameters:
+//   - root: the root of the Merkle tree
+//   - leafHashes: the hashes of the leaves to prove, in any order
+//
+// Returns:
+//   the multiproof, or ErrEmptyTree if root is nil, or an error wrapping ErrLeafNotFound that names the first leaf not in the tree
+func GenerateMultiProof(root *MerkleNode, leafHashes [][32]byte) (MultiProof, error) {
+	if root == nil {
+		return MultiProof{}, ErrEmptyTree
+	}
+	targets := make(map[[32]byte]bool, len(leafHashes))
+	for _, leafHash := range leafHashes {
+		targets[leafHash] = true
+	}
+
+	found := make(map[[32]byte]bool, len(leafHashes))
+	var proof MultiProof
+	appendMultiProof(root, targets, found, &proof)
+
+	for _, leafHash := range leafHashes {
+		if !found[leafHash] {
+			return MultiProof{}, fmt.Errorf("%w: %x", ErrLeafNotFound, leafHash)
+		}
+	}
+	return proof, nil
+}
+
+// appendMultiProof records a subtree into a multiproof.
+//
+// It reports whether the subtree holds any requested leaf, so the caller can replace a subtree without one by its hash. A node with a single child cannot be rebuilt by the verifier, so like findProofPath it is recorded as a plain hash and the leaves beneath it are not found.
+//
+// Parameters:
+//   - node: the subtree to record
+//   - targets: the set of requested leaf hashes
+//   - found: the set of requested leaves seen so far, updated in place
+//   - proof: the multiproof being built
+//
+// Returns:
+//   true if the subtree contains a requested leaf, false otherwise
+func appendMultiProof(node *MerkleNode, targets, found map[[32]byte]bool, proof *MultiProof) bool {
+	if node.Left == nil && node.Right == nil {
+		if !targets[node.Hash] {
+			proof.Flags = append(proof.Flags, multiProofHash)
+			proof.Hashes = append(proof.Hashes, node.Hash)
+			return false
+		}
+		found[node.Hash] = true
+		proof.Flags = append(proof.Flags, multiProofLeaf)
+		proof.Leaves = append(proof.Leaves, node.Hash)
+		return true
+	}
+	if node.Left == nil || node.Right == nil {
+		proof.Flags = append(proof.Flags, multiProofHash)
+		proof.Hashes = append(proof.Hashes, node.Hash)
+		return false
+	}
+
+	flagAt, hashesAt, leavesAt := len(proof.Flags), len(proof.Hashes), len(proof.Leaves)
+	proof.Flags = append(proof.Flags, multiProofNode)
+	left := appendMultiProof(node.Left, targets, found, proof)
+	right := appendMultiProof(node.Right, targets, found, proof)
+	if left || right {
+		return true
+	}
+
+	proof.Flags = append(proof.Flags[:flagAt], multiProofHash)
+	proof.Hashes = append(proof.Hashes[:hashesAt], node.Hash)
+	proof.Leaves = proof.Leaves[:leavesAt]
+	return false
+}
+
+// VerifyMultiProof checks that every leaf in a multiproof is included under an expected Merkle root built with SHA-256.
+//
+// It verifies the proof with the default SHA-256 tree builder.
+//
+// Parameters:
+//   - proof: the multiproof to check
+//   - expectedRoot: the published root hash
+//
+// Returns:
+//   true if the proof reconstructs the expected root, false otherwise
+func VerifyMultiProof(proof MultiProof, expectedRoot [32]byte) bool {
+	return NewTreeBuilder(nil).VerifyMultiProof(proof, expectedRoot)
+}
+
+// VerifyMultiProof checks that every leaf in a multiproof is included under an expected Merkle root built with this builder's hasher.
+//
+// It replays the proof's flags to rebuild the root from the proven leaves and the supplied hashes, and rejects proofs that are malformed or leave flags, hashes or leaves unused. Callers should check that the leaves they care about appear in proof.Leaves.
+//
+// Parameters:
+//   - proof: the multiproof to check
+//   - expectedRoot: the published root hash
+//
+// Returns:
+//   true if the proof reconstructs the expected root, false otherwise
+func (b *TreeBuilder) VerifyMultiProof(proof MultiProof, expectedRoot [32]byte) bool {
+	var flagAt, hashAt, leafAt int
+
+	var rebuild func() ([32]byte, bool)
+	rebuild = func() ([32]byte, bool) {
+		if flagAt >= len(proof.Flags) {
+			return [32]byte{}, false
+		}
+		flag := proof.Flags[flagAt]
+		flagAt++
+
+		switch flag {
+		case multiProofHash:
+			if hashAt >= len(proof.Hashes) {
+				return [32]byte{}, false
+			}
+			hashAt++
+			return proof.Hashes[hashAt-1], true
+		case multiProofLeaf:
+			if leafAt >= len(proof.Leaves) {
+				return [32]byte{}, false
+			}
+			leafAt++
+			return proof.Leaves[leafAt-1], true
+		case multiProofNode:
+			left, ok := rebuild()
+			if !ok {
+				return [32]byte{}, false
+			}
+			right, ok := rebuild()
+			if !ok {
+				return [32]byte{}, false
+			}
+			return hashChildren(b.h(), left, right), true
+		default:
+			return [32]byte{}, false
+		}
+	}
+
+	root, ok := rebuild()
+	if !ok || flagAt != len(proof.Flags) || hashAt != len(proof.Hashes) || leafAt != len(proof.Leaves) {
+		return false
+	}
+	return equalHashes(root, expectedRoot)
+}
+
+// TopHolders returns the n accounts holding the largest balance of a given asset.
+//
+// It sums each account's balances for the asset and returns the holders sorted in descending order, breaking ties by identifier.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to rank
+//   - asset: the asset symbol to rank holders by
+//   - n: the maximum number of holders to return
+//
+// Returns:
+//   a slice of at most n Account structs holding the asset, largest holder first, or an error wrapping ErrInvalidSign if a balance of the asset has an unknown sign
+func TopHolders(accounts []Account, asset string, n int) ([]Account, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	type holder struct {
+		account Account
+		amount  float64
+	}
+
+	var holders []holder
+	for _, account := range accounts {
+		held := false
+		amount := 0.0
+		for _, balance := range account.Balances {
+			if balance.Asset == asset {
+				signed, err := balance.SignedAmount()
+				if err != nil {
+					return nil, fmt.Errorf("account %s: %w", account.Identifier, err)
+				}
+				held = true
+				amount += signed
+			}
+		}
+		if held {
+			holders = append(holders, holder{account: account, amount: amount})
+		}
+	}
+
+	sort.Slice(holders, func(i, j int) bool {
+		if holders[i].amount != holders[j].amount {
+			return holders[i].amount > holders[j].amount
+		}
+		return holders[i].account.Identifier < holders[j].account.Identifier
+	})
+
+	if n > len(holders) {
+		n = len(holders)
+	}
+	top := make([]Account, n)
+	for i := range top {
+		top[i] = holders[i].account
+	}
+
+	return top, nil
+}
+
+// ChangedIdentifiers compares two account slices and reports which identifiers were added, removed or modified.
+//
+// It matches accounts by identifier and treats an account as modified when the canonical hash of its balances differs.
+//
+// Parameters:
+//   - oldAccounts: the previous slice of Account structs
+//   - newAccounts: the current slice of Account structs
+//
+// Returns:
+//   the sorted identifiers that were added, removed and modified between the two slices, or an error naming the first account whose balances cannot be encoded
+func ChangedIdentifiers(oldAccounts, newAccounts []Account) (added, removed, modified []string, err error) {
+	oldHashes := make(map[string][32]byte, len(oldAccounts))
+	for _, account := range oldAccounts {
+		if oldHashes[account.Identifier], err = canonicalBalancesHash(account.Balances); err != nil {
+			return nil, nil, nil, fmt.Errorf("account %s: %w", account.Identifier, err)
+		}
+	}
+
+	newHashes := make(map[string][32]byte, len(newAccounts))
+	for _, account := range newAccounts {
+		if newHashes[account.Identifier], err = canonicalBalancesHash(account.Balances); err != nil {
+			return nil, nil, nil, fmt.Errorf("account %s: %w", account.Identifier, err)
+		}
+	}
+
+	for identifier, newHash := range newHashes {
+		oldHash, ok := oldHashes[identifier]
+		if !ok {
+			added = append(added, identifier)
+		} else if oldHash != newHash {
+			modified = append(modified, identifier)
+		}
+	}
+	for identifier := range oldHashes {
+		if _, ok := newHashes[identifier]; !ok {
+			removed = append(removed, identifier)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(modified)
+
+	return added, removed, modified, nil
+}
+
+// canonicalBalancesHash computes an order-independent hash of a set of balances.
+//
+// It sorts a copy of the balances by asset and amount and encodes them as a canonical JSON array with appendCanonicalBalance, so the same holdings always hash identically.
+//
+// Parameters:
+//   - balances: a slice of Balance structs to hash
+//
+// Returns:
+//   the SHA-256 hash of the canonically ordered balances, or an error naming the asset if an amount is not a finite number
+func canonicalBalancesHash(balances []Balance) ([32]byte, error) {
+	buf := append(make([]byte, 0, 64*len(balances)+2), '[')
+	for i, balance := range sortedBalances(balances) {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		var err error
+		if buf, err = appendCanonicalBalance(buf, balance); err != nil {
+			return [32]byte{}, fmt.Errorf("asset %s: %w", balance.Asset, err)
+		}
+	}
+	return sha256.Sum256(append(buf, ']')), nil
+}
+
+// sortedAccounts returns a copy of the accounts ordered by identifier.
+//
+// It leaves the input slice untouched, so the per-account builders can fix their leaf order without reordering the caller's accounts.
+//
+// Parameters:
+//   - accounts: the accounts to order
+//
+// Returns:
+//   a new slice holding the accounts sorted by identifier
+func sortedAccounts(accounts []Account) []Account {
+	sorted := make([]Account, len(accounts))
+	copy(sorted, accounts)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Identifier < sorted[j].Identifier
+	})
+	return sorted
+}
+
+// sortedBalances returns a copy of the balances in canonical order.
+//
+// It sorts by asset, then amount, then sign, leaving the input slice untouched.
+//
+// Parameters:
+//   - balances: the balances to order
+//
+// Returns:
+//   a new slice holding the balances in canonical order
+func sortedBalances(balances []Balance) []Balance {
+	sorted := make([]Balance, len(balances))
+	copy(sorted, balances)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Asset != sorted[j].Asset {
+			return sorted[i].Asset < sorted[j].Asset
+		}
+		if sorted[i].Balance != sorted[j].Balance {
+			return sorted[i].Balance < sorted[j].Balance
+		}
+		return sorted[i].Sign < sorted[j].Sign
+	})
+	return sorted
+}
+
+// AccountsFingerprint computes a stable fingerprint of a set of accounts that does not depend on their order.
+//
+// It hashes each account's identifier with the canonical hash of its balances, sorted by identifier, so reordered but equal inputs share a fingerprint and can be used as a cache key to skip rebuilds.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to fingerprint
+//
+// Returns:
+//   the SHA-256 fingerprint of the normalized account data, or an error naming the first account whose balances cannot be encoded
+func AccountsFingerprint(accounts []Account) ([]byte, error) {
+	type entry struct {
+		identifier string
+		hash       [32]byte
+	}
+
+	entries := make([]entry, len(accounts))
+	for i, account := range accounts {
+		hash, err := canonicalBalancesHash(account.Balances)
+		if err != nil {
+			return nil, fmt.Errorf("account %s: %w", account.Identifier, err)
+		}
+		entries[i] = entry{identifier: account.Identifier, hash: hash}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].identifier != entries[j].identifier {
+			return entries[i].identifier < entries[j].identifier
+		}
+		return bytes.Compare(entries[i].hash[:], entries[j].hash[:]) < 0
+	})
+
+	h := sha256.New()
+	var length [4]byte
+	for _, e := range entries {
+		binary.BigEndian.PutUint32(length[:], uint32(len(e.identifier)))
+		h.Write(length[:])
+		h.Write([]byte(e.identifier))
+		h.Write(e.hash[:])
+	}
+
+	return h.Sum(nil), nil
+}
+
+// VerifyRootWithCount checks that a set of accounts reproduces a published SHA-256 root and leaf count.
+//
+// It hashes with SHA-256; see TreeBuilder.VerifyRootWithCount.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to rebuild the tree from
+//   - expectedRootHex: the published root hash, hex encoded
+//   - expectedCount: the published number of leaves
+//
+// Returns:
+//   true if both the leaf count and the root match, and an error wrapping ErrLeafCount if the count differs, or an error if the root is not a valid hash or the tree cannot be built
+func VerifyRootWithCount(accounts []Account, expectedRootHex string, expectedCount int) (bool, error) {
+	return NewTreeBuilder(nil).VerifyRootWithCount(accounts, expectedRootHex, expectedCount)
+}
+
+// VerifyRootWithCount checks that a set of accounts reproduces a published root and leaf count under the builder's options.
+//
+// It compares the number of leaves before building the tree, so an under-reported user base is reported as a count mismatch rather than an opaque root mismatch. The tree is rebuilt with Build, so the builder must be configured as the publisher's was.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to rebuild the tree from
+//   - expectedRootHex: the published root hash, hex encoded
+//   - expectedCount: the published number of leaves
+//
+// Returns:
+//   true if both the leaf count and the root match, and an error wrapping ErrLeafCount if the count differs, or an error if the root is not a valid hash or the tree cannot be built
+func (b *TreeBuilder) VerifyRootWithCount(accounts []Account, expectedRootHex string, expectedCount int) (bool, error) {
+	leafCount := 0
+	for _, account := range accounts {
+		leafCount += len(account.Balances)
+	}
+	if leafCount != expectedCount {
+		return false, fmt.Errorf("%w: expected %d, got %d", ErrLeafCount, expectedCount, leafCount)
+	}
+
+	expectedRoot, err := decodeHexHash(expectedRootHex)
+	if err != nil {
+		return false, err
+	}
+
+	root, err := b.Build(accounts)
+	if err != nil {
+		return false, err
+	}
+	return equalHashes(root.Hash, expectedRoot), nil
+}
+
+// VerifyLoadedTree checks a tree loaded from storage against its published SHA-256 root and leaf count.
+//
+// It validates with the default SHA-256 tree builder; see TreeBuilder.VerifyLoadedTree.
+//
+// Parameters:
+//   - root: the root of the loaded tree
+//   - expectedRootHex: the published root hash, hex encoded
+//   - expectedLeaves: the published number of leaves
+//
+// Returns:
+//   nil if the tree is consistent and matches both, or an error wrapping ErrInvalidTree, ErrRootMismatch or ErrLeafCount
+func VerifyLoadedTree(root *MerkleNode, expectedRootHex string, expectedLeaves int) error {
+	return NewTreeBuilder(nil).VerifyLoadedTree(root, expectedRootHex, expectedLeaves)
+}
+
+// VerifyLoadedTree checks a tree loaded from storage against its published root and leaf count under the builder's hasher.
+//
+// It runs the checks in order and stops at the first failure: Validate recomputes every internal hash, then the root hash is compared with expectedRootHex, then the leaves are counted. Each failure wraps its own sentinel error, so callers can tell a corrupted file from a tree of the wrong snapshot or a truncated one with errors.Is.
+//
+// Parameters:
+//   - root: the root of the loaded tree
+//   - expectedRootHex: the published root hash, hex encoded
+//   - expectedLeaves: the published number of leaves
+//
+// Returns:
+//   nil if the tree is consistent and matches both, an error wrapping ErrEmptyTree if root is nil, ErrInvalidTree if a node's hash does not match its children, ErrRootMismatch if the root differs, ErrLeafCount if the leaf count differs, or a decoding error if expectedRootHex is not a valid hash
+func (b *TreeBuilder) VerifyLoadedTree(root *MerkleNode, expectedRootHex string, expectedLeaves int) error {
+	if root == nil {
+		return ErrEmptyTree
+	}
+	expectedRoot, err := decodeHexHash(expectedRootHex)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Validate(root); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidTree, err)
+	}
+	if !equalHashes(root.Hash, expectedRoot) {
+		return fmt.Errorf("%w: expected %x, got %x", ErrRootMismatch, expectedRoot, root.Hash)
+	}
+	if leaves := root.LeafCount(); leaves != expectedLeaves {
+		return fmt.Errorf("%w: expected %d, got %d", ErrLeafCount, expectedLeaves, leaves)
+	}
+	return nil
+}
+
+// CommitRoot computes a commitment to a Merkle root and a secret nonce for commit-reveal publication.
+//
+// It hashes the root followed by the nonce, so the commitment can be published before the root and nonce are revealed.
+//
+// Parameters:
+//   - root: the Merkle root hash being committed to
+//   - nonce: the secret nonce revealed later alongside the root
+//
+// Returns:
+//   the SHA-256 hash of root || nonce
+func CommitRoot(root []byte, nonce []byte) []byte {
+	data := make([]byte, 0, len(root)+len(nonce))
+	data = append(data, root...)
+	data = append(data, nonce...)
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// VerifyRootCommitment checks that a revealed root and nonce match a previously published commitment.
+//
+// It recomputes the commitment from the revealed values and compares it in constant time.
+//
+// Parameters:
+//   - commitment: the published commitment
+//   - root: the revealed Merkle root hash
+//   - nonce: the revealed nonce
+//
+// Returns:
+//   true if the revealed root and nonce reproduce the commitment, false otherwise
+func VerifyRootCommitment(commitment, root, nonce []byte) bool {
+	return subtle.ConstantTimeCompare(commitment, CommitRoot(root, nonce)) == 1
+}
+
+// DistinctAssets lists the unique asset symbols held across a set of accounts.
+//
+// It collects every asset found in the accounts' balances and returns them in sorted order.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to scan for assets
+//
+// Returns:
+//   a sorted slice of unique asset symbols
+func DistinctAssets(accounts []Account) []string {
+	seen := make(map[string]struct{})
+	for _, account := range accounts {
+		for _, balance := range account.Balances {
+			seen[balance.Asset] = struct{}{}
+		}
+	}
+
+	assets := make([]string, 0, len(seen))
+	for asset := range seen {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+
+	return assets
+}
+
+// LoadAccountsJSONL reads accounts from newline-delimited JSON.
+//
+// It decodes each non-blank line as a single Account and reports decoding failures with the offending line number.
+//
+// Parameters:
+//   - r: the reader providing one JSON-encoded account per line
+//
+// Returns:
+//   a slice of the decoded Account structs, or an error identifying the first line that could not be read or decoded
+func LoadAccountsJSONL(r io.Reader) ([]Account, error) {
+	var accounts []Account
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var account Account
+		if err := json.Unmarshal(line, &account); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		accounts = append(accounts, account)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", lineNumber+1, err)
+	}
+
+	return accounts, nil
+}
+
+// BuildTreeFromReader computes the Merkle root of newline-delimited JSON accounts without holding them all in memory.
+//
+// It decodes one account at a time and appends its balances to an IncrementalTree, so memory stays proportional to the largest account plus O(log n) hashes. The root matches createMerkleTreeForAccounts over the same records only if they arrive in canonical order, so accounts must be sorted by identifier with no duplicates; balances within an account may be in any order. Only the root is kept, so the returned node has no children and cannot be used to generate proofs.
+//
+// Parameters:
+//   - r: the reader providing one JSON-encoded account per line, sorted by identifier
+//
+// Returns:
+//   a childless MerkleNode holding the root hash, or an error identifying the first line that could not be read, decoded or appended, or that is out of order
+func BuildTreeFromReader(r io.Reader) (*MerkleNode, error) {
+	return BuildTreeFromReaderCtx(context.Background(), r)
+}
+
+// BuildTreeFromReaderCtx computes the Merkle root of newline-delimited JSON accounts like BuildTreeFromReader, stopping early if the context is cancelled.
+//
+// The context is checked before each line is processed, so a build over a slow reader returns as soon as the line being read when it is cancelled arrives.
+//
+// Parameters:
+//   - ctx: the context that cancels the build
+//   - r: the reader providing one JSON-encoded account per line, sorted by identifier
+//
+// Returns:
+//   a childless MerkleNode holding the root hash, or ctx.Err() if the context is cancelled, or an error identifying the first line that could not be read, decoded or appended, or that is out of order
+func BuildTreeFromReaderCtx(ctx context.Context, r io.Reader) (*MerkleNode, error) {
+	tree := NewIncrementalTree(nil)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	lineNumber := 0
+	previous := ""
+	seen := false
+	signs := make(map[string]Sign)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		lineNumber++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var account Account
+		if err := json.Unmarshal(line, &account); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if seen && account.Identifier <= previous {
+			return nil, fmt.Errorf("line %d: account %s is not sorted after %s", lineNumber, account.Identifier, previous)
+		}
+		previous, seen = account.Identifier, true
+
+		balances := account.Balances
+		if err := checkSigns(account.Identifier, len(balances), func(i int) (string, Sign) { return balances[i].Asset, balances[i].Sign }, signs); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		for _, balance := range sortedBalances(account.Balances) {
+			if err := tree.Append(balance); err != nil {
+				return nil, fmt.Errorf("line %d: account %s: %w", lineNumber, account.Identifier, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", lineNumber+1, err)
+	}
+
+	return &MerkleNode{Hash: tree.Root()}, nil
+}
+
+const sumByAssetChunkSize = 4096
+
+// SumByAsset computes the total balance held of each asset across a set of accounts.
+//
+// It nets debits against credits, sums fixed-size chunks of accounts and merges the partial totals in chunk order, so its results match SumByAssetConcurrent exactly. Signs are checked with ValidateSigns, as the builders do.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to total
+//
+// Returns:
+//   a map from asset symbol to the summed balance of that asset, or an error wrapping ErrInvalidSign naming the first account with an unknown or mixed sign
+func SumByAsset(accounts []Account) (map[string]float64, error) {
+	totals := make(map[string]float64)
+	for start := 0; start < len(accounts); start += sumByAssetChunkSize {
+		end := start + sumByAssetChunkSize
+		if end > len(accounts) {
+			end = len(accounts)
+		}
+		partial, err := sumAssetChunk(accounts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		mergeAssetTotals(totals, partial)
+	}
+
+	return totals, nil
+}
+
+// SumByAsset computes the total balance of each asset across a set of accounts, weighting each balance if the builder's ApplyWeights is set.
+//
+// The totals then match those BuildWithTotals commits to for the same builder. Without ApplyWeights it is the package-level SumByAsset.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to total
+//
+// Returns:
+//   a map from asset symbol to the summed, possibly weighted, balance of that asset, or an error if a sign or weight is invalid
+func (b *TreeBuilder) SumByAsset(accounts []Account) (map[string]float64, error) {
+	if !b.ApplyWeights {
+		return SumByAsset(accounts)
+	}
+
+	weighted := make([]Account, len(accounts))
+	for i, account := range accounts {
+		balances := make([]Balance, len(account.Balances))
+		for j, balance := range account.Balances {
+			var err error
+			if balances[j], err = leafBalance(balance, true); err != nil {
+				return nil, fmt.Errorf("account %s: %w", account.Identifier, err)
+			}
+		}
+		weighted[i] = Account{Identifier: account.Identifier, Balances: balances}
+	}
+	return SumByAsset(weighted)
+}
+
+// SumByAssetConcurrent computes the total balance of each asset across a set of accounts using multiple workers.
+//
+// It partitions the accounts into the same fixed-size chunks as SumByAsset, has each worker total its chunks into local maps, and merges them in chunk order so float summation order is reproducible.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to total
+//   - workers: the number of goroutines to use, or runtime.NumCPU() if not positive
+//
+// Returns:
+//   a map from asset symbol to the summed balance of that asset, identical to SumByAsset over the same accounts, or the error SumByAsset would return
+func SumByAssetConcurrent(accounts []Account, workers int) (map[string]float64, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	numChunks := (len(accounts) + sumByAssetChunkSize - 1) / sumByAssetChunkSize
+	partials := make([]map[string]float64, numChunks)
+	errs := make([]error, numChunks)
+	chunks := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				start := chunk * sumByAssetChunkSize
+				end := start + sumByAssetChunkSize
+				if end > len(accounts) {
+					end = len(accounts)
+				}
+				partials[chunk], errs[chunk] = sumAssetChunk(accounts[start:end])
+			}
+		}()
+	}
+
+	for chunk := 0; chunk < numChunks; chunk++ {
+		chunks <- chunk
+	}
+	close(chunks)
+	wg.Wait()
+
+	totals := make(map[string]float64)
+	for chunk, partial := range partials {
+		if errs[chunk] != nil {
+			return nil, errs[chunk]
+		}
+		mergeAssetTotals(totals, partial)
+	}
+
+	return totals, nil
+}
+
+// sumAssetChunk totals the balances of each asset within a single chunk of accounts.
+//
+// It validates the chunk's signs, then walks the accounts and their balances in order, accumulating a per-asset sum with debits subtracted.
+//
+// Parameters:
+//   - accounts: the chunk of Account structs to total
+//
+// Returns:
+//   a map from asset symbol to the summed balance within the chunk, or an error wrapping ErrInvalidSign
+func sumAssetChunk(accounts []Account) (map[string]float64, error) {
+	if err := ValidateSigns(accounts); err != nil {
+		return nil, err
+	}
+	totals := make(map[string]float64)
+	for _, account := range accounts {
+		for _, balance := range account.Balances {
+			amount, err := balance.SignedAmount()
+			if err != nil {
+				return nil, fmt.Errorf("account %s: %w", account.Identifier, err)
+			}
+			totals[balance.Asset] += amount
+		}
+	}
+
+	return totals, nil
+}
+
+// mergeAssetTotals adds a set of partial per-asset totals into an accumulator.
 //
-// It takes a slice of Account structs and returns a pointer to the root MerkleNode of the constructed tree.
+// It visits the partial totals in sorted asset order so merging is deterministic.
 //
 // Parameters:
-//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree
+//   - totals: the accumulator map to add into
+//   - partial: the partial per-asset totals to merge
+//
+// Returns:
+//   None
+func mergeAssetTotals(totals, partial map[string]float64) {
+	assets := make([]string, 0, len(partial))
+	for asset := range partial {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+
+	for _, asset := range assets {
+		totals[asset] += partial[asset]
+	}
+}
+
+// SignedAmount returns the balance amount with its liability sign applied.
+//
+// It negates the amount of debit balances and leaves credit balances unchanged. Any other sign is an error rather than a credit, since the leaf hash commits to the sign as written.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   the signed balance amount, or an error wrapping ErrInvalidSign if the sign is neither Credit nor Debit
+func (b Balance) SignedAmount() (float64, error) {
+	switch b.Sign {
+	case Credit:
+		return b.Balance, nil
+	case Debit:
+		return -b.Balance, nil
+	default:
+		return 0, fmt.Errorf("asset %s: %w %q", b.Asset, ErrInvalidSign, b.Sign)
+	}
+}
+
+// ValidateSigns checks that every balance carries an unambiguous liability sign.
+//
+// It rejects unknown sign values and accounts that hold both a credit and a debit of the same asset, since those should be netted before committing. Every builder and SumByAsset run it before using the balances.
+//
+// Parameters:
+//   - accounts: a slice of Account structs to validate
 //
 // Returns:
-//   a pointer to the root MerkleNode representing the Merkle tree built from the account balances
-func createMerkleTreeForAccounts(accounts []Account) *MerkleNode {
-	var allBalances []Balance
+//   an error wrapping ErrInvalidSign that names the first offending account and asset, or nil if all signs are valid
+func ValidateSigns(accounts []Account) error {
+	seen := make(map[string]Sign)
 	for _, account := range accounts {
-		allBalances = append(allBalances, account.Balances...)
+		balances := account.Balances
+		if err := checkSigns(account.Identifier, len(balances), func(i int) (string, Sign) { return balances[i].Asset, balances[i].Sign }, seen); err != nil {
+			return err
+		}
 	}
 
-	leaves := make([]*MerkleNode, len(allBalances))
-	for i, balance := range allBalances {
-		data, _ := json.Marshal(balance)
-		hash := sha256.Sum256(data)
-		leaves[i] = &MerkleNode{Hash: hash[:]}
+	return nil
+}
+
+// checkSigns checks the signs of one account's balances.
+//
+// It is shared by ValidateSigns and BuildFixed, whose balance types differ, and reuses the caller's map so validating many accounts does not allocate one per account.
+//
+// Parameters:
+//   - identifier: the identifier of the account
+//   - count: the number of balances the account holds
+//   - balance: returns the asset and sign of the balance at an index
+//   - seen: scratch space for the signs seen per asset, cleared before use
+//
+// Returns:
+//   an error wrapping ErrInvalidSign if a sign is unknown or an asset is held with both signs, or nil otherwise
+func checkSigns(identifier string, count int, balance func(int) (string, Sign), seen map[string]Sign) error {
+	clear(seen)
+	for i := 0; i < count; i++ {
+		asset, sign := balance(i)
+		if !validSign(sign) {
+			return fmt.Errorf("account %s asset %s: %w %q", identifier, asset, ErrInvalidSign, sign)
+		}
+		if previous, ok := seen[asset]; ok && previous != sign {
+			return fmt.Errorf("account %s asset %s: %w: mixes credit and debit balances", identifier, asset, ErrInvalidSign)
+		}
+		seen[asset] = sign
 	}
 
-	return buildTree(leaves)
+	return nil
 }
 
-// buildTree constructs a Merkle tree from a slice of MerkleNode pointers.
+type ProofStepJSON struct {
+	Hash   string `json:"hash"`
+	IsLeft bool   `json:"isLeft"`
+}
+
+type BalanceProof struct {
+	Asset    string          `json:"asset"`
+	LeafHash string          `json:"leafHash"`
+	Proof    []ProofStepJSON `json:"proof"`
+}
+
+type UserProof struct {
+	Identifier string         `json:"identifier"`
+	Root       string         `json:"root"`
+	Balances   []BalanceProof `json:"balances"`
+}
+
+// BuildUserProof collects the inclusion proof of every balance an account holds in a tree built by createMerkleTreeForAccounts.
 //
-// It takes a slice of MerkleNode pointers and recursively builds a Merkle tree by combining the hashes of the nodes.
+// It hashes each of the account's balances into its leaf, generates the proof for it and hex-encodes every hash, so the result can be marshalled to JSON and handed to the user. Each decoded leaf hash and path verifies against the root with VerifyProof.
 //
 // Parameters:
-//   - nodes: a slice of pointers to MerkleNode, representing the leaf nodes of the tree.
+//   - root: the root of the tree the account was committed to
+//   - account: the account whose proofs are collected
 //
 // Returns:
-//   a pointer to the root MerkleNode of the constructed Merkle tree, or nil if the input slice is empty.
-func buildTree(nodes []*MerkleNode) *MerkleNode {
-	if len(nodes) == 0 {
-		return nil
+//   the account's proofs, or an error if a balance cannot be hashed or is not in the tree
+func BuildUserProof(root *MerkleNode, account Account) (UserProof, error) {
+	return BuildUserProofCtx(context.Background(), root, account)
+}
+
+// BuildUserProofCtx collects the inclusion proof of every balance an account holds like BuildUserProof, stopping early if the context is cancelled.
+//
+// The context is checked before each balance is proved, so a request that has timed out stops generating proofs for an account with many balances.
+//
+// Parameters:
+//   - ctx: the context that bounds the work
+//   - root: the root of the tree the account was committed to
+//   - account: the account whose proofs are collected
+//
+// Returns:
+//   the account's proofs, or ctx.Err() if the context is cancelled, or an error if a balance cannot be hashed or is not in the tree
+func BuildUserProofCtx(ctx context.Context, root *MerkleNode, account Account) (UserProof, error) {
+	b := NewTreeBuilder(nil)
+	userProof := UserProof{Identifier: account.Identifier, Root: root.RootHex()}
+
+	for _, balance := range sortedBalances(account.Balances) {
+		if err := ctx.Err(); err != nil {
+			return UserProof{}, err
+		}
+		balanceProof, err := b.balanceProof(root, account.Identifier, balance)
+		if err != nil {
+			return UserProof{}, err
+		}
+		userProof.Balances = append(userProof.Balances, balanceProof)
 	}
-	if len(nodes) == 1 {
-		return nodes[0]
+
+	return userProof, nil
+}
+
+// ProofForAsset builds the inclusion proof of one of an account's balances in a tree built by createMerkleTreeForAccounts.
+//
+// It produces the same BalanceProof that BuildUserProof lists for the asset, without hashing and proving the account's other balances. If the account holds several balances in the asset, the first in canonical order is proved.
+//
+// Parameters:
+//   - root: the root of the tree the account was committed to
+//   - account: the account holding the balance
+//   - asset: the asset of the balance to prove
+//
+// Returns:
+//   the balance's proof, or an error wrapping ErrLeafNotFound if the account holds no balance in asset or the balance is not in the tree, or an error if the balance cannot be hashed
+func ProofForAsset(root *MerkleNode, account Account, asset string) (BalanceProof, error) {
+	for _, balance := range sortedBalances(account.Balances) {
+		if balance.Asset == asset {
+			return NewTreeBuilder(nil).balanceProof(root, account.Identifier, balance)
+		}
 	}
+	return BalanceProof{}, fmt.Errorf("account %s asset %s: %w", account.Identifier, asset, ErrLeafNotFound)
+}
 
-	var nextLevel []*MerkleNode
+// balanceProof hashes one balance into its leaf and hex-encodes the leaf and its inclusion proof.
+//
+// Parameters:
+//   - root: the root of the tree the balance was committed to
+//   - identifier: the identifier of the account holding the balance
+//   - balance: the balance to prove
+//
+// Returns:
+//   the balance's proof, or an error if the balance cannot be hashed or is not in the tree
+func (b *TreeBuilder) balanceProof(root *MerkleNode, identifier string, balance Balance) (BalanceProof, error) {
+	leaf, err := b.hashBalanceLeaf(accountBalance{identifier: identifier, balance: balance})
+	if err != nil {
+		return BalanceProof{}, err
+	}
+	proof, err := b.GenerateProof(root, leaf.Hash)
+	if err != nil {
+		return BalanceProof{}, fmt.Errorf("account %s asset %s: %w", identifier, balance.Asset, err)
+	}
 
-	for i := 0; i < len(nodes); i += 2 {
-		left := nodes[i]
-		var right *MerkleNode
-		if i+1 < len(nodes) {
-			right = nodes[i+1]
-		} else {
-			right = &MerkleNode{Hash: left.Hash}
+	steps := make([]ProofStepJSON, len(proof))
+	for i, step := range proof {
+		steps[i] = ProofStepJSON{Hash: hex.EncodeToString(step.Hash[:]), IsLeft: step.IsLeft}
+	}
+	return BalanceProof{
+		Asset:    balance.Asset,
+		LeafHash: hex.EncodeToString(leaf.Hash[:]),
+		Proof:    steps,
+	}, nil
+}
+
+// printUserProof prints the inclusion proofs for one account as indented JSON.
+//
+// It looks the account up by identifier and exits with a non-zero status if it is not found or its proofs cannot be built.
+//
+// Parameters:
+//   - root: the root of the tree built from accounts
+//   - accounts: the accounts the tree was built from
+//   - identifier: the identifier of the account to prove
+//
+// Returns:
+//   None
+func printUserProof(root *MerkleNode, accounts []Account, identifier string) {
+	for _, account := range accounts {
+		if account.Identifier != identifier {
+			continue
+		}
+
+		userProof, err := BuildUserProof(root, account)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to build proof for %s: %v\n", identifier, err)
+			os.Exit(1)
 		}
 
-		combined := append(left.Hash, right.Hash...)
-		hash := sha256.Sum256(combined)
-		parent := &MerkleNode{
-			Hash:  hash[:],
-			Left:  left,
-			Right: right,
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(userProof); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to encode proof: %v\n", err)
+			os.Exit(1)
 		}
-		nextLevel = append(nextLevel, parent)
+		return
 	}
 
-	return buildTree(nextLevel)
+	fmt.Fprintf(os.Stderr, "Account %s not found\n", identifier)
+	os.Exit(1)
 }
 
-// createMerkleTreeForAccountsConcurrent creates a Merkle tree from a slice of accounts concurrently.
+// VerifyUserProof checks every balance proof in a UserProof against a root obtained independently of it.
 //
-// It takes a slice of Account structs and returns a pointer to the root MerkleNode of the constructed tree.
+// The root recorded in the UserProof itself is not trusted; it only has to agree with the one given.
 //
 // Parameters:
-//   - accounts: a slice of Account structs containing balances to be included in the Merkle tree.
+//   - userProof: the proofs to check, as produced by BuildUserProof
+//   - root: the published root to check them against
+//
+// Returns:
+//   nil if every balance verifies, an error wrapping ErrRootMismatch if the proof was issued for another root or a balance does not verify, or an error if a hash is malformed
+func VerifyUserProof(userProof UserProof, root [32]byte) error {
+	if userProof.Root != hex.EncodeToString(root[:]) {
+		return fmt.Errorf("%w: proof is for root %s, expected %x", ErrRootMismatch, userProof.Root, root)
+	}
+	for _, balance := range userProof.Balances {
+		leaf, err := decodeHexHash(balance.LeafHash)
+		if err != nil {
+			return fmt.Errorf("asset %s: %w", balance.Asset, err)
+		}
+		proof := make([]ProofStep, len(balance.Proof))
+		for i, step := range balance.Proof {
+			if proof[i].Hash, err = decodeHexHash(step.Hash); err != nil {
+				return fmt.Errorf("asset %s step %d: %w", balance.Asset, i, err)
+			}
+			proof[i].IsLeft = step.IsLeft
+		}
+		if !VerifyProof(leaf, proof, root) {
+			return fmt.Errorf("asset %s: %w", balance.Asset, ErrRootMismatch)
+		}
+	}
+	return nil
+}
+
+// resolveRoot picks the root to verify against from the -root flag or, when the flag is empty, the first line of stdin.
+//
+// Reading stdin lets a published root be piped in, as in echo <root> | test -verify -proof proof.json.
+//
+// Parameters:
+//   - flagValue: the value of the -root flag
+//   - stdin: the reader to fall back to
+//
+// Returns:
+//   the decoded root, or an error if stdin cannot be read or the root is not a hex-encoded 32-byte hash
+func resolveRoot(flagValue string, stdin io.Reader) ([32]byte, error) {
+	if flagValue != "" {
+		return decodeHexHash(flagValue)
+	}
+
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return [32]byte{}, fmt.Errorf("reading root from stdin: %w", err)
+	}
+	return decodeHexHash(strings.TrimSpace(line))
+}
+
+// verifyProofFile reads a proof file written by -proof and checks it against the root from the -root flag or stdin.
+//
+// Parameters:
+//   - path: the path of the UserProof JSON file
+//   - rootFlag: the value of the -root flag
+//   - stdin: the reader to take the root from when rootFlag is empty
+//
+// Returns:
+//   the verified proofs, or an error if the file or root cannot be read or a balance does not verify
+func verifyProofFile(path, rootFlag string, stdin io.Reader) (UserProof, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return UserProof{}, err
+	}
+	var userProof UserProof
+	if err := json.Unmarshal(data, &userProof); err != nil {
+		return UserProof{}, fmt.Errorf("%s: %w", path, err)
+	}
+	root, err := resolveRoot(rootFlag, stdin)
+	if err != nil {
+		return UserProof{}, err
+	}
+	if err := VerifyUserProof(userProof, root); err != nil {
+		return UserProof{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return userProof, nil
+}
+
+type proofPage struct {
+	Asset    string
+	Balance  string
+	Sign     Sign
+	LeafData string
+	LeafHash string
+	Root     string
+	Proof    []ProofStepJSON
+}
+
+var proofPageTemplate = template.Must(template.New("proof").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Proof of reserves: {{.Asset}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+code { word-break: break-all; }
+#result { padding: 0.5em; font-weight: bold; }
+#result.ok { background: #c8f7c5; color: #1b5e20; }
+#result.fail { background: #f7c5c5; color: #b71c1c; }
+</style>
+</head>
+<body>
+<h1>Balance inclusion proof</h1>
+<table>
+<tr><th>Asset</th><td>{{.Asset}}</td></tr>
+<tr><th>Balance</th><td>{{.Balance}}{{if .Sign}} ({{.Sign}}){{end}}</td></tr>
+<tr><th>Leaf data</th><td><code>{{.LeafData}}</code></td></tr>
+<tr><th>Leaf hash</th><td><code>{{.LeafHash}}</code></td></tr>
+<tr><th>Root</th><td><code>{{.Root}}</code></td></tr>
+</table>
+<h2>Proof steps</h2>
+<ol>
+{{range .Proof}}<li>{{if .IsLeft}}left{{else}}right{{end}} sibling <code>{{.Hash}}</code></li>
+{{end}}</ol>
+<p id="result">Verifying&hellip;</p>
+<script>
+const leafData = {{.LeafData}};
+const proof = {{.Proof}};
+const expectedRoot = {{.Root}};
+
+function concat(...parts) {
+  const out = new Uint8Array(parts.reduce((n, p) => n + p.length, 0));
+  let offset = 0;
+  for (const p of parts) {
+    out.set(p, offset);
+    offset += p.length;
+  }
+  return out;
+}
+
+function fromHex(s) {
+  const out = new Uint8Array(s.length / 2);
+  for (let i = 0; i < out.length; i++) {
+    out[i] = parseInt(s.substr(i * 2, 2), 16);
+  }
+  return out;
+}
+
+function toHex(bytes) {
+  return Array.from(bytes, b => b.toString(16).padStart(2, "0")).join("");
+}
+
+async function sha256(bytes) {
+  return new Uint8Array(await crypto.subtle.digest("SHA-256", bytes));
+}
+
+async function verify() {
+  let current = await sha256(concat([0x00], new TextEncoder().encode(leafData)));
+  for (const step of proof) {
+    const sibling = fromHex(step.hash);
+    current = await sha256(step.isLeft ? concat([0x01], sibling, current) : concat([0x01], current, sibling));
+  }
+  return toHex(current) === expectedRoot;
+}
+
+const result = document.getElementById("result");
+verify().then(ok => {
+  result.className = ok ? "ok" : "fail";
+  result.textContent = ok ? "Verified: the balance is included under the root." : "Failed: the proof does not lead to the root.";
+}, err => {
+  result.className = "fail";
+  result.textContent = "Verification error: " + err;
+});
+</script>
+</body>
+</html>
+`))
+
+// RenderProofHTML writes a standalone HTML page that lets a user check one balance's inclusion proof in the browser.
+//
+// The page shows the balance, its canonical leaf data and the proof steps, and embeds a script that hashes the leaf data with SHA-256 under the leaf prefix, folds in each step under the internal prefix and shows a green or red result depending on whether it reaches rootHex. It therefore only verifies proofs from trees built with the default hasher.
+//
+// Parameters:
+//   - w: the writer to render the page to
+//   - leaf: the balance the proof is for
+//   - proof: the inclusion proof of the balance's leaf
+//   - rootHex: the hex-encoded root the proof should verify against
+//
+// Returns:
+//   an error if rootHex is not a valid hash, the balance cannot be encoded, or writing fails
+func RenderProofHTML(w io.Writer, leaf Balance, proof []ProofStep, rootHex string) error {
+	root, err := decodeHexHash(rootHex)
+	if err != nil {
+		return err
+	}
+	if !validSign(leaf.Sign) {
+		return fmt.Errorf("asset %s: %w %q", leaf.Asset, ErrInvalidSign, leaf.Sign)
+	}
+	data, err := appendCanonicalBalance(nil, leaf)
+	if err != nil {
+		return fmt.Errorf("encode balance for asset %s: %w", leaf.Asset, err)
+	}
+	leafHash := hashLeaf(SHA256Hasher{}, data)
+
+	page := proofPage{
+		Asset:    leaf.Asset,
+		Balance:  strconv.FormatFloat(leaf.Balance, 'f', -1, 64),
+		Sign:     leaf.Sign,
+		LeafData: string(data),
+		LeafHash: hex.EncodeToString(leafHash[:]),
+		Root:     hex.EncodeToString(root[:]),
+		Proof:    make([]ProofStepJSON, len(proof)),
+	}
+	for i, step := range proof {
+		page.Proof[i] = ProofStepJSON{Hash: hex.EncodeToString(step.Hash[:]), IsLeft: step.IsLeft}
+	}
+
+	return proofPageTemplate.Execute(w, page)
+}
+
+type ProofServer struct {
+	Timeout  time.Duration
+	mu       sync.RWMutex
+	root     *MerkleNode
+	accounts map[string]Account
+}
+
+// NewProofServer creates an HTTP handler that serves proofs once a tree is set.
+//
+// Until SetTree is called every request is answered with 503 Service Unavailable. Set Timeout before serving to bound how long a proof request may take.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   a pointer to an empty ProofServer
+func NewProofServer() *ProofServer {
+	return &ProofServer{}
+}
+
+// SetTree publishes a tree and the accounts it was built from.
+//
+// It may be called again after a rebuild; requests in flight finish against the tree they started with.
+//
+// Parameters:
+//   - root: the root of a tree built by createMerkleTreeForAccounts
+//   - accounts: the accounts the tree was built from
 //
 // Returns:
-//   a pointer to the root MerkleNode representing the constructed Merkle tree.
-func createMerkleTreeForAccountsConcurrent(accounts []Account) *MerkleNode {
-	var allBalances []Balance
+//   None
+func (s *ProofServer) SetTree(root *MerkleNode, accounts []Account) {
+	index := make(map[string]Account, len(accounts))
 	for _, account := range accounts {
-		allBalances = append(allBalances, account.Balances...)
+		index[account.Identifier] = account
 	}
 
-	leaves := make([]*MerkleNode, len(allBalances))
-	numWorkers := runtime.NumCPU()
-	chunkSize := (len(allBalances) + numWorkers - 1) / numWorkers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.root, s.accounts = root, index
+}
 
-	var wg sync.WaitGroup
-	wg.Add(numWorkers)
+// ServeHTTP answers GET /root with the root hash as hex and GET /proof?account=<id> with the account's UserProof as JSON.
+//
+// It responds 503 before a tree is set, 404 for unknown paths and accounts, 400 when the account parameter is missing and 405 for methods other than GET. Proofs are generated under the request's context, limited to Timeout if it is positive, and a request whose deadline passes is answered with 503 without proving the rest of the account's balances. Any other proof failure is answered with a fixed 500 message so internal errors are not exposed to clients.
+//
+// Parameters:
+//   - w: the response writer
+//   - r: the request
+//
+// Returns:
+//   None
+func (s *ProofServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/root" && r.URL.Path != "/proof" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	for i := 0; i < numWorkers; i++ {
-		start := i * chunkSize
-		end := (i + 1) * chunkSize
-		if end > len(allBalances) {
-			end = len(allBalances)
-		}
+	s.mu.RLock()
+	root, accounts := s.root, s.accounts
+	s.mu.RUnlock()
+	if root == nil {
+		http.Error(w, "tree not built yet", http.StatusServiceUnavailable)
+		return
+	}
 
-		go func(start, end int) {
-			defer wg.Done()
-			for j := start; j < end; j++ {
-				data, _ := json.Marshal(allBalances[j])
-				hash := sha256.Sum256(data)
-				leaves[j] = &MerkleNode{Hash: hash[:]}
-			}
-		}(start, end)
+	if r.URL.Path == "/root" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, root.RootHex())
+		return
 	}
 
-	wg.Wait()
+	identifier := r.URL.Query().Get("account")
+	if identifier == "" {
+		http.Error(w, "missing account parameter", http.StatusBadRequest)
+		return
+	}
+	account, ok := accounts[identifier]
+	if !ok {
+		http.Error(w, "account not found", http.StatusNotFound)
+		return
+	}
+	ctx := r.Context()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	userProof, err := BuildUserProofCtx(ctx, root, account)
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "proof generation timed out", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to build proof", http.StatusInternalServerError)
+		return
+	}
 
-	return buildTreeParallel(leaves)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(userProof)
 }
 
-// buildTreeParallel constructs a Merkle tree from a slice of Merkle nodes in parallel.
+type treeSnapshot struct {
+	timestamp time.Time
+	root      *MerkleNode
+	accounts  map[string]Account
+	totals    map[string]float64
+}
+
+type SnapshotSummary struct {
+	Timestamp time.Time          `json:"timestamp"`
+	Root      string             `json:"root"`
+	LeafCount int                `json:"leafCount"`
+	Totals    map[string]float64 `json:"totals"`
+}
+
+type SnapshotStore struct {
+	mu        sync.RWMutex
+	snapshots []treeSnapshot
+}
+
+// NewSnapshotStore creates an empty store of trees keyed by the time they were built.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   a pointer to an empty SnapshotStore
+func NewSnapshotStore() *SnapshotStore {
+	return &SnapshotStore{}
+}
+
+// Add records a tree and the accounts it was built from as the snapshot taken at ts.
 //
-// It takes a slice of MerkleNode pointers and returns the root MerkleNode of the constructed tree.
+// Snapshots may be added in any order; adding a second snapshot at the same time replaces the first. The per-asset totals reported by TimeSeries are computed here with SumByAsset.
 //
 // Parameters:
-//   - nodes: a slice of pointers to MerkleNode that represent the leaf nodes of the tree.
+//   - ts: the time the snapshot was taken
+//   - root: the root of a tree built by createMerkleTreeForAccounts
+//   - accounts: the accounts the tree was built from
 //
 // Returns:
-//   a pointer to the root MerkleNode of the constructed tree, or nil if no nodes are provided.
-func buildTreeParallel(nodes []*MerkleNode) *MerkleNode {
-	for len(nodes) > 1 {
-		nextLevel := make([]*MerkleNode, (len(nodes)+1)/2)
-		var wg sync.WaitGroup
-		wg.Add(len(nextLevel))
+//   an error if the accounts cannot be totalled, in which case the snapshot is not added
+func (s *SnapshotStore) Add(ts time.Time, root *MerkleNode, accounts []Account) error {
+	totals, err := SumByAsset(accounts)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]Account, len(accounts))
+	for _, account := range accounts {
+		index[account.Identifier] = account
+	}
+	snapshot := treeSnapshot{timestamp: ts, root: root, accounts: index, totals: totals}
 
-		for i := 0; i < len(nodes); i += 2 {
-			go func(i int) {
-				defer wg.Done()
-				left := nodes[i]
-				var right *MerkleNode
-				if i+1 < len(nodes) {
-					right = nodes[i+1]
-				} else {
-					right = &MerkleNode{Hash: left.Hash}
-				}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.Search(len(s.snapshots), func(i int) bool { return !s.snapshots[i].timestamp.Before(ts) })
+	if i < len(s.snapshots) && s.snapshots[i].timestamp.Equal(ts) {
+		s.snapshots[i] = snapshot
+		return nil
+	}
+	s.snapshots = append(s.snapshots, treeSnapshot{})
+	copy(s.snapshots[i+1:], s.snapshots[i:])
+	s.snapshots[i] = snapshot
+	return nil
+}
 
-				combined := append(left.Hash, right.Hash...)
-				hash := sha256.Sum256(combined)
-				nextLevel[i/2] = &MerkleNode{
-					Hash:  hash[:],
-					Left:  left,
-					Right: right,
-				}
-			}(i)
+// TimeSeries summarizes every stored snapshot, oldest first, for charting how the committed liabilities change over time.
+//
+// Each summary carries the snapshot's time, hex-encoded root, leaf count and per-asset totals. The totals maps are copies, so callers may modify them.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   one summary per snapshot, ordered by timestamp, or nil if the store is empty
+func (s *SnapshotStore) TimeSeries() []SnapshotSummary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var series []SnapshotSummary
+	for _, snapshot := range s.snapshots {
+		totals := make(map[string]float64, len(snapshot.totals))
+		for asset, total := range snapshot.totals {
+			totals[asset] = total
 		}
+		series = append(series, SnapshotSummary{
+			Timestamp: snapshot.timestamp,
+			Root:      snapshot.root.RootHex(),
+			LeafCount: snapshot.root.LeafCount(),
+			Totals:    totals,
+		})
+	}
+	return series
+}
 
-		wg.Wait()
-		nodes = nextLevel
+// ProofAt builds an account's inclusion proofs against the latest snapshot taken at or before ts.
+//
+// It delegates to BuildUserProof, so the result is the same as asking a ProofServer that was serving that snapshot.
+//
+// Parameters:
+//   - ts: the point in time to prove the account at
+//   - identifier: the identifier of the account to prove
+//
+// Returns:
+//   the account's proofs, or an error wrapping ErrNoSnapshot if no snapshot is that old, or ErrLeafNotFound if the account is not in the snapshot
+func (s *SnapshotStore) ProofAt(ts time.Time, identifier string) (UserProof, error) {
+	s.mu.RLock()
+	i := sort.Search(len(s.snapshots), func(i int) bool { return s.snapshots[i].timestamp.After(ts) })
+	var snapshot treeSnapshot
+	if i > 0 {
+		snapshot = s.snapshots[i-1]
 	}
+	s.mu.RUnlock()
 
-	if len(nodes) == 0 {
-		return nil
+	if snapshot.root == nil {
+		return UserProof{}, fmt.Errorf("%w %s", ErrNoSnapshot, ts.Format(time.RFC3339))
 	}
-	return nodes[0]
+	account, ok := snapshot.accounts[identifier]
+	if !ok {
+		return UserProof{}, fmt.Errorf("account %s at %s: %w", identifier, snapshot.timestamp.Format(time.RFC3339), ErrLeafNotFound)
+	}
+	return BuildUserProof(snapshot.root, account)
 }
 
 // generateRandomAccounts generates a specified number of random accounts
@@ -193,7 +5913,21 @@ func buildTreeParallel(nodes []*MerkleNode) *MerkleNode {
 // Returns:
 //   a slice of Account structs, each containing a unique identifier and random balances for predefined assets
 func generateRandomAccounts(count int) []Account {
-    r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return generateRandomAccountsSeed(count, time.Now().UnixNano())
+}
+
+// generateRandomAccountsSeed generates a specified number of random accounts from a fixed seed
+//
+// It produces byte-identical accounts, and therefore an identical root, for the same count and seed, so benchmark runs are comparable across commits and machines.
+//
+// Parameters:
+//   - count: the number of random accounts to generate
+//   - seed: the seed for the random number generator
+//
+// Returns:
+//   a slice of Account structs, each containing a unique identifier and random balances for predefined assets
+func generateRandomAccountsSeed(count int, seed int64) []Account {
+    r := rand.New(rand.NewSource(seed))
     accounts := make([]Account, count)
     assets := []string{"BTC", "ETH", "USDT", "XRP", "ADA"}
     
@@ -227,29 +5961,63 @@ func generateRandomAccounts(count int) []Account {
 func main() {
 	accountsCount := flag.Int("accounts", 1, "Number of random accounts to generate")
 	isConcurrent := flag.Bool("concurrent", false, "Use concurrent implementation")
+	proofFor := flag.String("proof", "", "Print the inclusion proofs for this account identifier as JSON, or with -verify, the proof file to check")
+	seed := flag.Int64("seed", 0, "Seed for the random accounts (0 seeds from the current time)")
+	verify := flag.Bool("verify", false, "Verify the proof file given by -proof instead of building a tree")
+	rootHex := flag.String("root", "", "Root to verify against with -verify (read from stdin if empty)")
 	flag.Parse()
 
-	accounts := generateRandomAccounts(*accountsCount)
+	if *verify {
+		userProof, err := verifyProofFile(*proofFor, *rootHex, os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Proof verification failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Verified %d balances of %s against %s\n", len(userProof.Balances), userProof.Identifier, userProof.Root)
+		return
+	}
+
+	var accounts []Account
+	if *seed != 0 {
+		accounts = generateRandomAccountsSeed(*accountsCount, *seed)
+	} else {
+		accounts = generateRandomAccounts(*accountsCount)
+	}
+
+	// With -proof, stdout carries only the proof JSON so it can be piped into a verifier.
+	var out io.Writer = os.Stdout
+	if *proofFor != "" {
+		out = os.Stderr
+	}
 
-	fmt.Printf("Generated %d random accounts\n\n", *accountsCount)
+	fmt.Fprintf(out, "Generated %d random accounts\n\n", *accountsCount)
 
 	startTime := time.Now()
 
 	var merkleRoot *MerkleNode
+	var err error
 	if *isConcurrent {
-		merkleRoot = createMerkleTreeForAccountsConcurrent(accounts)
+		merkleRoot, err = createMerkleTreeForAccountsConcurrent(accounts)
 	} else {
-		merkleRoot = createMerkleTreeForAccounts(accounts)
+		merkleRoot, err = createMerkleTreeForAccounts(accounts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create Merkle tree: %v\n", err)
+		os.Exit(1)
 	}
 
 	duration := time.Since(startTime)
 
-	fmt.Printf("Merkle Root Hash for all accounts: %x\n", merkleRoot.Hash)
+	fmt.Fprintf(out, "Merkle Root Hash for all accounts: %x\n", merkleRoot.Hash)
+
+	if *proofFor != "" {
+		printUserProof(merkleRoot, accounts, *proofFor)
+	}
 	
-	fmt.Printf("\nTime taken to create Merkle tree: %.4f seconds\n", duration.Seconds())
+	fmt.Fprintf(out, "\nTime taken to create Merkle tree: %.4f seconds\n", duration.Seconds())
 
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 
-	fmt.Printf("Peak memory usage: %.2f MB\n", float64(m.TotalAlloc)/1024/1024)
+	fmt.Fprintf(out, "Peak memory usage: %.2f MB\n", float64(m.TotalAlloc)/1024/1024)
 }
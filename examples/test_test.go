@@ -0,0 +1,4812 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// exampleAccounts returns a fixed set of random accounts for tests.
+//
+// It uses generateRandomAccountsSeed with a constant seed, so every run sees the same accounts and the same root.
+//
+// Parameters:
+//   - count: the number of accounts to generate
+//
+// Returns:
+//   a slice of Account structs with five balances each
+func exampleAccounts(count int) []Account {
+	return generateRandomAccountsSeed(count, 42)
+}
+
+// exampleTreeLeaves returns the leaf hashes of the default SHA-256 tree over the accounts, in tree order.
+//
+// Parameters:
+//   - t: the test context
+//   - accounts: the accounts to hash
+//
+// Returns:
+//   the leaf hashes
+func exampleTreeLeaves(t *testing.T, accounts []Account) [][32]byte {
+	t.Helper()
+	b := NewTreeBuilder(nil)
+	var leaves [][32]byte
+	for _, entry := range flattenBalances(accounts) {
+		leaf, err := b.hashBalance(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, leaf)
+	}
+	return leaves
+}
+
+// peakHeap runs f and samples the live heap while it runs.
+//
+// The heap is collected first so earlier garbage does not count, then sampled every millisecond until f returns. Sampling can miss a short spike, so the result is a close lower bound rather than an exact peak.
+//
+// Parameters:
+//   - f: the work to measure
+//
+// Returns:
+//   the largest live heap seen while f ran, in bytes above the heap before it started
+func peakHeap(f func()) uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	base, peak := stats.HeapAlloc, stats.HeapAlloc
+
+	done := make(chan struct{})
+	sampled := make(chan uint64)
+	go func() {
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				sampled <- peak
+				return
+			case <-ticker.C:
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > peak {
+					peak = stats.HeapAlloc
+				}
+			}
+		}
+	}()
+	f()
+	close(done)
+	return <-sampled - base
+}
+
+// exampleLeafNodes hashes balances into leaf nodes with the default SHA-256 builder.
+//
+// Parameters:
+//   - t: the test context
+//   - entries: the balances to hash, in tree order
+//
+// Returns:
+//   the leaf nodes
+func exampleLeafNodes(t *testing.T, entries []accountBalance) []*MerkleNode {
+	t.Helper()
+	leaves := make([]*MerkleNode, len(entries))
+	for i, entry := range entries {
+		leaf, err := NewTreeBuilder(nil).hashBalanceLeaf(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves[i] = leaf
+	}
+	return leaves
+}
+
+// FuzzBuild feeds arbitrary account JSON into the builder.
+//
+// Every input must either be rejected with an error or produce a tree that passes Validate, and the concurrent builder must agree with the sequential one.
+//
+// Parameters:
+//   - f: the fuzzing context
+//
+// Returns:
+//   None
+func FuzzBuild(f *testing.F) {
+	for _, count := range []int{0, 1, 2, 3, 7} {
+		data, err := json.Marshal(exampleAccounts(count))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte(`[{"identifier":"a","balances":[{"asset":"BTC","balance":-1}]}]`))
+	f.Add([]byte(`[{"identifier":"a","balances":[{"asset":"BTC","balance":1,"sign":"Debit"}]}]`))
+	f.Add([]byte(`[{"identifier":"a"},{"identifier":"a"}]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var accounts []Account
+		if err := json.Unmarshal(data, &accounts); err != nil {
+			return
+		}
+
+		root, err := createMerkleTreeForAccounts(accounts)
+		if err != nil {
+			return
+		}
+		if err := root.Validate(); err != nil {
+			t.Fatalf("built tree does not validate: %v", err)
+		}
+
+		concurrent, err := createMerkleTreeForAccountsConcurrent(accounts)
+		if err != nil {
+			t.Fatalf("concurrent build failed where the sequential one succeeded: %v", err)
+		}
+		if concurrent.Hash != root.Hash {
+			t.Fatalf("concurrent root %x differs from sequential root %x", concurrent.Hash, root.Hash)
+		}
+	})
+}
+
+// FuzzVerifyProof feeds arbitrary leaves and proofs into VerifyProof.
+//
+// A proof may only be accepted if it is the proof GenerateProof produces for that leaf, so no forged path verifies against a root the builder did not produce.
+//
+// Parameters:
+//   - f: the fuzzing context
+//
+// Returns:
+//   None
+func FuzzVerifyProof(f *testing.F) {
+	root, err := createMerkleTreeForAccounts(exampleAccounts(5))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for i, leaf := range root.Leaves() {
+		var leafHash [32]byte
+		copy(leafHash[:], leaf)
+		proof, err := GenerateProof(root, leafHash)
+		if err != nil {
+			f.Fatal(err)
+		}
+		data, err := json.Marshal(proof)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(leaf, data)
+		if i == 0 {
+			f.Add(leaf, []byte(`[]`))
+			f.Add(root.Hash[:], []byte(`[]`))
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, leaf, data []byte) {
+		if len(leaf) != 32 {
+			return
+		}
+		var leafHash [32]byte
+		copy(leafHash[:], leaf)
+
+		var proof []ProofStep
+		if err := json.Unmarshal(data, &proof); err != nil {
+			return
+		}
+		if !VerifyProof(leafHash, proof, root.Hash) {
+			return
+		}
+
+		if len(proof) == 0 && leafHash == root.Hash {
+			return
+		}
+		want, err := GenerateProof(root, leafHash)
+		if err != nil {
+			t.Fatalf("accepted a proof for leaf %x, which is not in the tree", leafHash)
+		}
+		if len(want) != len(proof) {
+			t.Fatalf("accepted a %d-step proof where the tree has a %d-step path", len(proof), len(want))
+		}
+		for i := range want {
+			if want[i] != proof[i] {
+				t.Fatalf("accepted a proof that differs from the tree's path at step %d", i)
+			}
+		}
+	})
+}
+
+// TestConcurrentLeafOrder checks that the concurrent builder places every leaf where the sequential builder does.
+//
+// It compares the leaf hashes of both trees element by element across account counts around the chunk boundaries and for several worker counts, so an off-by-one in the chunk ranges would show up as a reordered or missing leaf rather than only as a different root.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestConcurrentLeafOrder(t *testing.T) {
+	for _, count := range []int{0, 1, 2, 3, 4, 5, 7, 8, 9, 15, 16, 17, 63, 64, 65, 100, 257, 1000} {
+		accounts := exampleAccounts(count)
+		sequential, err := NewTreeBuilder(nil).Build(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := sequential.Leaves()
+
+		for _, workers := range []int{1, 2, 3, 4, 7, 16, 64} {
+			b := NewTreeBuilder(nil)
+			b.Workers = workers
+			concurrent, err := b.BuildConcurrent(accounts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := concurrent.Leaves()
+			if len(got) != len(want) {
+				t.Fatalf("%d accounts, %d workers: got %d leaves, want %d", count, workers, len(got), len(want))
+			}
+			for i := range want {
+				if string(got[i]) != string(want[i]) {
+					t.Fatalf("%d accounts, %d workers: leaf %d is %x, want %x", count, workers, i, got[i], want[i])
+				}
+			}
+			if concurrent.Hash != sequential.Hash {
+				t.Fatalf("%d accounts, %d workers: root %x, want %x", count, workers, concurrent.Hash, sequential.Hash)
+			}
+		}
+	}
+}
+
+type sha512Hasher struct{}
+
+// Hash returns the SHA-512/256 digest of data.
+//
+// Parameters:
+//   - data: the bytes to hash
+//
+// Returns:
+//   the 32-byte digest
+func (sha512Hasher) Hash(data []byte) [32]byte {
+	return sha512.Sum512_256(data)
+}
+
+// Name returns the name sha512Hasher is registered under.
+//
+// Parameters:
+//   - None
+//
+// Returns:
+//   "sha512/256"
+func (sha512Hasher) Name() string {
+	return "sha512/256"
+}
+
+// TestVerifyProofWithHasher checks that proofs from a tree built with another hasher verify only through a builder with the same hasher.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestVerifyProofWithHasher(t *testing.T) {
+	accounts := exampleAccounts(9)
+	b := NewTreeBuilder(sha512Hasher{})
+	root, err := b.Build(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := b.hashBalance(accountBalance{identifier: accounts[4].Identifier, balance: accounts[4].Balances[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := GenerateProof(root, leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !NewTreeBuilder(sha512Hasher{}).VerifyProof(leaf, proof, root.Hash) {
+		t.Fatal("proof does not verify with the matching hasher")
+	}
+	if VerifyProof(leaf, proof, root.Hash) {
+		t.Fatal("proof verifies with SHA-256 although the tree was built with SHA-512/256")
+	}
+}
+
+// TestVerifyRootWithCount checks that a count mismatch and a root mismatch are reported differently, under the default and a custom hasher.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestVerifyRootWithCount(t *testing.T) {
+	accounts := exampleAccounts(6)
+	for _, b := range []*TreeBuilder{NewTreeBuilder(nil), NewTreeBuilder(sha512Hasher{})} {
+		root, err := b.Build(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rootHex := root.RootHex()
+
+		if ok, err := b.VerifyRootWithCount(accounts, rootHex, 30); !ok || err != nil {
+			t.Fatalf("matching root and count: ok=%v err=%v", ok, err)
+		}
+		if ok, err := b.VerifyRootWithCount(accounts, rootHex, 29); ok || !errors.Is(err, ErrLeafCount) {
+			t.Fatalf("count mismatch: ok=%v err=%v, want ErrLeafCount", ok, err)
+		}
+		for _, bad := range []string{rootHex[:62], rootHex + "00", "zz" + rootHex[2:]} {
+			if ok, err := b.VerifyRootWithCount(accounts, bad, 30); ok || err == nil {
+				t.Fatalf("malformed root %q: ok=%v err=%v", bad, ok, err)
+			}
+		}
+		if ok, err := b.VerifyRootWithCount(accounts[1:], rootHex, 25); ok || err != nil {
+			t.Fatalf("root mismatch: ok=%v err=%v", ok, err)
+		}
+	}
+
+	root, err := NewTreeBuilder(sha512Hasher{}).Build(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := VerifyRootWithCount(accounts, root.RootHex(), 30); ok || err != nil {
+		t.Fatalf("SHA-256 check of a SHA-512/256 root: ok=%v err=%v", ok, err)
+	}
+}
+
+// TestRenderProofHTML checks that the rendered page carries the leaf data, the proof as JSON and the root for its script to verify.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestRenderProofHTML(t *testing.T) {
+	accounts := exampleAccounts(7)
+	root, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance := accounts[3].Balances[1]
+	leaf, err := NewTreeBuilder(nil).hashBalance(accountBalance{identifier: accounts[3].Identifier, balance: balance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := GenerateProof(root, leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := RenderProofHTML(&buf, balance, proof, root.RootHex()); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+
+	leafData, err := appendCanonicalBalance(nil, balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proofJSON, err := json.Marshal(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		template.HTMLEscapeString(string(leafData)),
+		hex.EncodeToString(leaf[:]),
+		"const proof = " + string(proofJSON) + ";",
+		`const expectedRoot = "` + root.RootHex() + `";`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page does not contain %s", want)
+		}
+	}
+
+	if err := RenderProofHTML(&buf, balance, proof, "not a hash"); err == nil {
+		t.Error("rendered a page for an invalid root")
+	}
+}
+
+// TestTreeBuilderOptionsRoundTrip checks that options published in the metadata rebuild the same root after a JSON round trip.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestTreeBuilderOptionsRoundTrip(t *testing.T) {
+	RegisterHasher(sha512Hasher{})
+	accounts := exampleAccounts(5)
+	accounts[2].Balances[0].Balance = -3
+
+	b := NewTreeBuilder(sha512Hasher{})
+	b.AllowNegative = true
+	meta := TreeMetadata{Timestamp: 1700000000, Version: 2, Options: b}
+	root, err := b.BuildWithMetadata(accounts, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded TreeMetadata
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Options == nil || !loaded.Options.AllowNegative || loaded.Options.AllowDuplicates {
+		t.Fatalf("options did not round-trip: %s", data)
+	}
+
+	rebuilt, err := loaded.Options.BuildWithMetadata(accounts, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.Hash != root.Hash {
+		t.Fatalf("rebuilt root %x, want %x", rebuilt.Hash, root.Hash)
+	}
+	header, err := loaded.Options.hashMetadata(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := GenerateProof(rebuilt, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Options.VerifyMetadata(root.Hash, loaded, proof) {
+		t.Fatal("loaded options do not verify the metadata")
+	}
+
+	if err := new(TreeBuilder).UnmarshalJSON([]byte(`{"hasher":"md5"}`)); err == nil {
+		t.Fatal("loaded options naming an unregistered hasher")
+	}
+}
+
+// TestAssetCanonicalizer checks that synonym asset symbols produce the same leaves and roots once they are mapped to a canonical id.
+//
+// The mapping renames BTC to XBT and USDT to USDT.ERC20 in one copy of the accounts, which also changes where those balances sort, so the test covers canonicalization before ordering as well as before hashing.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestAssetCanonicalizer(t *testing.T) {
+	synonyms := map[string]string{"XBT": "BTC", "USDT.ERC20": "USDT"}
+	canonicalize := func(asset string) string {
+		if canonical, ok := synonyms[asset]; ok {
+			return canonical
+		}
+		return asset
+	}
+
+	accounts := exampleAccounts(6)
+	renamed := exampleAccounts(6)
+	for _, account := range renamed {
+		for i := range account.Balances {
+			switch account.Balances[i].Asset {
+			case "BTC":
+				account.Balances[i].Asset = "XBT"
+			case "USDT":
+				account.Balances[i].Asset = "USDT.ERC20"
+			}
+		}
+	}
+
+	b := NewTreeBuilder(nil)
+	b.AssetCanonicalizer = canonicalize
+	leaf, err := b.hashBalance(accountBalance{identifier: accounts[0].Identifier, balance: accounts[0].Balances[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	synonym, err := b.hashBalance(accountBalance{identifier: renamed[0].Identifier, balance: renamed[0].Balances[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf != synonym {
+		t.Fatalf("synonym leaf %x, want %x", synonym, leaf)
+	}
+
+	builds := map[string]func(*TreeBuilder, []Account) (*MerkleNode, error){
+		"Build":          (*TreeBuilder).Build,
+		"BuildByAccount": (*TreeBuilder).BuildByAccount,
+		"BuildTwoLevel":  (*TreeBuilder).BuildTwoLevel,
+	}
+	for name, build := range builds {
+		want, err := build(b, accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := build(b, renamed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Hash != want.Hash {
+			t.Errorf("%s: synonym root %x, want %x", name, got.Hash, want.Hash)
+		}
+
+		plain, err := build(NewTreeBuilder(nil), renamed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plain.Hash == want.Hash {
+			t.Errorf("%s: renamed assets give the same root without a canonicalizer", name)
+		}
+	}
+
+	if renamed[0].Balances[0].Asset != "XBT" {
+		t.Fatalf("build modified the caller's accounts: asset is %s", renamed[0].Balances[0].Asset)
+	}
+}
+
+// TestVerifyLoadedTree checks that each failed check of a loaded tree is reported with its own error.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestVerifyLoadedTree(t *testing.T) {
+	built, err := createMerkleTreeForAccounts(exampleAccounts(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(built)
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func() *MerkleNode {
+		var root MerkleNode
+		if err := json.Unmarshal(data, &root); err != nil {
+			t.Fatal(err)
+		}
+		return &root
+	}
+	rootHex := built.RootHex()
+
+	if err := VerifyLoadedTree(load(), rootHex, 20); err != nil {
+		t.Fatalf("intact tree: %v", err)
+	}
+
+	tampered := load()
+	tampered.Left.Right.Hash[0] ^= 1
+	if err := VerifyLoadedTree(tampered, rootHex, 20); !errors.Is(err, ErrInvalidTree) {
+		t.Errorf("tampered node: got %v, want ErrInvalidTree", err)
+	}
+
+	other, err := createMerkleTreeForAccounts(exampleAccounts(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyLoadedTree(load(), other.RootHex(), 20); !errors.Is(err, ErrRootMismatch) {
+		t.Errorf("wrong root: got %v, want ErrRootMismatch", err)
+	}
+
+	if err := VerifyLoadedTree(load(), rootHex, 19); !errors.Is(err, ErrLeafCount) {
+		t.Errorf("wrong leaf count: got %v, want ErrLeafCount", err)
+	}
+}
+
+// TestPolicyHash checks that the root binds to the policy hash while balance and policy proofs still verify.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestPolicyHash(t *testing.T) {
+	accounts := exampleAccounts(5)
+	plain, err := NewTreeBuilder(nil).Build(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := make(map[[32]byte]string)
+	roots[plain.Hash] = "no policy"
+	for _, policy := range []string{"methodology v1", "methodology v2"} {
+		digest := sha512.Sum512_256([]byte(policy))
+		b := NewTreeBuilder(nil)
+		b.PolicyHash = digest[:]
+
+		root, err := b.Build(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if previous, ok := roots[root.Hash]; ok {
+			t.Fatalf("%s gives the same root as %s", policy, previous)
+		}
+		roots[root.Hash] = policy
+
+		concurrent, err := b.BuildConcurrent(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if concurrent.Hash != root.Hash {
+			t.Fatalf("%s: concurrent root %x, want %x", policy, concurrent.Hash, root.Hash)
+		}
+
+		proof, err := GenerateProof(root, b.PolicyLeaf())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !b.VerifyProof(b.PolicyLeaf(), proof, root.Hash) {
+			t.Fatalf("%s: policy proof does not verify", policy)
+		}
+		leaf, err := b.hashBalance(accountBalance{identifier: accounts[1].Identifier, balance: accounts[1].Balances[3]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err = GenerateProof(root, leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !b.VerifyProof(leaf, proof, root.Hash) {
+			t.Fatalf("%s: balance proof does not verify", policy)
+		}
+
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded := new(TreeBuilder)
+		if err := json.Unmarshal(data, loaded); err != nil {
+			t.Fatal(err)
+		}
+		rebuilt, err := loaded.Build(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rebuilt.Hash != root.Hash {
+			t.Fatalf("%s: root rebuilt from %s is %x, want %x", policy, data, rebuilt.Hash, root.Hash)
+		}
+	}
+}
+
+// TestReserveAddresses checks that the root commits to the reserve address set and that each address is provable.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestReserveAddresses(t *testing.T) {
+	accounts := exampleAccounts(5)
+	build := func(addresses ...string) (*TreeBuilder, *MerkleNode) {
+		b := NewTreeBuilder(nil)
+		b.PolicyHash = []byte("policy")
+		b.ReserveAddresses = addresses
+		root, err := b.Build(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, root
+	}
+
+	b, root := build("bc1qreserve0", "bc1qreserve1", "0xreserve2")
+	if _, changed := build("bc1qreserve0", "bc1qreserveX", "0xreserve2"); changed.Hash == root.Hash {
+		t.Fatal("changing a reserve address kept the root")
+	}
+	if _, none := build(); none.Hash == root.Hash {
+		t.Fatal("dropping the reserve addresses kept the root")
+	}
+	if _, reordered := build("0xreserve2", "bc1qreserve1", "bc1qreserve0"); reordered.Hash != root.Hash {
+		t.Fatal("reordering the reserve addresses changed the root")
+	}
+
+	for _, leaf := range [][32]byte{b.ReserveLeaf("bc1qreserve1"), b.PolicyLeaf()} {
+		proof, err := GenerateProof(root, leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !b.VerifyProof(leaf, proof, root.Hash) {
+			t.Fatalf("proof of %x does not verify", leaf)
+		}
+	}
+}
+
+// TestVerifyAgainstAny checks that a proof is matched to the one candidate root it was generated for.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestVerifyAgainstAny(t *testing.T) {
+	accounts := exampleAccounts(6)
+	var roots []string
+	var trees []*MerkleNode
+	for _, count := range []int{4, 6, 5} {
+		root, err := createMerkleTreeForAccounts(accounts[:count])
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, root.RootHex())
+		trees = append(trees, root)
+	}
+
+	balance := accounts[5].Balances[0]
+	leaf, err := NewTreeBuilder(nil).hashBalance(accountBalance{identifier: accounts[5].Identifier, balance: balance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := GenerateProof(trees[1], leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i, ok := VerifyAgainstAny(roots, balance, proof); !ok || i != 1 {
+		t.Fatalf("got index %d, ok %v; want 1, true", i, ok)
+	}
+	if i, ok := VerifyAgainstAny([]string{"zz", roots[0], roots[2]}, balance, proof); ok || i != -1 {
+		t.Fatalf("matched root %d without the proof's root", i)
+	}
+}
+
+type countingHasher struct {
+	calls *int
+}
+
+// Hash counts the call and returns the SHA-256 digest of data.
+//
+// Parameters:
+//   - data: the bytes to hash
+//
+// Returns:
+//   the 32-byte digest
+func (h countingHasher) Hash(data []byte) [32]byte {
+	*h.calls++
+	return SHA256Hasher{}.Hash(data)
+}
+
+// TestHashOpCount checks the predicted number of hash operations against the calls an instrumented hasher sees during real builds.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestHashOpCount(t *testing.T) {
+	for _, count := range []int{0, 1, 2, 3, 7, 13} {
+		accounts := exampleAccounts(count)
+		for _, extras := range []bool{false, true} {
+			var calls int
+			b := NewTreeBuilder(countingHasher{calls: &calls})
+			if extras {
+				b.PolicyHash = []byte("policy")
+				b.ReserveAddresses = []string{"a", "b", "c"}
+				b.PairWithZero = count%2 == 1
+			}
+
+			for _, padded := range []bool{false, true} {
+				calls = 0
+				build := b.Build
+				if padded {
+					build = b.BuildPadded
+				}
+				if _, err := build(accounts); err != nil {
+					t.Fatal(err)
+				}
+				if want := b.HashOpCount(5*count, padded); calls != want {
+					t.Errorf("%d accounts, extras %v, padded %v: %d hash calls, HashOpCount says %d", count, extras, padded, calls, want)
+				}
+			}
+		}
+	}
+}
+
+// TestTopHolders checks the top three holders of an asset for a known distribution.
+//
+// The distribution includes an account that does not hold the asset, a debit that ranks its account below every credit and a tie that is broken by identifier.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestTopHolders(t *testing.T) {
+	accounts := []Account{
+		{Identifier: "alice", Balances: []Balance{{Asset: "BTC", Balance: 5}, {Asset: "ETH", Balance: 100}}},
+		{Identifier: "bob", Balances: []Balance{{Asset: "BTC", Balance: 9, Sign: Debit}}},
+		{Identifier: "carol", Balances: []Balance{{Asset: "BTC", Balance: 7}}},
+		{Identifier: "dave", Balances: []Balance{{Asset: "ETH", Balance: 50}}},
+		{Identifier: "erin", Balances: []Balance{{Asset: "BTC", Balance: 5}}},
+	}
+
+	top, err := TopHolders(accounts, "BTC", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, account := range top {
+		got = append(got, account.Identifier)
+	}
+	if want := []string{"carol", "alice", "erin"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("top holders %v, want %v", got, want)
+	}
+
+	if all, err := TopHolders(accounts, "BTC", 10); err != nil || len(all) != 4 {
+		t.Fatalf("asking for more holders than exist: %d holders, err %v", len(all), err)
+	}
+
+	accounts[2].Balances[0].Sign = "Debit"
+	if _, err := TopHolders(accounts, "BTC", 3); !errors.Is(err, ErrInvalidSign) {
+		t.Fatalf("unknown sign: got %v, want ErrInvalidSign", err)
+	}
+}
+
+// TestChangedIdentifiers checks that one added, one removed and one modified account are each reported, and that reordered balances are not a change.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestChangedIdentifiers(t *testing.T) {
+	oldAccounts := exampleAccounts(5)
+	newAccounts := exampleAccounts(6)[1:]
+	newAccounts[1].Balances[2].Balance += 0.5
+	balances := newAccounts[2].Balances
+	balances[0], balances[4] = balances[4], balances[0]
+
+	added, removed, modified, err := ChangedIdentifiers(oldAccounts, newAccounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(added, ",") != "user6" || strings.Join(removed, ",") != "user1" || strings.Join(modified, ",") != "user3" {
+		t.Fatalf("added %v, removed %v, modified %v; want [user6], [user1], [user3]", added, removed, modified)
+	}
+
+	nan := []Account{{Identifier: "a", Balances: []Balance{{Asset: "BTC", Balance: math.NaN()}}}}
+	if _, _, _, err := ChangedIdentifiers(oldAccounts, nan); err == nil {
+		t.Fatal("compared a NaN balance without an error")
+	}
+}
+
+// TestDistinctAssets checks the sorted list of assets held across accounts with overlapping holdings.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestDistinctAssets(t *testing.T) {
+	accounts := []Account{
+		{Identifier: "a", Balances: []Balance{{Asset: "USDT", Balance: 1}, {Asset: "BTC", Balance: 2}}},
+		{Identifier: "b", Balances: []Balance{{Asset: "ETH", Balance: 3}, {Asset: "BTC", Balance: 4}}},
+		{Identifier: "c"},
+		{Identifier: "d", Balances: []Balance{{Asset: "ADA", Balance: 5}, {Asset: "USDT", Balance: 6}}},
+	}
+
+	got := DistinctAssets(accounts)
+	if want := "ADA,BTC,ETH,USDT"; strings.Join(got, ",") != want {
+		t.Fatalf("distinct assets %v, want %s", got, want)
+	}
+	if got := DistinctAssets(nil); len(got) != 0 {
+		t.Fatalf("distinct assets of no accounts: %v", got)
+	}
+}
+
+// TestLoadAccountsJSONL checks that blank lines are skipped and a malformed line is reported by its line number.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestLoadAccountsJSONL(t *testing.T) {
+	valid := `{"identifier":"a","balances":[{"asset":"BTC","balance":1}]}
+
+{"identifier":"b","balances":[{"asset":"ETH","balance":2,"sign":"debit"}]}
+`
+	accounts, err := LoadAccountsJSONL(strings.NewReader(valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 || accounts[1].Identifier != "b" || accounts[1].Balances[0].Sign != Debit {
+		t.Fatalf("decoded %+v", accounts)
+	}
+
+	malformed := valid + "   \n" + `{"identifier":"c","balances":[` + "\n"
+	_, err = LoadAccountsJSONL(strings.NewReader(malformed))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 5:") {
+		t.Fatalf("malformed line 5: got %v", err)
+	}
+}
+
+// TestSumByAssetConcurrent checks that the concurrent totals equal the sequential ones exactly, across chunk boundaries and worker counts.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestSumByAssetConcurrent(t *testing.T) {
+	accounts := exampleAccounts(3*sumByAssetChunkSize + 17)
+	for i := 0; i < len(accounts); i += 7 {
+		accounts[i].Balances[1].Sign = Debit
+	}
+
+	for _, count := range []int{0, 1, sumByAssetChunkSize, sumByAssetChunkSize + 1, len(accounts)} {
+		want, err := SumByAsset(accounts[:count])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []int{0, 1, 3, 8} {
+			got, err := SumByAssetConcurrent(accounts[:count], workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("%d accounts, %d workers: %d assets, want %d", count, workers, len(got), len(want))
+			}
+			for asset, total := range want {
+				if got[asset] != total {
+					t.Errorf("%d accounts, %d workers: %s total %v, want %v", count, workers, asset, got[asset], total)
+				}
+			}
+		}
+	}
+
+	accounts[sumByAssetChunkSize+3].Balances[0].Sign = "credit"
+	if _, err := SumByAssetConcurrent(accounts, 4); !errors.Is(err, ErrInvalidSign) {
+		t.Fatalf("unknown sign: got %v, want ErrInvalidSign", err)
+	}
+}
+
+// TestAccountsFingerprint checks that reordered but equal inputs share a fingerprint, that a changed balance does not and that a non-finite balance is an error.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestAccountsFingerprint(t *testing.T) {
+	accounts := exampleAccounts(8)
+	want, err := AccountsFingerprint(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reordered := exampleAccounts(8)
+	reordered[0], reordered[7] = reordered[7], reordered[0]
+	reordered[3].Balances[0], reordered[3].Balances[4] = reordered[3].Balances[4], reordered[3].Balances[0]
+	got, err := AccountsFingerprint(reordered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("reordered fingerprint %x, want %x", got, want)
+	}
+
+	reordered[5].Balances[2].Balance += 1e-9
+	changed, err := AccountsFingerprint(reordered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(changed, want) {
+		t.Fatal("changing a balance kept the fingerprint")
+	}
+
+	for _, amount := range []float64{math.NaN(), math.Inf(1)} {
+		reordered[5].Balances[2].Balance = amount
+		if _, err := AccountsFingerprint(reordered); err == nil {
+			t.Fatalf("fingerprinted a %v balance without an error", amount)
+		}
+	}
+}
+
+// TestBalanceSign checks that debits reduce the net total, that the sign changes the leaf hash and that unknown or mixed signs are rejected.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestBalanceSign(t *testing.T) {
+	accounts := []Account{
+		{Identifier: "a", Balances: []Balance{{Asset: "BTC", Balance: 10}}},
+		{Identifier: "b", Balances: []Balance{{Asset: "BTC", Balance: 4}}},
+		{Identifier: "exchange", Balances: []Balance{{Asset: "BTC", Balance: 3, Sign: Debit}}},
+	}
+	totals, err := SumByAsset(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totals["BTC"] != 11 {
+		t.Fatalf("net BTC total %v, want 11", totals["BTC"])
+	}
+
+	b := NewTreeBuilder(nil)
+	credit, err := b.hashBalance(accountBalance{balance: Balance{Asset: "BTC", Balance: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	debit, err := b.hashBalance(accountBalance{balance: Balance{Asset: "BTC", Balance: 3, Sign: Debit}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credit == debit {
+		t.Fatal("credit and debit leaves hash the same")
+	}
+
+	unknown := []Account{{Identifier: "a", Balances: []Balance{{Asset: "BTC", Balance: 1, Sign: "Debit"}}}}
+	mixed := []Account{{Identifier: "a", Balances: []Balance{{Asset: "BTC", Balance: 1}, {Asset: "BTC", Balance: 1, Sign: Debit}}}}
+	for name, accounts := range map[string][]Account{"unknown": unknown, "mixed": mixed} {
+		if _, err := createMerkleTreeForAccounts(accounts); !errors.Is(err, ErrInvalidSign) {
+			t.Errorf("%s sign: build returned %v, want ErrInvalidSign", name, err)
+		}
+		if _, err := SumByAsset(accounts); !errors.Is(err, ErrInvalidSign) {
+			t.Errorf("%s sign: SumByAsset returned %v, want ErrInvalidSign", name, err)
+		}
+	}
+	if _, err := unknown[0].Balances[0].SignedAmount(); !errors.Is(err, ErrInvalidSign) {
+		t.Errorf("unknown sign: SignedAmount returned %v, want ErrInvalidSign", err)
+	}
+}
+
+// TestSumTree checks that a hash+sum tree carries each subtree's total and that the hash accumulator reproduces the default root.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestSumTree(t *testing.T) {
+	accounts := exampleAccounts(11)
+	accounts[4].Balances[1].Sign = Debit
+
+	root, err := createSumTreeForAsset(accounts, "ETH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	totals, err := SumByAsset(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(root.Sum-totals["ETH"]) > 1e-9 {
+		t.Fatalf("root total %v, want %v", root.Sum, totals["ETH"])
+	}
+	if root.Left.Sum+root.Right.Sum != root.Sum {
+		t.Fatalf("subtree totals %v and %v do not add up to %v", root.Left.Sum, root.Right.Sum, root.Sum)
+	}
+
+	tampered := *root.Left
+	tampered.Sum++
+	acc := hashSumAccumulator{hasher: SHA256Hasher{}}
+	if acc.Combine(&tampered, root.Right).Hash == root.Hash {
+		t.Fatal("changing a subtree total kept the root hash")
+	}
+
+	var leaves []*MerkleNode
+	for _, leaf := range exampleTreeLeaves(t, accounts) {
+		leaves = append(leaves, &MerkleNode{Hash: leaf})
+	}
+	want, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := BuildAccumulatorTree[*MerkleNode](leaves, hashAccumulator{hasher: SHA256Hasher{}}); got.Hash != want.Hash {
+		t.Fatalf("accumulator root %x, want %x", got.Hash, want.Hash)
+	}
+}
+
+// TestRootCommitment checks that a valid reveal matches its commitment and that a changed root or nonce does not.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestRootCommitment(t *testing.T) {
+	root, err := createMerkleTreeForAccounts(exampleAccounts(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := []byte("0123456789abcdef0123456789abcdef")
+	commitment := CommitRoot(root.Hash[:], nonce)
+
+	if !VerifyRootCommitment(commitment, root.Hash[:], nonce) {
+		t.Fatal("valid reveal rejected")
+	}
+
+	other := root.Hash
+	other[31] ^= 1
+	if VerifyRootCommitment(commitment, other[:], nonce) {
+		t.Fatal("reveal with another root accepted")
+	}
+	if VerifyRootCommitment(commitment, root.Hash[:], []byte("0123456789abcdef0123456789abcdeF")) {
+		t.Fatal("reveal with another nonce accepted")
+	}
+}
+
+// TestVerifyProofBitFlips checks that every proof verifies and that flipping a single bit of the leaf or of any sibling makes it fail.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestVerifyProofBitFlips(t *testing.T) {
+	root, err := createMerkleTreeForAccounts(exampleAccounts(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bit := range []int{0, 7, 130, 255} {
+		for i, leaf := range exampleTreeLeaves(t, exampleAccounts(7)) {
+			proof, err := GenerateProof(root, leaf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyProof(leaf, proof, root.Hash) {
+				t.Fatalf("leaf %d: proof does not verify", i)
+			}
+
+			flipped := leaf
+			flipped[bit/8] ^= 1 << (bit % 8)
+			if VerifyProof(flipped, proof, root.Hash) {
+				t.Fatalf("leaf %d: proof verifies with bit %d of the leaf flipped", i, bit)
+			}
+
+			for j := range proof {
+				mutated := append([]ProofStep(nil), proof...)
+				mutated[j].Hash[bit/8] ^= 1 << (bit % 8)
+				if VerifyProof(leaf, mutated, root.Hash) {
+					t.Fatalf("leaf %d: proof verifies with bit %d of sibling %d flipped", i, bit, j)
+				}
+			}
+		}
+	}
+}
+
+// TestShuffledAccountsRoot checks that shuffling the accounts and their balances does not change the root.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestShuffledAccountsRoot(t *testing.T) {
+	want, err := createMerkleTreeForAccounts(exampleAccounts(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for run := 0; run < 5; run++ {
+		accounts := exampleAccounts(50)
+		r.Shuffle(len(accounts), func(i, j int) { accounts[i], accounts[j] = accounts[j], accounts[i] })
+		for _, account := range accounts {
+			r.Shuffle(len(account.Balances), func(i, j int) {
+				account.Balances[i], account.Balances[j] = account.Balances[j], account.Balances[i]
+			})
+		}
+
+		got, err := createMerkleTreeForAccounts(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Hash != want.Hash {
+			t.Fatalf("run %d: shuffled root %x, want %x", run, got.Hash, want.Hash)
+		}
+	}
+}
+
+// TestOddLeafCarry checks that unpaired nodes are carried up rather than duplicated, in the sequential and parallel builders alike, and that proofs still verify.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestOddLeafCarry(t *testing.T) {
+	h := SHA256Hasher{}
+	duplicatedRoot := func(level [][32]byte) [32]byte {
+		for len(level) > 1 {
+			var next [][32]byte
+			for i := 0; i < len(level); i += 2 {
+				right := level[i]
+				if i+1 < len(level) {
+					right = level[i+1]
+				}
+				next = append(next, hashChildren(h, level[i], right))
+			}
+			level = next
+		}
+		return level[0]
+	}
+
+	for _, count := range []int{3, 5, 7} {
+		hashes := make([][32]byte, count)
+		leaves := make([]*MerkleNode, count)
+		for i := range hashes {
+			hashes[i] = hashLeaf(h, []byte{byte(i)})
+			leaves[i] = &MerkleNode{Hash: hashes[i]}
+		}
+
+		root := buildTree(leaves)
+		if root.Hash == duplicatedRoot(hashes) {
+			t.Fatalf("%d leaves: root matches the duplication scheme", count)
+		}
+		parallel, err := NewTreeBuilder(nil).buildTreeParallel(context.Background(), leaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parallel.Hash != root.Hash {
+			t.Fatalf("%d leaves: parallel root %x, want %x", count, parallel.Hash, root.Hash)
+		}
+
+		for i, leaf := range hashes {
+			proof, err := GenerateProof(root, leaf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyProof(leaf, proof, root.Hash) {
+				t.Fatalf("%d leaves: proof of leaf %d does not verify", count, i)
+			}
+		}
+	}
+}
+
+type recordingObserver struct {
+	builds []observedBuild
+}
+
+type observedBuild struct {
+	duration      time.Duration
+	leaves, depth int
+}
+
+// ObserveBuild records the measurements of a build.
+//
+// Parameters:
+//   - duration: how long the build took
+//   - leaves: the number of leaves hashed into the tree
+//   - depth: the height of the tree that was built
+//
+// Returns:
+//   None
+func (o *recordingObserver) ObserveBuild(duration time.Duration, leaves, depth int) {
+	o.builds = append(o.builds, observedBuild{duration: duration, leaves: leaves, depth: depth})
+}
+
+type mockHasher struct{}
+
+// Hash returns a digest that differs from SHA-256 for every input.
+//
+// Parameters:
+//   - data: the bytes to hash
+//
+// Returns:
+//   the SHA-256 digest of data with its first byte inverted
+func (mockHasher) Hash(data []byte) [32]byte {
+	digest := sha256.Sum256(data)
+	digest[0] ^= 0xff
+	return digest
+}
+
+// TestPluggableHasher checks that a mock hasher changes the root, that all hashing goes through the injected hasher and that a zero-value builder hashes with SHA-256.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestPluggableHasher(t *testing.T) {
+	accounts := exampleAccounts(6)
+	sha, err := NewTreeBuilder(nil).Build(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock, err := NewTreeBuilder(mockHasher{}).Build(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mock.Hash == sha.Hash {
+		t.Fatal("mock hasher gives the SHA-256 root")
+	}
+
+	var calls int
+	b := NewTreeBuilder(countingHasher{calls: &calls})
+	if _, err := b.Build(accounts); err != nil {
+		t.Fatal(err)
+	}
+	if want := HashOpCount(30); calls != want {
+		t.Fatalf("injected hasher saw %d calls, want %d", calls, want)
+	}
+
+	var zero TreeBuilder
+	root, err := zero.Build(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Hash != sha.Hash {
+		t.Fatalf("zero-value builder root %x, want %x", root.Hash, sha.Hash)
+	}
+}
+
+// TestNonceTree checks that different nonces give different roots for identical balances, that the returned nonce lets a user verify their leaf and that input order does not matter.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestNonceTree(t *testing.T) {
+	accounts := exampleAccounts(5)
+	nonces := func(salt byte) map[string][]byte {
+		m := make(map[string][]byte)
+		for i, account := range accounts {
+			m[account.Identifier] = []byte{salt, byte(i), 0xa5, 0x5a}
+		}
+		return m
+	}
+
+	first, err := createMerkleTreeWithNonces(accounts, nonces(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := createMerkleTreeWithNonces(accounts, nonces(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Hash == second.Hash {
+		t.Fatal("different nonces give the same root")
+	}
+
+	proof, nonce, err := GenerateNonceProof(first, accounts[3], nonces(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := NewTreeBuilder(nil).hashAccountLeaf(accounts[3], nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyProof(leaf.Hash, proof, first.Hash) {
+		t.Fatal("nonce proof does not verify")
+	}
+
+	reversed := exampleAccounts(5)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	again, err := createMerkleTreeWithNonces(reversed, nonces(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Hash != first.Hash {
+		t.Fatal("reordered accounts give a different root")
+	}
+	if reversed[0].Identifier != "user5" {
+		t.Fatal("build reordered the caller's accounts")
+	}
+
+	missing := nonces(1)
+	delete(missing, "user2")
+	if _, err := createMerkleTreeWithNonces(accounts, missing); err == nil {
+		t.Fatal("built a tree with an account missing its nonce")
+	}
+}
+
+type panickingHasher struct {
+	leaves bool
+}
+
+// Hash panics on leaf data naming the POISON asset, or on every internal node when leaves is unset, and returns the SHA-256 digest of data otherwise.
+//
+// Parameters:
+//   - data: the bytes to hash
+//
+// Returns:
+//   the 32-byte digest
+func (h panickingHasher) Hash(data []byte) [32]byte {
+	if h.leaves && bytes.Contains(data, []byte("POISON")) {
+		panic("poisoned leaf")
+	}
+	if !h.leaves && len(data) == 65 && data[0] == internalPrefix {
+		panic("poisoned node")
+	}
+	return sha256.Sum256(data)
+}
+
+type cancellingHasher struct {
+	calls  *atomic.Int64
+	after  int64
+	cancel context.CancelFunc
+}
+
+// Hash cancels the build's context once a set number of hashes have been computed and returns the SHA-256 digest of data.
+//
+// Parameters:
+//   - data: the bytes to hash
+//
+// Returns:
+//   the 32-byte digest
+func (h cancellingHasher) Hash(data []byte) [32]byte {
+	if h.calls.Add(1) == h.after {
+		h.cancel()
+	}
+	return sha256.Sum256(data)
+}
+
+// TestBuildConcurrentCancel checks that cancelling the context part-way through a concurrent build stops it with context.Canceled.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestBuildConcurrentCancel(t *testing.T) {
+	accounts := exampleAccounts(2000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var calls atomic.Int64
+	b := NewTreeBuilder(cancellingHasher{calls: &calls, after: 500, cancel: cancel})
+	b.Workers = 4
+	if _, err := b.BuildConcurrentCtx(ctx, accounts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled build returned %v, want context.Canceled", err)
+	}
+	if total := int64(HashOpCount(5 * len(accounts))); calls.Load() >= total {
+		t.Fatalf("cancelled build still computed all %d hashes", total)
+	}
+
+	if _, err := createMerkleTreeForAccountsConcurrentCtx(ctx, accounts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("build with a cancelled context returned %v, want context.Canceled", err)
+	}
+}
+
+// buildTreeUnbounded builds a tree the way the parallel builder did before it used a worker pool, with one goroutine per pair at every level.
+//
+// It is kept only as the baseline for BenchmarkBuildTreeParallel.
+//
+// Parameters:
+//   - nodes: the leaf nodes of the tree
+//
+// Returns:
+//   the root node of the tree
+func buildTreeUnbounded(nodes []*MerkleNode) *MerkleNode {
+	acc := hashAccumulator{hasher: SHA256Hasher{}}
+	for len(nodes) > 1 {
+		nextLevel := make([]*MerkleNode, (len(nodes)+1)/2)
+		var wg sync.WaitGroup
+		for k := range nextLevel {
+			wg.Add(1)
+			go func(k int) {
+				defer wg.Done()
+				var right *MerkleNode
+				if 2*k+1 < len(nodes) {
+					right = nodes[2*k+1]
+				}
+				nextLevel[k] = acc.Combine(nodes[2*k], right)
+			}(k)
+		}
+		wg.Wait()
+		nodes = nextLevel
+	}
+	return nodes[0]
+}
+
+// BenchmarkBuildTreeParallel compares the bounded worker pool with one goroutine per pair on a million leaves.
+//
+// Parameters:
+//   - b: the benchmark context
+//
+// Returns:
+//   None
+func BenchmarkBuildTreeParallel(b *testing.B) {
+	leaves := make([]*MerkleNode, 1<<20)
+	for i := range leaves {
+		leaves[i] = &MerkleNode{Hash: hashLeaf(SHA256Hasher{}, []byte(strconv.Itoa(i)))}
+	}
+	builder := NewTreeBuilder(nil)
+	bounded, err := builder.buildTreeParallel(context.Background(), leaves)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if buildTreeUnbounded(leaves).Hash != bounded.Hash {
+		b.Fatal("bounded and unbounded roots differ")
+	}
+
+	b.Run("unbounded", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buildTreeUnbounded(leaves)
+		}
+	})
+	b.Run("bounded", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := builder.buildTreeParallel(context.Background(), leaves); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestEmptyTreeRoot checks that an empty account slice and accounts without balances both give the canonical empty root rather than nil.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestEmptyTreeRoot(t *testing.T) {
+	want := sha256.Sum256(nil)
+	inputs := map[string][]Account{
+		"nil":            nil,
+		"empty slice":    {},
+		"empty balances": {{Identifier: "a"}, {Identifier: "b", Balances: []Balance{}}},
+	}
+	for name, accounts := range inputs {
+		for _, build := range []func([]Account) (*MerkleNode, error){createMerkleTreeForAccounts, createMerkleTreeForAccountsConcurrent} {
+			root, err := build(accounts)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if root == nil || root.Hash != want {
+				t.Fatalf("%s: root %v, want the SHA-256 of empty input", name, root)
+			}
+		}
+	}
+}
+
+// TestIncrementalTree checks that the root after every append equals a full rebuild over the same balances in the same order.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestIncrementalTree(t *testing.T) {
+	accounts := exampleAccounts(14)
+	entries := flattenBalances(accounts)
+
+	tree := NewIncrementalTree(nil)
+	if tree.Root() != sha256.Sum256(nil) {
+		t.Fatal("empty incremental tree does not have the empty root")
+	}
+	for n, entry := range entries {
+		if err := tree.Append(entry.balance); err != nil {
+			t.Fatal(err)
+		}
+		want := buildTree(exampleLeafNodes(t, entries[:n+1]))
+		if got := tree.Root(); got != want.Hash {
+			t.Fatalf("after %d appends: root %x, want %x", n+1, got, want.Hash)
+		}
+	}
+
+	full, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Root() != full.Hash {
+		t.Fatalf("incremental root %x, want %x", tree.Root(), full.Hash)
+	}
+
+	if err := tree.Append(Balance{Asset: "BTC", Balance: -1}); !errors.Is(err, ErrNegativeBalance) {
+		t.Fatalf("negative append returned %v, want ErrNegativeBalance", err)
+	}
+	err = tree.Append(Balance{Asset: "BTC", Balance: 1, Sign: "owed"})
+	if !errors.Is(err, ErrInvalidSign) || !strings.Contains(err.Error(), "leaf "+strconv.Itoa(len(entries))) {
+		t.Fatalf("unknown sign returned %v, want ErrInvalidSign naming leaf %d", err, len(entries))
+	}
+}
+
+// TestNegativeBalances checks that every constructor rejects a negative balance by default, naming the account and asset, and accepts it with AllowNegative.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestNegativeBalances(t *testing.T) {
+	accounts := exampleAccounts(4)
+	accounts[2].Balances[3].Balance = -0.25
+
+	builds := map[string]func(*TreeBuilder) error{
+		"Build": func(b *TreeBuilder) error {
+			_, err := b.Build(accounts)
+			return err
+		},
+		"BuildConcurrent": func(b *TreeBuilder) error {
+			_, err := b.BuildConcurrent(accounts)
+			return err
+		},
+		"BuildByAccount": func(b *TreeBuilder) error {
+			_, err := b.BuildByAccount(accounts)
+			return err
+		},
+		"BuildFixed": func(b *TreeBuilder) error {
+			_, err := b.BuildFixed([]FixedAccount{{Identifier: "user3", Balances: []FixedBalance{{Asset: "XRP", Amount: -25, Decimals: 2}}}})
+			return err
+		},
+	}
+	for name, build := range builds {
+		err := build(NewTreeBuilder(nil))
+		if !errors.Is(err, ErrNegativeBalance) {
+			t.Errorf("%s: got %v, want ErrNegativeBalance", name, err)
+		} else if !strings.Contains(err.Error(), "user3") || !strings.Contains(err.Error(), "XRP") {
+			t.Errorf("%s: error %q does not name the account and asset", name, err)
+		}
+
+		allowing := NewTreeBuilder(nil)
+		allowing.AllowNegative = true
+		if err := build(allowing); err != nil {
+			t.Errorf("%s with AllowNegative: %v", name, err)
+		}
+	}
+
+	incremental := NewIncrementalTree(nil)
+	sparse := NewSparseTree(nil)
+	negative := Balance{Asset: "BTC", Balance: -1}
+	if err := incremental.Append(negative); !errors.Is(err, ErrNegativeBalance) {
+		t.Errorf("IncrementalTree: got %v, want ErrNegativeBalance", err)
+	}
+	if err := sparse.Update("a", negative); !errors.Is(err, ErrNegativeBalance) {
+		t.Errorf("SparseTree: got %v, want ErrNegativeBalance", err)
+	}
+	incremental.AllowNegative, sparse.AllowNegative = true, true
+	if err := incremental.Append(negative); err != nil {
+		t.Errorf("IncrementalTree with AllowNegative: %v", err)
+	}
+	if err := sparse.Update("a", negative); err != nil {
+		t.Errorf("SparseTree with AllowNegative: %v", err)
+	}
+}
+
+// TestFixedBalanceRoots checks that integer balances give the same root however the amount was arrived at, while float balances do not.
+//
+// Two servers that compute the same 0.3 BTC as 0.1+0.2 and as 0.3 commit to different float64 values, and so to different roots, while the integer amounts 10+20 and 30 are the same value.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestFixedBalanceRoots(t *testing.T) {
+	a, b := 0.1, 0.2
+	summed := []Account{{Identifier: "u", Balances: []Balance{{Asset: "BTC", Balance: a + b}}}}
+	direct := []Account{{Identifier: "u", Balances: []Balance{{Asset: "BTC", Balance: 0.3}}}}
+	floatSummed, err := createMerkleTreeForAccounts(summed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	floatDirect, err := createMerkleTreeForAccounts(direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if floatSummed.Hash == floatDirect.Hash {
+		t.Fatal("0.1+0.2 and 0.3 give the same float root")
+	}
+
+	var want [32]byte
+	for run, amount := range []int64{10 + 20, 30, 15 * 2} {
+		root, err := createMerkleTreeForFixedAccounts([]FixedAccount{{Identifier: "u", Balances: []FixedBalance{{Asset: "BTC", Amount: amount, Decimals: 2}}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run == 0 {
+			want = root.Hash
+		} else if root.Hash != want {
+			t.Fatalf("run %d: integer root %x, want %x", run, root.Hash, want)
+		}
+	}
+
+	other, err := createMerkleTreeForFixedAccounts([]FixedAccount{{Identifier: "u", Balances: []FixedBalance{{Asset: "BTC", Amount: 30, Decimals: 3}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Hash == want {
+		t.Fatal("different decimals give the same integer root")
+	}
+}
+
+// TestDepthAndLeafCount checks Depth and LeafCount on trees of 1, 2, 3 and 1000 leaves, where the odd counts carry a node up, and on a nil node.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestDepthAndLeafCount(t *testing.T) {
+	for _, tc := range []struct{ leaves, depth int }{{1, 1}, {2, 2}, {3, 3}, {1000, 11}} {
+		leaves := make([]*MerkleNode, tc.leaves)
+		for i := range leaves {
+			leaves[i] = &MerkleNode{Hash: hashLeaf(SHA256Hasher{}, []byte(strconv.Itoa(i)))}
+		}
+		root := buildTree(leaves)
+		if got := root.Depth(); got != tc.depth {
+			t.Errorf("%d leaves: depth %d, want %d", tc.leaves, got, tc.depth)
+		}
+		if got := root.LeafCount(); got != tc.leaves {
+			t.Errorf("%d leaves: leaf count %d, want %d", tc.leaves, got, tc.leaves)
+		}
+	}
+
+	var nilNode *MerkleNode
+	if nilNode.Depth() != 0 || nilNode.LeafCount() != 0 {
+		t.Fatalf("nil node: depth %d, leaf count %d", nilNode.Depth(), nilNode.LeafCount())
+	}
+}
+
+// TestDiffTrees checks that changing one balance out of 1000 reports exactly that leaf, at its position, with its old and new hashes.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestDiffTrees(t *testing.T) {
+	accounts := exampleAccounts(200)
+	before, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLeaves := before.Leaves()
+
+	accounts[123].Balances[2].Balance += 1
+	after, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLeaves := after.Leaves()
+
+	diffs := DiffTrees(before, after)
+	if len(diffs) != 1 {
+		t.Fatalf("got %d diffs, want 1", len(diffs))
+	}
+	d := diffs[0]
+	if string(d.Old) != string(oldLeaves[d.Index]) || string(d.New) != string(newLeaves[d.Index]) || string(d.Old) == string(d.New) {
+		t.Fatalf("diff at %d does not hold the old and new leaf hashes", d.Index)
+	}
+	for i := range oldLeaves {
+		if i != d.Index && string(oldLeaves[i]) != string(newLeaves[i]) {
+			t.Fatalf("leaf %d changed but was not reported", i)
+		}
+	}
+
+	if diffs := DiffTrees(before, before); len(diffs) != 0 {
+		t.Fatalf("identical trees: %d diffs", len(diffs))
+	}
+}
+
+// TestMultiProof checks that a multiproof for 10 of 1000 leaves verifies and is smaller than the 10 individual proofs, and that one-child nodes are handled.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestMultiProof(t *testing.T) {
+	root, err := createMerkleTreeForAccounts(exampleAccounts(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := root.Leaves()
+
+	var chosen [][32]byte
+	individual := 0
+	for _, i := range []int{3, 97, 98, 250, 401, 512, 640, 777, 900, 999} {
+		var leaf [32]byte
+		copy(leaf[:], leaves[i])
+		chosen = append(chosen, leaf)
+		proof, err := GenerateProof(root, leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		individual += 32 * (1 + len(proof))
+	}
+
+	proof, err := GenerateMultiProof(root, chosen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyMultiProof(proof, root.Hash) {
+		t.Fatal("multiproof does not verify")
+	}
+	if size := 32*(len(proof.Leaves)+len(proof.Hashes)) + len(proof.Flags); size >= individual {
+		t.Fatalf("multiproof is %d bytes, individual proofs are %d", size, individual)
+	}
+
+	proof.Hashes[0][0] ^= 1
+	if VerifyMultiProof(proof, root.Hash) {
+		t.Fatal("multiproof verifies with a flipped hash")
+	}
+
+	var lopsided MerkleNode
+	data, err := json.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &lopsided); err != nil {
+		t.Fatal(err)
+	}
+	lopsided.Right.Right = nil
+	if _, err := GenerateMultiProof(&lopsided, chosen); !errors.Is(err, ErrLeafNotFound) {
+		t.Fatalf("leaves below a one-child node: got %v, want ErrLeafNotFound", err)
+	}
+	if _, err := GenerateMultiProof(&lopsided, chosen[:2]); err != nil {
+		t.Fatalf("leaves outside the one-child node: %v", err)
+	}
+}
+
+// TestOverCapacityLeaves checks that leaves backed by slices with spare capacity give the same root on every build and are never written to.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestOverCapacityLeaves(t *testing.T) {
+	backing := make([]byte, 0, 4096)
+	var leaves, tight [][]byte
+	for i := 0; i < 37; i++ {
+		start := len(backing)
+		backing = append(backing, "leaf-"+strconv.Itoa(i)...)
+		leaves = append(leaves, backing[start:len(backing):cap(backing)])
+		tight = append(tight, []byte("leaf-"+strconv.Itoa(i)))
+	}
+	snapshot := bytes.Clone(backing[:cap(backing)])
+
+	want := BuildTreeFromLeafBytes(tight).Hash
+	for i := 0; i < 5; i++ {
+		if got := BuildTreeFromLeafBytes(leaves).Hash; got != want {
+			t.Fatalf("build %d: root %x, want %x", i, got, want)
+		}
+	}
+	if !bytes.Equal(backing[:cap(backing)], snapshot) {
+		t.Fatal("building wrote into the leaves' backing array")
+	}
+}
+
+// TestMixedSignProofs checks that a tree mixing credits and debits nets them per asset, and that a proof commits to the sign of its balance.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestMixedSignProofs(t *testing.T) {
+	accounts := []Account{
+		{Identifier: "alice", Balances: []Balance{{Asset: "BTC", Balance: 5}, {Asset: "ETH", Balance: 2, Sign: Debit}}},
+		{Identifier: "bob", Balances: []Balance{{Asset: "BTC", Balance: 1.5, Sign: Debit}, {Asset: "ETH", Balance: 7}}},
+		{Identifier: "carol", Balances: []Balance{{Asset: "ETH", Balance: 1}}},
+	}
+	totals, err := SumByAsset(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totals["BTC"] != 3.5 || totals["ETH"] != 6 {
+		t.Fatalf("net totals %v, want BTC 3.5 and ETH 6", totals)
+	}
+
+	root, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewTreeBuilder(nil)
+	debit := Balance{Asset: "BTC", Balance: 1.5, Sign: Debit}
+	leaf, err := b.hashBalance(accountBalance{identifier: "bob", balance: debit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := GenerateProof(root, leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyProof(leaf, proof, root.Hash) {
+		t.Fatal("debit proof does not verify")
+	}
+
+	debit.Sign = Credit
+	credit, err := b.hashBalance(accountBalance{identifier: "bob", balance: debit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifyProof(credit, proof, root.Hash) {
+		t.Fatal("debit proof verifies for the same amount as a credit")
+	}
+}
+
+// TestProofJSONRoundTrip checks that proofs and trees encode hashes as lowercase hex and still verify after a JSON round trip.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestProofJSONRoundTrip(t *testing.T) {
+	accounts := exampleAccounts(20)
+	root, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := exampleTreeLeaves(t, accounts)[42]
+	proof, err := GenerateProof(root, leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"hash":"`+hex.EncodeToString(proof[0].Hash[:])+`"`) {
+		t.Fatalf("proof JSON %s does not carry lowercase hex hashes", data)
+	}
+	var decoded []ProofStep
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(proof) {
+		t.Fatalf("decoded %d steps, want %d", len(decoded), len(proof))
+	}
+	for i := range proof {
+		if decoded[i] != proof[i] {
+			t.Fatalf("step %d: decoded %+v, want %+v", i, decoded[i], proof[i])
+		}
+	}
+	if !VerifyProof(leaf, decoded, root.Hash) {
+		t.Fatal("decoded proof does not verify")
+	}
+
+	data, err = json.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tree MerkleNode
+	if err := json.Unmarshal(data, &tree); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Hash != root.Hash || tree.LeafCount() != root.LeafCount() {
+		t.Fatalf("decoded tree has root %x and %d leaves, want %x and %d", tree.Hash, tree.LeafCount(), root.Hash, root.LeafCount())
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal([]byte(`[{"hash":"abcd","isLeft":true}]`), &decoded); err == nil {
+		t.Fatal("a short hash decoded without error")
+	}
+}
+
+// TestValidate checks that Validate accepts a built tree and reports the path of a tampered internal node or a node with one child.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestValidate(t *testing.T) {
+	root, err := createMerkleTreeForAccounts(exampleAccounts(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	root.Left.Right.Hash[0] ^= 1
+	err = root.Validate()
+	if err == nil || !strings.Contains(err.Error(), `path "LR"`) {
+		t.Fatalf("tampered node: got %v, want an error at path LR", err)
+	}
+	root.Left.Right.Hash[0] ^= 1
+
+	root.Hash[31] ^= 1
+	if err := root.Validate(); err == nil || !strings.Contains(err.Error(), `path ""`) {
+		t.Fatalf("tampered root: got %v, want an error at the root", err)
+	}
+	root.Hash[31] ^= 1
+
+	right := root.Right.Right
+	root.Right.Right = nil
+	if err := root.Validate(); err == nil || !strings.Contains(err.Error(), "only one child") {
+		t.Fatalf("one-child node: got %v, want a one-child error", err)
+	}
+	root.Right.Right = right
+
+	leaf := root
+	for leaf.Left != nil {
+		leaf = leaf.Left
+	}
+	leaf.Hash[0] ^= 1
+	if err := root.Validate(); err == nil || !strings.Contains(err.Error(), `path "L`) {
+		t.Fatalf("tampered leaf: got %v, want its parent reported", err)
+	}
+}
+
+// TestSparseTree checks inclusion and non-inclusion proofs against the same sparse tree root.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestSparseTree(t *testing.T) {
+	tree := NewSparseTree(nil)
+	empty := tree.Root()
+	balances := map[string]Balance{
+		"alice": {Asset: "BTC", Balance: 1.25},
+		"bob":   {Asset: "ETH", Balance: 30},
+		"carol": {Asset: "BTC", Balance: 0.5, Sign: Debit},
+	}
+	for id, balance := range balances {
+		if err := tree.Update(id, balance); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := tree.Root()
+	if root == empty {
+		t.Fatal("root did not change after updates")
+	}
+
+	for id, balance := range balances {
+		proof, err := tree.ProveInclusion(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !VerifySparseInclusion(root, id, balance, proof) {
+			t.Fatalf("inclusion proof for %s does not verify", id)
+		}
+		if VerifySparseNonInclusion(root, id, proof) {
+			t.Fatalf("non-inclusion verifies for included account %s", id)
+		}
+		if _, err := tree.ProveNonInclusion(id); err == nil {
+			t.Fatalf("ProveNonInclusion succeeded for included account %s", id)
+		}
+	}
+
+	proof, err := tree.ProveNonInclusion("mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifySparseNonInclusion(root, "mallory", proof) {
+		t.Fatal("non-inclusion proof does not verify")
+	}
+	if VerifySparseInclusion(root, "mallory", Balance{Asset: "BTC", Balance: 1}, proof) {
+		t.Fatal("non-inclusion proof verifies as an inclusion proof")
+	}
+	if _, err := tree.ProveInclusion("mallory"); !errors.Is(err, ErrLeafNotFound) {
+		t.Fatalf("ProveInclusion for a missing account: got %v, want ErrLeafNotFound", err)
+	}
+
+	bob, err := tree.ProveInclusion("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifySparseInclusion(root, "bob", Balance{Asset: "ETH", Balance: 31}, bob) {
+		t.Fatal("inclusion proof verifies for a different balance")
+	}
+	if err := tree.Update("dave", Balance{Asset: "BTC", Balance: -1}); !errors.Is(err, ErrNegativeBalance) {
+		t.Fatalf("negative balance: got %v, want ErrNegativeBalance", err)
+	}
+	if tree.Root() != root {
+		t.Fatal("rejected update changed the root")
+	}
+}
+
+// TestProgressCompletes checks that every builder's last progress report has processed equal to total, with and without root extras.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestProgressCompletes(t *testing.T) {
+	accounts := exampleAccounts(300)
+	fixed := []FixedAccount{{Identifier: "u", Balances: []FixedBalance{{Asset: "BTC", Amount: 30, Decimals: 1}, {Asset: "ETH", Amount: 7}}}}
+	leaves := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	nonces := make(map[string][]byte, len(accounts))
+	for _, account := range accounts {
+		nonces[account.Identifier] = []byte("nonce-" + account.Identifier)
+	}
+	builds := map[string]func(*TreeBuilder) error{
+		"Build":              func(b *TreeBuilder) error { _, err := b.Build(accounts); return err },
+		"BuildPadded":        func(b *TreeBuilder) error { _, err := b.BuildPadded(accounts); return err },
+		"BuildFromLeafBytes": func(b *TreeBuilder) error { b.BuildFromLeafBytes(leaves); return nil },
+		"BuildWithTotals":    func(b *TreeBuilder) error { _, _, err := b.BuildWithTotals(accounts); return err },
+		"BuildWithMetadata":  func(b *TreeBuilder) error { _, err := b.BuildWithMetadata(accounts, TreeMetadata{}); return err },
+		"BuildConcurrent":    func(b *TreeBuilder) error { _, err := b.BuildConcurrent(accounts); return err },
+		"BuildByAccount":     func(b *TreeBuilder) error { _, err := b.BuildByAccount(accounts); return err },
+		"BuildWithNonces":    func(b *TreeBuilder) error { _, err := b.BuildWithNonces(accounts, nonces); return err },
+		"BuildTwoLevel":      func(b *TreeBuilder) error { _, err := b.BuildTwoLevel(accounts); return err },
+		"BuildPerAsset":      func(b *TreeBuilder) error { _, _, err := b.BuildPerAsset(accounts); return err },
+		"BuildFixed":         func(b *TreeBuilder) error { _, err := b.BuildFixed(fixed); return err },
+	}
+
+	for name, build := range builds {
+		for _, extras := range []bool{false, true} {
+			var (
+				mu                  sync.Mutex
+				calls               int
+				lastDone, lastTotal int
+			)
+			b := NewTreeBuilder(nil)
+			b.Workers = 4
+			if extras {
+				b.PolicyHash = []byte("policy")
+				b.ReserveAddresses = []string{"bc1q-a", "bc1q-b", "bc1q-c"}
+			}
+			b.Progress = func(processed, total int) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+				lastDone, lastTotal = processed, total
+			}
+			if err := build(b); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if calls == 0 || lastDone != lastTotal {
+				t.Errorf("%s (extras %v): %d calls, last report %d of %d", name, extras, calls, lastDone, lastTotal)
+			}
+		}
+	}
+}
+
+// TestFindAccountLeaf checks that user500 is found in a 1000-account tree by identifier and that unknown identifiers give nil.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestFindAccountLeaf(t *testing.T) {
+	accounts := exampleAccounts(1000)
+	root, err := createMerkleTreeByAccount(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := FindAccountLeaf(root, accounts, "user500")
+	if leaf == nil {
+		t.Fatal("user500 not found")
+	}
+	if leaf.Left != nil || leaf.Right != nil {
+		t.Fatal("FindAccountLeaf returned an internal node")
+	}
+	proof, err := GenerateProof(root, leaf.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyProof(leaf.Hash, proof, root.Hash) {
+		t.Fatal("proof for user500 does not verify")
+	}
+	if other := FindAccountLeaf(root, accounts, "user501"); other == nil || other.Hash == leaf.Hash {
+		t.Fatal("user501 not found or has user500's leaf")
+	}
+
+	if FindAccountLeaf(root, accounts, "nobody") != nil {
+		t.Fatal("found a leaf for an unknown identifier")
+	}
+	if FindAccountLeaf(root, accounts[:10], "user500") != nil {
+		t.Fatal("found a leaf for an account missing from the list")
+	}
+	if FindLeaf(root, func(*MerkleNode) bool { return false }) != nil {
+		t.Fatal("FindLeaf matched with a predicate that never matches")
+	}
+	if FindLeaf(nil, func(*MerkleNode) bool { return true }) != nil {
+		t.Fatal("FindLeaf matched in a nil tree")
+	}
+}
+
+// TestCanonicalBalanceJCS checks balance leaf encodings against RFC 8785 vectors for numbers, strings and key order.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestCanonicalBalanceJCS(t *testing.T) {
+	numbers := map[uint64]string{
+		0x0000000000000000: "0",
+		0x8000000000000000: "0",
+		0x0000000000000001: "5e-324",
+		0x7fefffffffffffff: "1.7976931348623157e+308",
+		0x4340000000000000: "9007199254740992",
+		0x4430000000000000: "295147905179352830000",
+		0x44b52d02c7e14af5: "9.999999999999997e+22",
+		0x44b52d02c7e14af6: "1e+23",
+		0x444b1ae4d6e2ef4f: "999999999999999900000",
+		0x444b1ae4d6e2ef50: "1e+21",
+		0x3eb0c6f7a0b5ed8c: "9.999999999999997e-7",
+		0x3eb0c6f7a0b5ed8d: "0.000001",
+		0x41b3de4355555554: "333333333.33333325",
+		0x41b3de4355555555: "333333333.3333333",
+		0x43143ff3c1cb0959: "1424953923781206.2",
+	}
+	for bits, number := range numbers {
+		balance := Balance{Asset: "BTC", Balance: math.Float64frombits(bits)}
+		want := `{"asset":"BTC","balance":` + number + `}`
+		got, err := appendCanonicalBalance(nil, balance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%016x: got %s, want %s", bits, got, want)
+		}
+		generic, err := marshalCanonical(balance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(generic) != want {
+			t.Errorf("%016x: marshalCanonical gave %s, want %s", bits, generic, want)
+		}
+	}
+
+	balance := Balance{Asset: "€$\u000f\nA'B\"\\\\\"/<>&", Balance: 1.5, Sign: Debit}
+	want := `{"asset":"€$\u000f\nA'B\"\\\\\"/<>&","balance":1.5,"sign":"debit"}`
+	for name, encode := range map[string]func(Balance) ([]byte, error){
+		"appendCanonicalBalance": func(b Balance) ([]byte, error) { return appendCanonicalBalance(nil, b) },
+		"marshalCanonical":       func(b Balance) ([]byte, error) { return marshalCanonical(b) },
+	} {
+		got, err := encode(balance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+
+	if _, err := appendCanonicalBalance(nil, Balance{Asset: "BTC", Balance: math.NaN()}); err == nil {
+		t.Error("NaN encoded without error")
+	}
+}
+
+// TestLeavesRoundTrip checks that Leaves returns each leaf once in construction order and that rebuilding from them reproduces the root.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestLeavesRoundTrip(t *testing.T) {
+	for _, count := range []int{1, 2, 3, 5, 7, 12, 33} {
+		data := make([][]byte, count)
+		for i := range data {
+			data[i] = []byte("leaf-" + strconv.Itoa(i))
+		}
+		root := BuildTreeFromLeafBytes(data)
+		leaves := root.Leaves()
+		if len(leaves) != count {
+			t.Fatalf("%d leaves: Leaves returned %d", count, len(leaves))
+		}
+
+		nodes := make([]*MerkleNode, len(leaves))
+		for i, leaf := range leaves {
+			nodes[i] = &MerkleNode{}
+			copy(nodes[i].Hash[:], leaf)
+		}
+		if rebuilt := buildTree(nodes); rebuilt.Hash != root.Hash {
+			t.Fatalf("%d leaves: rebuilt root %x, want %x", count, rebuilt.Hash, root.Hash)
+		}
+	}
+
+	accounts := exampleAccounts(7)
+	root, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := root.Leaves()
+	for i, want := range exampleTreeLeaves(t, accounts) {
+		if !bytes.Equal(leaves[i], want[:]) {
+			t.Fatalf("leaf %d: got %x, want %x", i, leaves[i], want)
+		}
+	}
+
+	leaves[0][0] ^= 1
+	if root.Leaves()[0][0] == leaves[0][0] {
+		t.Fatal("Leaves returned slices that alias the tree's hashes")
+	}
+	if (*MerkleNode)(nil).Leaves() != nil {
+		t.Fatal("nil tree returned leaves")
+	}
+}
+
+// FuzzVerifyProofStream checks streamed proofs over trees of random size with a random bit flipped.
+//
+// The untouched proof must verify from the stream alone, flipping any bit of the leaf or of a proof hash must make it fail, and arbitrary stream bytes must give the same answer as decoding them and calling VerifyProof.
+//
+// Parameters:
+//   - f: the fuzzing context
+//
+// Returns:
+//   None
+func FuzzVerifyProofStream(f *testing.F) {
+	f.Add(uint16(1), uint16(0), uint16(0), []byte(`[]`))
+	f.Add(uint16(5), uint16(4), uint16(3), []byte(`[{"hash":"00","isLeft":true}]`))
+	f.Add(uint16(64), uint16(17), uint16(700), []byte(`{}`))
+	f.Add(uint16(300), uint16(299), uint16(2000), []byte(`[`))
+
+	f.Fuzz(func(t *testing.T, count, index, flip uint16, stream []byte) {
+		count = count%300 + 1
+		index %= count
+		leaves := make([][]byte, count)
+		for i := range leaves {
+			leaves[i] = []byte("leaf-" + strconv.Itoa(i))
+		}
+		root := BuildTreeFromLeafBytes(leaves)
+		var leaf [32]byte
+		copy(leaf[:], root.Leaves()[index])
+		proof, err := GenerateProof(root, leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := json.Marshal(proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := VerifyProofStream(leaf, bytes.NewReader(data), root.Hash); err != nil || !ok {
+			t.Fatalf("%d leaves, leaf %d: streamed proof rejected: %v", count, index, err)
+		}
+
+		bit := int(flip) % (256 * (1 + len(proof)))
+		if bit < 256 {
+			leaf[bit/8] ^= 1 << (bit % 8)
+		} else {
+			bit -= 256
+			proof[bit/256].Hash[bit%256/8] ^= 1 << (bit % 8)
+		}
+		if data, err = json.Marshal(proof); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := VerifyProofStream(leaf, bytes.NewReader(data), root.Hash); err != nil || ok {
+			t.Fatalf("%d leaves, leaf %d: proof with bit %d flipped: ok %v, err %v", count, index, flip, ok, err)
+		}
+
+		ok, err := VerifyProofStream(leaf, bytes.NewReader(stream), root.Hash)
+		var decoded []ProofStep
+		if json.Unmarshal(stream, &decoded) == nil && err == nil && ok != VerifyProof(leaf, decoded, root.Hash) {
+			t.Fatalf("stream %q: VerifyProofStream gave %v, VerifyProof disagrees", stream, ok)
+		}
+	})
+}
+
+// BenchmarkCreateMerkleTreeAuto compares CreateMerkleTreeAuto with the sequential and concurrent builders at 10, 100, 1k and 100k leaves.
+//
+// Auto should track the faster of the two at each size: the sequential builder below ConcurrentThreshold and the concurrent one above it.
+//
+// Parameters:
+//   - b: the benchmark context
+//
+// Returns:
+//   None
+func BenchmarkCreateMerkleTreeAuto(b *testing.B) {
+	builders := []struct {
+		name  string
+		build func([]Account) (*MerkleNode, error)
+	}{
+		{"sequential", createMerkleTreeForAccounts},
+		{"concurrent", createMerkleTreeForAccountsConcurrent},
+		{"auto", CreateMerkleTreeAuto},
+	}
+	for _, leaves := range []int{10, 100, 1000, 100000} {
+		accounts := exampleAccounts(leaves / 5)
+		for _, builder := range builders {
+			b.Run(strconv.Itoa(leaves)+"/"+builder.name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := builder.build(accounts); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestTwoLevelProof checks that one asset of a multi-asset account is proven through its sub-tree without the other balances.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestTwoLevelProof(t *testing.T) {
+	accounts := exampleAccounts(50)
+	root, err := createTwoLevelTree(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := accounts[17]
+	balance := account.Balances[2]
+
+	proof, err := GenerateTwoLevelProof(root, account, balance.Asset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proof.BalanceProof) == 0 || len(proof.AccountProof) == 0 {
+		t.Fatalf("proof has %d balance steps and %d account steps", len(proof.BalanceProof), len(proof.AccountProof))
+	}
+	if !VerifyTwoLevelProof(root.Hash, account.Identifier, balance, proof) {
+		t.Fatal("two-level proof does not verify")
+	}
+
+	changed := balance
+	changed.Balance++
+	if VerifyTwoLevelProof(root.Hash, account.Identifier, changed, proof) {
+		t.Fatal("proof verifies for a different amount")
+	}
+	if VerifyTwoLevelProof(root.Hash, account.Identifier, account.Balances[3], proof) {
+		t.Fatal("proof verifies for another asset of the account")
+	}
+	if VerifyTwoLevelProof(root.Hash, accounts[18].Identifier, balance, proof) {
+		t.Fatal("proof verifies for another account")
+	}
+	if _, err := GenerateTwoLevelProof(root, account, "NOPE"); !errors.Is(err, ErrLeafNotFound) {
+		t.Fatalf("missing asset: got %v, want ErrLeafNotFound", err)
+	}
+}
+
+// TestBuildObserver checks that a recording observer receives the leaf count and depth of each kind of build.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestBuildObserver(t *testing.T) {
+	accounts := []Account{
+		{Identifier: "a", Balances: []Balance{{Asset: "BTC", Balance: 1}, {Asset: "ETH", Balance: 2}}},
+		{Identifier: "b", Balances: []Balance{{Asset: "BTC", Balance: 3}}},
+		{Identifier: "c", Balances: []Balance{{Asset: "BTC", Balance: 4}}},
+		{Identifier: "d", Balances: []Balance{{Asset: "BTC", Balance: 5}}},
+		{Identifier: "e", Balances: []Balance{{Asset: "BTC", Balance: 6}}},
+	}
+	cases := []struct {
+		name          string
+		policy        bool
+		build         func(*TreeBuilder) (*MerkleNode, error)
+		leaves, depth int
+	}{
+		{"Build", false, func(b *TreeBuilder) (*MerkleNode, error) { return b.Build(accounts) }, 6, 4},
+		{"Build with policy", true, func(b *TreeBuilder) (*MerkleNode, error) { return b.Build(accounts) }, 6, 5},
+		{"BuildPadded", false, func(b *TreeBuilder) (*MerkleNode, error) { return b.BuildPadded(accounts) }, 8, 4},
+		{"BuildConcurrent", false, func(b *TreeBuilder) (*MerkleNode, error) { return b.BuildConcurrent(accounts) }, 6, 4},
+		{"BuildByAccount", false, func(b *TreeBuilder) (*MerkleNode, error) { return b.BuildByAccount(accounts) }, 5, 4},
+		{"BuildFromLeafBytes", false, func(b *TreeBuilder) (*MerkleNode, error) {
+			return b.BuildFromLeafBytes([][]byte{[]byte("x"), []byte("y"), []byte("z")}), nil
+		}, 3, 3},
+		{"BuildTwoLevel", false, func(b *TreeBuilder) (*MerkleNode, error) { return b.BuildTwoLevel(accounts) }, 6, 6},
+		{"BuildPerAsset", false, func(b *TreeBuilder) (*MerkleNode, error) {
+			_, root, err := b.BuildPerAsset(accounts)
+			return root, err
+		}, 6, 6},
+	}
+
+	for _, c := range cases {
+		observer := &recordingObserver{}
+		b := NewTreeBuilder(nil)
+		b.Observer = observer
+		if c.policy {
+			b.PolicyHash = []byte("policy")
+		}
+		root, err := c.build(b)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if len(observer.builds) != 1 {
+			t.Fatalf("%s: observed %d builds, want 1", c.name, len(observer.builds))
+		}
+		got := observer.builds[0]
+		if got.leaves != c.leaves || got.depth != c.depth || got.duration < 0 {
+			t.Errorf("%s: observed %d leaves, depth %d, duration %v; want %d leaves, depth %d", c.name, got.leaves, got.depth, got.duration, c.leaves, c.depth)
+		}
+		if c.name != "BuildTwoLevel" && c.name != "BuildPerAsset" && got.depth != root.Depth() {
+			t.Errorf("%s: observed depth %d, tree depth %d", c.name, got.depth, root.Depth())
+		}
+	}
+}
+
+// TestDuplicateAccounts checks that repeated identifiers are rejected and listed, and that AllowDuplicates builds them.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestDuplicateAccounts(t *testing.T) {
+	accounts := []Account{
+		{Identifier: "b", Balances: []Balance{{Asset: "BTC", Balance: 1}}},
+		{Identifier: "a", Balances: []Balance{{Asset: "BTC", Balance: 2}}},
+		{Identifier: "c", Balances: []Balance{{Asset: "ETH", Balance: 3}}},
+		{Identifier: "a", Balances: []Balance{{Asset: "ETH", Balance: 4}}},
+		{Identifier: "b", Balances: []Balance{{Asset: "ETH", Balance: 5}}},
+		{Identifier: "b", Balances: []Balance{{Asset: "SOL", Balance: 6}}},
+	}
+	fixed := []FixedAccount{
+		{Identifier: "a", Balances: []FixedBalance{{Asset: "BTC", Amount: 1}}},
+		{Identifier: "a", Balances: []FixedBalance{{Asset: "ETH", Amount: 2}}},
+	}
+
+	b := NewTreeBuilder(nil)
+	builds := map[string]func() error{
+		"Build":          func() error { _, err := b.Build(accounts); return err },
+		"BuildByAccount": func() error { _, err := b.BuildByAccount(accounts); return err },
+		"BuildTwoLevel":  func() error { _, err := b.BuildTwoLevel(accounts); return err },
+		"BuildFixed":     func() error { _, err := b.BuildFixed(fixed); return err },
+	}
+	for name, build := range builds {
+		err := build()
+		if !errors.Is(err, ErrDuplicateAccount) {
+			t.Fatalf("%s: got %v, want ErrDuplicateAccount", name, err)
+		}
+		if name != "BuildFixed" && !strings.HasSuffix(err.Error(), ": a, b") {
+			t.Errorf("%s: error %q does not list a and b once each", name, err)
+		}
+	}
+
+	b.AllowDuplicates = true
+	for name, build := range builds {
+		if err := build(); err != nil {
+			t.Errorf("%s with AllowDuplicates: %v", name, err)
+		}
+	}
+}
+
+// TestUpdateLeaf checks that updating one balance's leaf gives the same root as a full rebuild, both copying the path and in place.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestUpdateLeaf(t *testing.T) {
+	accounts := exampleAccounts(33)
+	root, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := root.Hash
+
+	b := NewTreeBuilder(nil)
+	old := accounts[20].Balances[3]
+	oldLeaf, err := b.hashBalance(accountBalance{identifier: accounts[20].Identifier, balance: old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := old
+	changed.Balance += 0.5
+	newLeaf, err := b.hashBalance(accountBalance{identifier: accounts[20].Identifier, balance: changed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updatedAccounts := make([]Account, len(accounts))
+	copy(updatedAccounts, accounts)
+	updatedAccounts[20].Balances = append([]Balance(nil), accounts[20].Balances...)
+	updatedAccounts[20].Balances[3] = changed
+	rebuilt, err := createMerkleTreeForAccounts(updatedAccounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := root.UpdateLeaf(oldLeaf, newLeaf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.Hash != rebuilt.Hash {
+		t.Fatalf("copy-on-path root %x, rebuilt root %x", copied.Hash, rebuilt.Hash)
+	}
+	if root.Hash != original || root.Validate() != nil {
+		t.Fatal("copy-on-path update changed the original tree")
+	}
+	if err := copied.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	inPlace, err := root.UpdateLeaf(oldLeaf, newLeaf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inPlace != root || root.Hash != rebuilt.Hash {
+		t.Fatalf("in-place update returned a new root or root %x, want %x", root.Hash, rebuilt.Hash)
+	}
+
+	if _, err := root.UpdateLeaf(oldLeaf, newLeaf, false); !errors.Is(err, ErrLeafNotFound) {
+		t.Fatalf("replaced leaf: got %v, want ErrLeafNotFound", err)
+	}
+	if _, err := (*MerkleNode)(nil).UpdateLeaf(oldLeaf, newLeaf, false); !errors.Is(err, ErrEmptyTree) {
+		t.Fatalf("nil tree: got %v, want ErrEmptyTree", err)
+	}
+}
+
+// TestSentinelErrors checks that errors.Is matches the sentinel error for each failure scenario, through the context each error is wrapped in.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestSentinelErrors(t *testing.T) {
+	accounts := exampleAccounts(4)
+	root, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, superRoot, err := createPerAssetTrees(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	negative := []Account{{Identifier: "a", Balances: []Balance{{Asset: "BTC", Balance: -1}}}}
+	duplicate := []Account{{Identifier: "a"}, {Identifier: "a"}}
+	var missing [32]byte
+
+	cases := []struct {
+		name string
+		err  func() error
+		want error
+	}{
+		{"negative Build", func() error { _, err := createMerkleTreeForAccounts(negative); return err }, ErrNegativeBalance},
+		{"negative BuildConcurrent", func() error { _, err := createMerkleTreeForAccountsConcurrent(negative); return err }, ErrNegativeBalance},
+		{"negative BuildFixed", func() error {
+			_, err := createMerkleTreeForFixedAccounts([]FixedAccount{{Identifier: "a", Balances: []FixedBalance{{Asset: "BTC", Amount: -1}}}})
+			return err
+		}, ErrNegativeBalance},
+		{"negative IncrementalTree", func() error { return NewIncrementalTree(nil).Append(Balance{Asset: "BTC", Balance: -1}) }, ErrNegativeBalance},
+		{"duplicate Build", func() error { _, err := createMerkleTreeForAccounts(duplicate); return err }, ErrDuplicateAccount},
+		{"duplicate BuildConcurrent", func() error { _, err := createMerkleTreeForAccountsConcurrent(duplicate); return err }, ErrDuplicateAccount},
+		{"missing GenerateProof", func() error { _, err := GenerateProof(root, missing); return err }, ErrLeafNotFound},
+		{"missing UpdateLeaf", func() error { _, err := root.UpdateLeaf(missing, missing, false); return err }, ErrLeafNotFound},
+		{"missing GenerateMultiProof", func() error { _, err := GenerateMultiProof(root, [][32]byte{missing}); return err }, ErrLeafNotFound},
+		{"missing GenerateTwoLevelProof", func() error {
+			_, err := GenerateTwoLevelProof(root, accounts[0], "NOPE")
+			return err
+		}, ErrLeafNotFound},
+		{"missing GeneratePerAssetProof", func() error {
+			_, err := GeneratePerAssetProof(roots, superRoot, accounts[0], "NOPE")
+			return err
+		}, ErrLeafNotFound},
+		{"empty GenerateProof", func() error { _, err := GenerateProof(nil, missing); return err }, ErrEmptyTree},
+		{"empty GenerateMultiProof", func() error { _, err := GenerateMultiProof(nil, nil); return err }, ErrEmptyTree},
+		{"empty UpdateLeaf", func() error { _, err := (*MerkleNode)(nil).UpdateLeaf(missing, missing, false); return err }, ErrEmptyTree},
+		{"count VerifyRootWithCount", func() error { _, err := VerifyRootWithCount(accounts, root.RootHex(), 1); return err }, ErrLeafCount},
+		{"empty SnapshotStore", func() error { _, err := NewSnapshotStore().ProofAt(time.Now(), "user1"); return err }, ErrNoSnapshot},
+	}
+	for _, c := range cases {
+		if err := c.err(); !errors.Is(err, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+// TestMetadataTimestamps checks that identical balances built at different timestamps give different roots and that each root proves only its own metadata.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestMetadataTimestamps(t *testing.T) {
+	accounts := exampleAccounts(9)
+	first := TreeMetadata{Timestamp: 1760000000, Version: 2, Label: "weekly"}
+	second := first
+	second.Timestamp++
+
+	firstRoot, err := createMerkleTreeWithMetadata(accounts, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondRoot, err := createMerkleTreeWithMetadata(accounts, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstRoot.Hash == secondRoot.Hash {
+		t.Fatal("builds one second apart have the same root")
+	}
+	plain, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Hash == firstRoot.Hash {
+		t.Fatal("metadata did not change the root")
+	}
+
+	proof, err := GenerateMetadataProof(firstRoot, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyMetadata(firstRoot.Hash, first, proof) {
+		t.Fatal("metadata proof does not verify")
+	}
+	if VerifyMetadata(firstRoot.Hash, second, proof) {
+		t.Fatal("proof verifies with the other timestamp")
+	}
+	if _, err := GenerateMetadataProof(secondRoot, first); !errors.Is(err, ErrLeafNotFound) {
+		t.Fatalf("other tree's metadata: got %v, want ErrLeafNotFound", err)
+	}
+}
+
+// BenchmarkLeafEncoding compares hashing leaves with a fresh marshalCanonical call per balance against a reused leafEncoder, as the concurrent builder's workers do.
+//
+// Both must give the concurrent builder's root, so the encoder only saves allocations. Run with -benchmem to compare allocs/op.
+//
+// Parameters:
+//   - b: the benchmark context
+//
+// Returns:
+//   None
+func BenchmarkLeafEncoding(b *testing.B) {
+	accounts := exampleAccounts(20000)
+	entries := flattenBalances(accounts)
+	builder := NewTreeBuilder(nil)
+	marshalLeaves := func(b *testing.B) []*MerkleNode {
+		leaves := make([]*MerkleNode, len(entries))
+		for i, entry := range entries {
+			data, err := marshalCanonical(entry.balance)
+			if err != nil {
+				b.Fatal(err)
+			}
+			leaves[i] = &MerkleNode{Hash: hashLeaf(SHA256Hasher{}, data)}
+		}
+		return leaves
+	}
+	encoderLeaves := func(b *testing.B) []*MerkleNode {
+		leaves := make([]*MerkleNode, len(entries))
+		var enc leafEncoder
+		for i, entry := range entries {
+			hash, err := builder.hashBalanceWith(entry, &enc)
+			if err != nil {
+				b.Fatal(err)
+			}
+			leaves[i] = &MerkleNode{Hash: hash}
+		}
+		return leaves
+	}
+
+	root, err := createMerkleTreeForAccountsConcurrent(accounts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if buildTree(marshalLeaves(b)).Hash != root.Hash || buildTree(encoderLeaves(b)).Hash != root.Hash {
+		b.Fatal("leaf encodings give different roots")
+	}
+
+	b.Run("marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			marshalLeaves(b)
+		}
+	})
+	b.Run("encoder", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			encoderLeaves(b)
+		}
+	})
+}
+
+// TestMMR checks that proofs for every position at every historical size from 1 to 100 verify against the root the range had at that size.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestMMR(t *testing.T) {
+	m := NewMMR(nil)
+	var leaves [][]byte
+	roots := [][32]byte{m.Root()}
+	for i := 0; i < 100; i++ {
+		leaf := []byte("entry-" + strconv.Itoa(i))
+		if pos := m.Append(leaf); pos != uint64(i) {
+			t.Fatalf("append %d returned position %d", i, pos)
+		}
+		leaves = append(leaves, leaf)
+		roots = append(roots, m.Root())
+		if want := BuildTreeFromLeafBytes(leaves).Hash; roots[i+1] != want {
+			t.Fatalf("size %d: root %x, buildTree root %x", i+1, roots[i+1], want)
+		}
+	}
+
+	for size := uint64(1); size <= m.Size(); size++ {
+		root, err := m.RootAt(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root != roots[size] {
+			t.Fatalf("RootAt(%d) %x, want %x", size, root, roots[size])
+		}
+		for pos := uint64(0); pos < size; pos++ {
+			proof, err := m.ProveAt(pos, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyMMRProof(root, leaves[pos], proof) {
+				t.Fatalf("position %d at size %d does not verify", pos, size)
+			}
+			if pos == 0 && size > 1 && VerifyMMRProof(root, leaves[1], proof) {
+				t.Fatalf("proof for position 0 at size %d verifies another leaf", size)
+			}
+		}
+	}
+
+	proof, err := m.Prove(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyMMRProof(m.Root(), leaves[42], proof) {
+		t.Fatal("Prove does not verify against Root")
+	}
+	if _, err := m.ProveAt(10, 10); !errors.Is(err, ErrLeafNotFound) {
+		t.Fatalf("position at size: got %v, want ErrLeafNotFound", err)
+	}
+	if _, err := m.ProveAt(0, 101); err == nil {
+		t.Fatal("proved against a size beyond the range")
+	}
+	if _, err := m.RootAt(101); err == nil {
+		t.Fatal("root for a size beyond the range")
+	}
+}
+
+// TestBuildTreeFromLeafBytes checks that passing the json.Marshal bytes of each balance, in Build's order, reproduces createMerkleTreeForAccounts's root.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestBuildTreeFromLeafBytes(t *testing.T) {
+	accounts := exampleAccounts(40)
+	want, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var leaves [][]byte
+	for _, entry := range flattenBalances(accounts) {
+		data, err := json.Marshal(entry.balance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, data)
+	}
+	if got := BuildTreeFromLeafBytes(leaves); got.Hash != want.Hash {
+		t.Fatalf("leaf bytes root %x, want %x", got.Hash, want.Hash)
+	}
+
+	leaves[0], leaves[1] = leaves[1], leaves[0]
+	if BuildTreeFromLeafBytes(leaves).Hash == want.Hash {
+		t.Fatal("reordered leaf bytes give the same root")
+	}
+}
+
+// TestLastLeafProofs checks that the last, unpaired leaf of odd-sized trees gets a proof without padding siblings that still verifies.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestLastLeafProofs(t *testing.T) {
+	for _, count := range []int{3, 5, 7, 9, 17, 33, 100} {
+		data := make([][]byte, count)
+		for i := range data {
+			data[i] = []byte("leaf-" + strconv.Itoa(i))
+		}
+		root := BuildTreeFromLeafBytes(data)
+		var last [32]byte
+		copy(last[:], root.Leaves()[count-1])
+
+		proof, err := GenerateProof(root, last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !VerifyProof(last, proof, root.Hash) {
+			t.Fatalf("%d leaves: last leaf's proof does not verify", count)
+		}
+		if max := treeDepth(count) - 1; len(proof) >= max {
+			t.Errorf("%d leaves: last leaf's proof has %d steps, want fewer than %d", count, len(proof), max)
+		}
+		for i, step := range proof {
+			if !step.IsLeft {
+				t.Errorf("%d leaves: step %d has a right sibling, but nothing lies right of the last leaf", count, i)
+			}
+		}
+	}
+}
+
+// TestEqualHashes checks that the constant-time comparison reports equal and unequal hashes correctly, including a difference in the last byte only.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestEqualHashes(t *testing.T) {
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+	last := a
+	last[31] ^= 0x80
+
+	cases := []struct {
+		name string
+		x, y [32]byte
+		want bool
+	}{
+		{"same hash", a, a, true},
+		{"equal copies", a, sha256.Sum256([]byte("a")), true},
+		{"zero hashes", [32]byte{}, [32]byte{}, true},
+		{"different hashes", a, b, false},
+		{"last byte differs", a, last, false},
+		{"zero and nonzero", [32]byte{}, a, false},
+	}
+	for _, c := range cases {
+		if got := equalHashes(c.x, c.y); got != c.want {
+			t.Errorf("%s: equalHashes returned %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// TestBuildPadded checks that 5 leaves are padded to 8, giving a tree 3 levels of edges deep whose padding leaves are the documented constant.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestBuildPadded(t *testing.T) {
+	var accounts []Account
+	for i := 0; i < 5; i++ {
+		accounts = append(accounts, Account{Identifier: "user" + strconv.Itoa(i), Balances: []Balance{{Asset: "BTC", Balance: float64(i + 1)}}})
+	}
+	root, err := createPaddedMerkleTree(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.LeafCount() != 8 || root.Depth() != 4 {
+		t.Fatalf("got %d leaves and depth %d, want 8 leaves and depth 4 (3 edges from root to leaf)", root.LeafCount(), root.Depth())
+	}
+
+	padding := NewTreeBuilder(nil).PaddingLeaf()
+	if padding != hashLeaf(SHA256Hasher{}, []byte{0}) {
+		t.Fatal("padding leaf is not the hash of a zero byte under the leaf prefix")
+	}
+	balances := exampleTreeLeaves(t, accounts)
+	for i, leaf := range root.Leaves() {
+		var hash [32]byte
+		copy(hash[:], leaf)
+		if i < len(balances) {
+			if hash != balances[i] || hash == padding {
+				t.Fatalf("leaf %d: got %x, want balance leaf %x", i, hash, balances[i])
+			}
+			proof, err := GenerateProof(root, hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(proof) != 3 || !VerifyProof(hash, proof, root.Hash) {
+				t.Fatalf("leaf %d: %d-step proof does not verify", i, len(proof))
+			}
+		} else if hash != padding {
+			t.Fatalf("leaf %d: got %x, want the padding leaf", i, hash)
+		}
+	}
+
+	unpadded, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unpadded.Hash == root.Hash {
+		t.Fatal("padded and unpadded trees have the same root")
+	}
+
+	for i := 5; i < 8; i++ {
+		accounts = append(accounts, Account{Identifier: "user" + strconv.Itoa(i), Balances: []Balance{{Asset: "BTC", Balance: float64(i + 1)}}})
+	}
+	full, err := createPaddedMerkleTree(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unpadded, err = createMerkleTreeForAccounts(accounts); err != nil {
+		t.Fatal(err)
+	}
+	if full.LeafCount() != 8 || full.Hash != unpadded.Hash {
+		t.Fatalf("8 leaves: got %d leaves, root %x; want 8 leaves and the unpadded root %x", full.LeafCount(), full.Hash, unpadded.Hash)
+	}
+}
+
+// TestProofServer checks the proof handler's responses before a tree is set, for a known account and for an unknown one.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestProofServer(t *testing.T) {
+	server := NewProofServer()
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	for _, target := range []string{"/root", "/proof?account=user42"} {
+		if rec := get(target); rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s before SetTree: status %d, want 503", target, rec.Code)
+		}
+	}
+
+	accounts := exampleAccounts(100)
+	root, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetTree(root, accounts)
+
+	if rec := get("/root"); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != root.RootHex() {
+		t.Fatalf("/root: status %d, body %q, want %s", rec.Code, rec.Body.String(), root.RootHex())
+	}
+
+	rec := get("/proof?account=user42")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/proof for user42: status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var userProof UserProof
+	if err := json.Unmarshal(rec.Body.Bytes(), &userProof); err != nil {
+		t.Fatal(err)
+	}
+	if userProof.Identifier != "user42" || userProof.Root != root.RootHex() || len(userProof.Balances) != 5 {
+		t.Fatalf("proof for %s against %s with %d balances", userProof.Identifier, userProof.Root, len(userProof.Balances))
+	}
+	for _, balance := range userProof.Balances {
+		leaf, err := decodeHexHash(balance.LeafHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps := make([]ProofStep, len(balance.Proof))
+		for i, step := range balance.Proof {
+			if steps[i].Hash, err = decodeHexHash(step.Hash); err != nil {
+				t.Fatal(err)
+			}
+			steps[i].IsLeft = step.IsLeft
+		}
+		if !VerifyProof(leaf, steps, root.Hash) {
+			t.Fatalf("served proof for %s does not verify", balance.Asset)
+		}
+	}
+
+	if rec := get("/proof?account=nobody"); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown account: status %d, want 404", rec.Code)
+	}
+	if rec := get("/proof"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("missing account: status %d, want 400", rec.Code)
+	}
+	post := httptest.NewRecorder()
+	server.ServeHTTP(post, httptest.NewRequest(http.MethodPost, "/root", nil))
+	if post.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /root: status %d, want 405", post.Code)
+	}
+}
+
+// TestProofServerTimeout checks that a proof request whose deadline passes is answered with 503, that one within its deadline is served and that any other proof failure gets a fixed 500 message.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestProofServerTimeout(t *testing.T) {
+	accounts := exampleAccounts(50)
+	root, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewProofServer()
+	server.SetTree(root, accounts)
+
+	for _, c := range []struct {
+		timeout time.Duration
+		want    int
+	}{
+		{time.Nanosecond, http.StatusServiceUnavailable},
+		{time.Minute, http.StatusOK},
+		{0, http.StatusOK},
+	} {
+		server.Timeout = c.timeout
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/proof?account=user7", nil))
+		if rec.Code != c.want {
+			t.Fatalf("timeout %v: status %d, body %q, want %d", c.timeout, rec.Code, rec.Body.String(), c.want)
+		}
+	}
+
+	other := exampleAccounts(50)
+	other[6].Balances[0].Balance += 1
+	server.Timeout = 0
+	server.SetTree(root, other)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/proof?account=user7", nil))
+	if rec.Code != http.StatusInternalServerError || strings.TrimSpace(rec.Body.String()) != "failed to build proof" {
+		t.Fatalf("unprovable account: status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := BuildUserProofCtx(ctx, root, accounts[6]); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled context: got %v, want context.Canceled", err)
+	}
+}
+
+// TestBuildConcurrentPanic checks that a hasher panicking in a leaf worker or a node worker makes the concurrent builder return ErrWorkerPanic instead of crashing.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestBuildConcurrentPanic(t *testing.T) {
+	accounts := exampleAccounts(500)
+	accounts[321].Balances[2].Asset = "POISON"
+
+	b := NewTreeBuilder(panickingHasher{leaves: true})
+	b.Workers = 4
+	root, err := b.BuildConcurrent(accounts)
+	if !errors.Is(err, ErrWorkerPanic) || root != nil {
+		t.Fatalf("leaf panic: got root %v and %v, want ErrWorkerPanic", root, err)
+	}
+	if !strings.Contains(err.Error(), accounts[321].Identifier) || !strings.Contains(err.Error(), "poisoned leaf") {
+		t.Fatalf("leaf panic error %q does not name the account and panic value", err)
+	}
+
+	b = NewTreeBuilder(panickingHasher{})
+	b.Workers = 4
+	root, err = b.BuildConcurrent(exampleAccounts(500))
+	if !errors.Is(err, ErrWorkerPanic) || root != nil {
+		t.Fatalf("node panic: got root %v and %v, want ErrWorkerPanic", root, err)
+	}
+	if !strings.Contains(err.Error(), "node worker") || !strings.Contains(err.Error(), "poisoned node") {
+		t.Fatalf("node panic error %q does not name the worker and panic value", err)
+	}
+}
+
+// TestRootOnly checks that RootOnly gives the root buildTree builds over the same leaves, for every size up to 40 and for none.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestRootOnly(t *testing.T) {
+	for count := 0; count <= 40; count++ {
+		leaves := make([][]byte, count)
+		nodes := make([]*MerkleNode, count)
+		for i := range leaves {
+			hash := hashLeaf(SHA256Hasher{}, []byte(strconv.Itoa(i)))
+			leaves[i] = hash[:]
+			nodes[i] = &MerkleNode{Hash: hash}
+		}
+		got, err := RootOnly(leaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := buildTree(nodes).Hash; got != want {
+			t.Fatalf("%d leaves: RootOnly %x, buildTree %x", count, got, want)
+		}
+	}
+
+	if _, err := RootOnly([][]byte{make([]byte, 32), make([]byte, 31)}); err == nil {
+		t.Fatal("a 31-byte leaf was accepted")
+	}
+}
+
+// BenchmarkRootOnly compares the memory RootOnly uses with building the full tree over the same 65536 leaf hashes.
+//
+// Parameters:
+//   - b: the benchmark context
+//
+// Returns:
+//   None
+func BenchmarkRootOnly(b *testing.B) {
+	leaves := make([][]byte, 1<<16)
+	for i := range leaves {
+		hash := hashLeaf(SHA256Hasher{}, []byte(strconv.Itoa(i)))
+		leaves[i] = hash[:]
+	}
+	buildFromLeaves := func() *MerkleNode {
+		nodes := make([]*MerkleNode, len(leaves))
+		for i, leaf := range leaves {
+			nodes[i] = &MerkleNode{}
+			copy(nodes[i].Hash[:], leaf)
+		}
+		return buildTree(nodes)
+	}
+	root, err := RootOnly(leaves)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if buildFromLeaves().Hash != root {
+		b.Fatal("RootOnly and buildTree roots differ")
+	}
+
+	b.Run("RootOnly", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := RootOnly(leaves); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("buildTree", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buildFromLeaves()
+		}
+	})
+}
+
+// TestPerAssetProof checks that a balance verifies through its asset's tree and up to the super-root, and that each level is bound to the other.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestPerAssetProof(t *testing.T) {
+	accounts := exampleAccounts(60)
+	roots, superRoot, err := createPerAssetTrees(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) < 2 {
+		t.Fatalf("got %d asset trees, want several", len(roots))
+	}
+	account := accounts[33]
+	balance := account.Balances[1]
+
+	proof, err := GeneratePerAssetProof(roots, superRoot, account, balance.Asset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof.AssetRoot != roots[balance.Asset].Hash {
+		t.Fatal("proof carries the wrong asset root")
+	}
+	if !VerifyPerAssetProof(superRoot.Hash, balance, proof) {
+		t.Fatal("per-asset proof does not verify")
+	}
+	leaf, err := NewTreeBuilder(nil).hashBalance(accountBalance{identifier: account.Identifier, balance: balance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyProof(leaf, proof.BalanceProof, proof.AssetRoot) {
+		t.Fatal("balance proof does not verify against the asset root alone")
+	}
+
+	changed := balance
+	changed.Balance *= 2
+	if VerifyPerAssetProof(superRoot.Hash, changed, proof) {
+		t.Fatal("proof verifies for a different amount")
+	}
+	for asset, root := range roots {
+		if asset == balance.Asset {
+			continue
+		}
+		forged := proof
+		forged.AssetRoot = root.Hash
+		if VerifyPerAssetProof(superRoot.Hash, balance, forged) {
+			t.Fatalf("proof verifies with the %s tree's root", asset)
+		}
+		renamed := balance
+		renamed.Asset = asset
+		if VerifyPerAssetProof(superRoot.Hash, renamed, proof) {
+			t.Fatalf("proof verifies for the balance relabelled as %s", asset)
+		}
+		break
+	}
+}
+
+// TestEstimateTree checks EstimateTree's leaf, depth, node and hash counts against real builds of small trees.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestEstimateTree(t *testing.T) {
+	for accountCount := 1; accountCount <= 12; accountCount++ {
+		for perAccount := 1; perAccount <= 3; perAccount++ {
+			accounts := make([]Account, accountCount)
+			for i := range accounts {
+				accounts[i].Identifier = "user" + strconv.Itoa(i)
+				for j := 0; j < perAccount; j++ {
+					accounts[i].Balances = append(accounts[i].Balances, Balance{Asset: "A" + strconv.Itoa(j), Balance: float64(i + j)})
+				}
+			}
+
+			calls := 0
+			root, err := NewTreeBuilder(countingHasher{calls: &calls}).Build(accounts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes := 0
+			root.Walk(func(*MerkleNode, int) bool {
+				nodes++
+				return true
+			})
+
+			estimate := EstimateTree(accountCount, perAccount)
+			if estimate.Leaves != root.LeafCount() || estimate.Depth != root.Depth() || estimate.Nodes != nodes || estimate.HashOps != calls {
+				t.Fatalf("%d accounts of %d balances: estimated %+v, built %d leaves, depth %d, %d nodes, %d hashes",
+					accountCount, perAccount, estimate, root.LeafCount(), root.Depth(), nodes, calls)
+			}
+			if estimate.Bytes <= 0 {
+				t.Fatalf("%d accounts of %d balances: estimated %d bytes", accountCount, perAccount, estimate.Bytes)
+			}
+		}
+	}
+
+	if empty := EstimateTree(0, 5); empty.Leaves != 0 || empty.Depth != 1 || empty.Nodes != 1 || empty.HashOps != 1 {
+		t.Fatalf("empty tree estimated %+v", empty)
+	}
+}
+
+// TestWalkMatchesRecursion checks Walk and the traversals built on it against recursive reference versions, and that a 100000-level chain survives them and a binary round trip.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestWalkMatchesRecursion(t *testing.T) {
+	var visit func(n *MerkleNode, depth int, frames *[]walkFrame)
+	visit = func(n *MerkleNode, depth int, frames *[]walkFrame) {
+		if n == nil {
+			return
+		}
+		*frames = append(*frames, walkFrame{node: n, depth: depth})
+		visit(n.Left, depth+1, frames)
+		visit(n.Right, depth+1, frames)
+	}
+	var valid func(n *MerkleNode) bool
+	valid = func(n *MerkleNode) bool {
+		if n.Left == nil && n.Right == nil {
+			return true
+		}
+		if n.Left == nil || n.Right == nil {
+			return false
+		}
+		return n.Hash == hashChildren(SHA256Hasher{}, n.Left.Hash, n.Right.Hash) && valid(n.Left) && valid(n.Right)
+	}
+
+	for count := 1; count <= 40; count++ {
+		data := make([][]byte, count)
+		for i := range data {
+			data[i] = []byte("leaf-" + strconv.Itoa(i))
+		}
+		root := BuildTreeFromLeafBytes(data)
+		if count%7 == 0 {
+			root.Right.Hash[0] ^= 1
+		}
+
+		var want, got []walkFrame
+		visit(root, 0, &want)
+		root.Walk(func(node *MerkleNode, depth int) bool {
+			got = append(got, walkFrame{node: node, depth: depth})
+			return true
+		})
+		if len(got) != len(want) {
+			t.Fatalf("%d leaves: Walk visited %d nodes, recursion %d", count, len(got), len(want))
+		}
+		var leaves [][]byte
+		depth := 0
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("%d leaves: visit %d differs", count, i)
+			}
+			if node := want[i].node; node.Left == nil && node.Right == nil {
+				leaves = append(leaves, node.Hash[:])
+			}
+			if want[i].depth+1 > depth {
+				depth = want[i].depth + 1
+			}
+		}
+
+		gotLeaves := root.Leaves()
+		if len(gotLeaves) != len(leaves) || root.LeafCount() != len(leaves) || root.Depth() != depth {
+			t.Fatalf("%d leaves: Leaves %d, LeafCount %d, Depth %d; recursion found %d leaves, depth %d",
+				count, len(gotLeaves), root.LeafCount(), root.Depth(), len(leaves), depth)
+		}
+		for i := range leaves {
+			if !bytes.Equal(gotLeaves[i], leaves[i]) {
+				t.Fatalf("%d leaves: leaf %d differs", count, i)
+			}
+		}
+		if (root.Validate() == nil) != valid(root) {
+			t.Fatalf("%d leaves: Validate returned %v, recursion says valid %v", count, root.Validate(), valid(root))
+		}
+	}
+
+	const levels = 100000
+	chain := &MerkleNode{Hash: hashLeaf(SHA256Hasher{}, []byte("bottom"))}
+	for i := 0; i < levels; i++ {
+		leaf := &MerkleNode{Hash: hashLeaf(SHA256Hasher{}, []byte(strconv.Itoa(i)))}
+		chain = &MerkleNode{Hash: hashChildren(SHA256Hasher{}, chain.Hash, leaf.Hash), Left: chain, Right: leaf}
+	}
+	if chain.Depth() != levels+1 || chain.LeafCount() != levels+1 || len(chain.Leaves()) != levels+1 {
+		t.Fatalf("chain: depth %d, %d leaves", chain.Depth(), chain.LeafCount())
+	}
+	if err := chain.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := chain.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := UnmarshalTree(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Hash != chain.Hash || loaded.Depth() != levels+1 || loaded.Validate() != nil {
+		t.Fatal("chain did not survive a binary round trip")
+	}
+	if _, err := GenerateProof(loaded, hashLeaf(SHA256Hasher{}, []byte("bottom"))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDomainSeparation checks the leaf and internal node prefixes against hand-computed SHA-256 digests and that an internal node's preimage cannot pose as a leaf.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestDomainSeparation(t *testing.T) {
+	a, b := []byte("alice"), []byte("bob")
+	leafA := sha256.Sum256(append([]byte{0x00}, a...))
+	leafB := sha256.Sum256(append([]byte{0x00}, b...))
+	want := sha256.Sum256(append(append([]byte{0x01}, leafA[:]...), leafB[:]...))
+
+	root := BuildTreeFromLeafBytes([][]byte{a, b})
+	if root.Left.Hash != leafA || root.Right.Hash != leafB || root.Hash != want {
+		t.Fatalf("root %x, want sha256(0x01 || sha256(0x00 || a) || sha256(0x00 || b)) = %x", root.Hash, want)
+	}
+
+	preimage := append(append([]byte(nil), leafA[:]...), leafB[:]...)
+	forged := hashLeaf(SHA256Hasher{}, preimage)
+	if forged == root.Hash {
+		t.Fatal("the internal node's preimage hashes to the root as a leaf")
+	}
+	if VerifyProof(forged, nil, root.Hash) {
+		t.Fatal("the internal node's preimage verifies as a one-leaf tree")
+	}
+	if other := BuildTreeFromLeafBytes([][]byte{preimage}); other.Hash == root.Hash {
+		t.Fatal("a one-leaf tree over the internal node's preimage has the same root")
+	}
+}
+
+// TestConcurrentChunkBoundaries checks that the concurrent builder matches the sequential root exactly for balance counts around chunk and worker boundaries.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestConcurrentChunkBoundaries(t *testing.T) {
+	for _, count := range []int{0, 1, 2, 7, 8, 9, 1000} {
+		accounts := make([]Account, count)
+		for i := range accounts {
+			accounts[i] = Account{Identifier: "user" + strconv.Itoa(i), Balances: []Balance{{Asset: "BTC", Balance: float64(i)}}}
+		}
+		sequential, err := createMerkleTreeForAccounts(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []int{1, 3, 8, 9, 16} {
+			b := NewTreeBuilder(nil)
+			b.Workers = workers
+			concurrent, err := b.BuildConcurrent(accounts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if concurrent.Hash != sequential.Hash || concurrent.LeafCount() != sequential.LeafCount() {
+				t.Errorf("%d balances, %d workers: root %x with %d leaves, want %x with %d",
+					count, workers, concurrent.Hash, concurrent.LeafCount(), sequential.Hash, sequential.LeafCount())
+			}
+		}
+	}
+}
+
+// TestBinaryRoundTrip checks that a 1000-account tree reloads from MarshalBinary with the same root, leaves and proofs, and that damaged data is rejected.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestBinaryRoundTrip(t *testing.T) {
+	root, err := createMerkleTreeForAccounts(exampleAccounts(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := root.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := UnmarshalTree(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Hash != root.Hash || loaded.Validate() != nil {
+		t.Fatalf("reloaded root %x, want %x", loaded.Hash, root.Hash)
+	}
+
+	leaves, loadedLeaves := root.Leaves(), loaded.Leaves()
+	if len(loadedLeaves) != len(leaves) {
+		t.Fatalf("reloaded %d leaves, want %d", len(loadedLeaves), len(leaves))
+	}
+	for i := range leaves {
+		if !bytes.Equal(leaves[i], loadedLeaves[i]) {
+			t.Fatalf("leaf %d differs after reloading", i)
+		}
+	}
+	for _, i := range []int{0, 1234, len(leaves) - 1} {
+		var leaf [32]byte
+		copy(leaf[:], leaves[i])
+		want, err := GenerateProof(root, leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := GenerateProof(loaded, leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) || !VerifyProof(leaf, got, root.Hash) {
+			t.Fatalf("leaf %d: reloaded tree gives a different proof", i)
+		}
+	}
+
+	damaged := map[string][]byte{
+		"empty":     nil,
+		"version":   append([]byte{data[0] + 1}, data[1:]...),
+		"truncated": data[:len(data)-1],
+		"trailing":  append(append([]byte(nil), data...), 0),
+	}
+	for name, data := range damaged {
+		if _, err := UnmarshalTree(data); err == nil {
+			t.Errorf("%s data decoded without error", name)
+		}
+	}
+}
+
+// BenchmarkBuildTreeFromReader compares the streaming reader with loading every account and building the full tree, reporting the peak live heap of each.
+//
+// Parameters:
+//   - b: the benchmark context
+//
+// Returns:
+//   None
+func BenchmarkBuildTreeFromReader(b *testing.B) {
+	accounts := exampleAccounts(20000)
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Identifier < accounts[j].Identifier })
+	var input bytes.Buffer
+	enc := json.NewEncoder(&input)
+	for _, account := range accounts {
+		if err := enc.Encode(account); err != nil {
+			b.Fatal(err)
+		}
+	}
+	accounts = nil
+
+	batch := func(b *testing.B) [32]byte {
+		loaded, err := LoadAccountsJSONL(bytes.NewReader(input.Bytes()))
+		if err != nil {
+			b.Fatal(err)
+		}
+		root, err := createMerkleTreeForAccounts(loaded)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return root.Hash
+	}
+	stream := func(b *testing.B) [32]byte {
+		root, err := BuildTreeFromReader(bytes.NewReader(input.Bytes()))
+		if err != nil {
+			b.Fatal(err)
+		}
+		return root.Hash
+	}
+	if batch(b) != stream(b) {
+		b.Fatal("streaming and batch roots differ")
+	}
+
+	for _, c := range []struct {
+		name  string
+		build func(*testing.B) [32]byte
+	}{{"batch", batch}, {"reader", stream}} {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				if used := peakHeap(func() { c.build(b) }); used > peak {
+					peak = used
+				}
+			}
+			b.ReportMetric(float64(peak), "peak-heap-B")
+		})
+	}
+}
+
+// BenchmarkNodeArena compares buildTree, which takes internal nodes from one arena, with allocating every internal node separately.
+//
+// B/op, the TotalAlloc growth per build, stays about the same because the same nodes are allocated either way; the arena's saving is in allocs/op and so in GC work.
+//
+// Parameters:
+//   - b: the benchmark context
+//
+// Returns:
+//   None
+func BenchmarkNodeArena(b *testing.B) {
+	leaves := make([]*MerkleNode, 1<<18)
+	for i := range leaves {
+		leaves[i] = &MerkleNode{Hash: hashLeaf(SHA256Hasher{}, []byte(strconv.Itoa(i)))}
+	}
+	perNode := func() *MerkleNode {
+		level := leaves
+		for len(level) > 1 {
+			next := make([]*MerkleNode, 0, (len(level)+1)/2)
+			for i := 0; i+1 < len(level); i += 2 {
+				next = append(next, &MerkleNode{Hash: hashChildren(SHA256Hasher{}, level[i].Hash, level[i+1].Hash), Left: level[i], Right: level[i+1]})
+			}
+			if len(level)%2 == 1 {
+				next = append(next, level[len(level)-1])
+			}
+			level = next
+		}
+		return level[0]
+	}
+	if perNode().Hash != buildTree(leaves).Hash {
+		b.Fatal("arena and per-node roots differ")
+	}
+
+	b.Run("per-node", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			perNode()
+		}
+	})
+	b.Run("arena", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buildTree(leaves)
+		}
+	})
+}
+
+// TestRootHelpers checks RootEquals and RootHex on equal and differing roots and on nil nodes.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestRootHelpers(t *testing.T) {
+	accounts := exampleAccounts(10)
+	a, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := createMerkleTreeForAccountsConcurrent(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := createMerkleTreeForAccounts(accounts[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var none *MerkleNode
+
+	cases := []struct {
+		name string
+		x, y *MerkleNode
+		want bool
+	}{
+		{"same tree", a, a, true},
+		{"equal roots", a, b, true},
+		{"differing roots", a, c, false},
+		{"nil receiver", none, a, false},
+		{"nil argument", a, none, false},
+		{"both nil", none, none, true},
+	}
+	for _, tc := range cases {
+		if got := tc.x.RootEquals(tc.y); got != tc.want {
+			t.Errorf("%s: RootEquals returned %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if rootHex := a.RootHex(); rootHex != strings.ToLower(rootHex) || len(rootHex) != 64 || rootHex != b.RootHex() || rootHex == c.RootHex() {
+		t.Fatalf("RootHex gave %q, %q and %q", rootHex, b.RootHex(), c.RootHex())
+	}
+	if decoded, err := decodeHexHash(a.RootHex()); err != nil || decoded != a.Hash {
+		t.Fatalf("RootHex does not decode back to the root: %v", err)
+	}
+	if none.RootHex() != "" {
+		t.Fatalf("nil RootHex gave %q", none.RootHex())
+	}
+}
+
+// TestSeededAccounts checks that the same seed and count give byte-identical accounts and the same root, and that another seed does not.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestSeededAccounts(t *testing.T) {
+	encode := func(accounts []Account) []byte {
+		data, err := json.Marshal(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	first, second, other := generateRandomAccountsSeed(200, 7), generateRandomAccountsSeed(200, 7), generateRandomAccountsSeed(200, 8)
+	if !bytes.Equal(encode(first), encode(second)) {
+		t.Fatal("the same seed gave different accounts")
+	}
+	if bytes.Equal(encode(first), encode(other)) {
+		t.Fatal("different seeds gave the same accounts")
+	}
+
+	firstRoot, err := createMerkleTreeForAccounts(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondRoot, err := createMerkleTreeForAccounts(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !firstRoot.RootEquals(secondRoot) {
+		t.Fatal("the same seed gave different roots")
+	}
+}
+
+// TestSnapshotStore checks that ProofAt answers from the latest of three snapshots taken at or before the requested time.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestSnapshotStore(t *testing.T) {
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewSnapshotStore()
+	roots := make([]*MerkleNode, 3)
+	for i, day := range []int{7, 0, 14} {
+		accounts := generateRandomAccountsSeed(10+i, int64(i))
+		root, err := createMerkleTreeForAccounts(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots[i] = root
+		if err := store.Add(base.AddDate(0, 0, day), root, accounts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		day  int
+		want *MerkleNode
+	}{
+		{0, roots[1]},
+		{3, roots[1]},
+		{7, roots[0]},
+		{13, roots[0]},
+		{14, roots[2]},
+		{100, roots[2]},
+	}
+	for _, c := range cases {
+		userProof, err := store.ProofAt(base.AddDate(0, 0, c.day), "user3")
+		if err != nil {
+			t.Fatalf("day %d: %v", c.day, err)
+		}
+		if userProof.Root != c.want.RootHex() {
+			t.Fatalf("day %d: proof against %s, want %s", c.day, userProof.Root, c.want.RootHex())
+		}
+		for _, balance := range userProof.Balances {
+			leaf, err := decodeHexHash(balance.LeafHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			steps := make([]ProofStep, len(balance.Proof))
+			for i, step := range balance.Proof {
+				if steps[i].Hash, err = decodeHexHash(step.Hash); err != nil {
+					t.Fatal(err)
+				}
+				steps[i].IsLeft = step.IsLeft
+			}
+			if !VerifyProof(leaf, steps, c.want.Hash) {
+				t.Fatalf("day %d: proof for %s does not verify", c.day, balance.Asset)
+			}
+		}
+	}
+
+	if _, err := store.ProofAt(base.AddDate(0, 0, -1), "user3"); !errors.Is(err, ErrNoSnapshot) {
+		t.Fatalf("before the first snapshot: got %v, want ErrNoSnapshot", err)
+	}
+	if _, err := store.ProofAt(base.AddDate(0, 0, 10), "user11"); !errors.Is(err, ErrLeafNotFound) {
+		t.Fatalf("account missing from the snapshot: got %v, want ErrLeafNotFound", err)
+	}
+	if _, err := store.ProofAt(base.AddDate(0, 0, 14), "user11"); err != nil {
+		t.Fatalf("account added in a later snapshot: %v", err)
+	}
+}
+
+// TestCompactProofs checks that the back-referenced encoding of every proof in a padded tree is smaller than the plain JSON and that both verify.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestCompactProofs(t *testing.T) {
+	root, err := createPaddedMerkleTree(exampleAccounts(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := root.Leaves()
+	proofs := make([][]ProofStep, len(leaves))
+	for i, leaf := range leaves {
+		if proofs[i], err = GenerateProof(root, [32]byte(leaf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plain, err := json.Marshal(proofs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := json.Marshal(CompactProofs(proofs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compact) >= len(plain) {
+		t.Fatalf("compact encoding is %d bytes, plain is %d", len(compact), len(plain))
+	}
+	t.Logf("%d proofs: plain %d bytes, compact %d bytes", len(proofs), len(plain), len(compact))
+
+	var decoded [][]CompactProofStep
+	if err := json.Unmarshal(compact, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	expanded, err := ExpandProofs(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, leaf := range leaves {
+		if !VerifyProof([32]byte(leaf), proofs[i], root.Hash) {
+			t.Fatalf("plain proof %d does not verify", i)
+		}
+		if !VerifyProof([32]byte(leaf), expanded[i], root.Hash) {
+			t.Fatalf("expanded proof %d does not verify", i)
+		}
+	}
+
+	for _, bad := range [][][]CompactProofStep{
+		{{{Ref: 1}}},
+		{{{Hash: hex.EncodeToString(root.Hash[:]), Ref: 1}}},
+		{{{}}},
+		{{{Hash: "zz"}}},
+	} {
+		if _, err := ExpandProofs(bad); err == nil {
+			t.Fatalf("ExpandProofs(%+v) succeeded", bad)
+		}
+	}
+}
+
+// TestVerifyAttestedTotals checks committed totals against attested ones that differ by rounding within tolerance, by more than tolerance, and by an asset missing from the tree.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestVerifyAttestedTotals(t *testing.T) {
+	_, committed, err := createMerkleTreeWithTotals(exampleAccounts(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rounded := make(map[string]float64, len(committed))
+	for asset, total := range committed {
+		rounded[asset] = math.Round(total*1e6) / 1e6
+	}
+	if ok, discrepancies := VerifyAttestedTotals(committed, rounded, 1e-6); !ok || len(discrepancies) != 0 {
+		t.Fatalf("rounded totals: ok %v, discrepancies %v", ok, discrepancies)
+	}
+
+	rounded["BTC"] += 0.5
+	rounded["DOGE"] = 3
+	ok, discrepancies := VerifyAttestedTotals(committed, rounded, 1e-6)
+	if ok || len(discrepancies) != 2 {
+		t.Fatalf("off totals: ok %v, discrepancies %v", ok, discrepancies)
+	}
+	if math.Abs(discrepancies["BTC"]-0.5) > 1e-6 || discrepancies["DOGE"] != 3 {
+		t.Fatalf("discrepancies %v, want BTC 0.5 and DOGE 3", discrepancies)
+	}
+	if ok, _ := VerifyAttestedTotals(committed, rounded, 5); !ok {
+		t.Fatal("totals within a tolerance of 5 were rejected")
+	}
+}
+
+type cancellingReader struct {
+	lines  [][]byte
+	reads  int
+	after  int
+	cancel context.CancelFunc
+}
+
+// Read returns one line per call, like a slow network stream, and cancels the build's context once a set number of lines have been read.
+//
+// Parameters:
+//   - p: the buffer to fill
+//
+// Returns:
+//   the number of bytes read, or io.EOF once every line has been returned
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	if r.reads == len(r.lines) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.lines[r.reads])
+	r.lines[r.reads] = r.lines[r.reads][n:]
+	if len(r.lines[r.reads]) == 0 {
+		r.reads++
+		if r.reads == r.after {
+			r.cancel()
+		}
+	}
+	return n, nil
+}
+
+// TestBuildTreeFromReaderCancel checks that cancelling the context while a slow reader is mid-stream stops BuildTreeFromReaderCtx with context.Canceled, and that an uncancelled build matches BuildTreeFromReader.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestBuildTreeFromReaderCancel(t *testing.T) {
+	accounts := sortedAccounts(exampleAccounts(50))
+	lines := func() [][]byte {
+		lines := make([][]byte, len(accounts))
+		for i, account := range accounts {
+			line, err := json.Marshal(account)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines[i] = append(line, '\n')
+		}
+		return lines
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader := &cancellingReader{lines: lines(), after: 10, cancel: cancel}
+	if _, err := BuildTreeFromReaderCtx(ctx, reader); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if reader.reads == len(accounts) {
+		t.Fatal("the cancelled build read the whole stream")
+	}
+
+	want, err := BuildTreeFromReader(&cancellingReader{lines: lines(), cancel: func() {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := BuildTreeFromReaderCtx(context.Background(), &cancellingReader{lines: lines(), cancel: func() {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Hash != want.Hash {
+		t.Fatalf("root %x, want %x", got.Hash, want.Hash)
+	}
+}
+
+// TestProofForAsset checks that the proof of each of a multi-asset account's balances matches the one BuildUserProof lists and verifies against the root.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestProofForAsset(t *testing.T) {
+	accounts := exampleAccounts(30)
+	root, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := accounts[17]
+	userProof, err := BuildUserProof(root, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, listed := range userProof.Balances {
+		proof, err := ProofForAsset(root, account, listed.Asset)
+		if err != nil {
+			t.Fatalf("%s: %v", listed.Asset, err)
+		}
+		got, err := json.Marshal(proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := json.Marshal(listed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: got %s, want %s", listed.Asset, got, want)
+		}
+
+		leaf, err := decodeHexHash(proof.LeafHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps := make([]ProofStep, len(proof.Proof))
+		for i, step := range proof.Proof {
+			if steps[i].Hash, err = decodeHexHash(step.Hash); err != nil {
+				t.Fatal(err)
+			}
+			steps[i].IsLeft = step.IsLeft
+		}
+		if !VerifyProof(leaf, steps, root.Hash) {
+			t.Fatalf("%s: proof does not verify", listed.Asset)
+		}
+	}
+	if len(userProof.Balances) != 5 {
+		t.Fatalf("checked %d assets, want 5", len(userProof.Balances))
+	}
+
+	if _, err := ProofForAsset(root, account, "DOGE"); !errors.Is(err, ErrLeafNotFound) {
+		t.Fatalf("asset not held: got %v, want ErrLeafNotFound", err)
+	}
+}
+
+// TestDuplicateLeaves checks that two identical full leaves are both reported, that distinct leaves are not, and that padding leaves are.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestDuplicateLeaves(t *testing.T) {
+	accounts := exampleAccounts(4)
+	root, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicates := root.DuplicateLeaves(); duplicates != nil {
+		t.Fatalf("distinct leaves: got %v", duplicates)
+	}
+	if duplicates := (*MerkleNode)(nil).DuplicateLeaves(); duplicates != nil {
+		t.Fatalf("nil tree: got %v", duplicates)
+	}
+
+	b := NewTreeBuilder(nil)
+	b.AllowDuplicates = true
+	twice := []Account{
+		{Identifier: "alice", Balances: []Balance{{Asset: "BTC", Balance: 1}}},
+		{Identifier: "bob", Balances: []Balance{{Asset: "BTC", Balance: 2}}},
+		{Identifier: "alice", Balances: []Balance{{Asset: "BTC", Balance: 1}}},
+	}
+	root, err = b.Build(twice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := root.Leaves()
+	duplicates := root.DuplicateLeaves()
+	if len(duplicates) != 2 || !bytes.Equal(leaves[duplicates[0]], leaves[duplicates[1]]) {
+		t.Fatalf("got %v over %d leaves, want both copies of alice's leaf", duplicates, len(leaves))
+	}
+
+	padded, err := createPaddedMerkleTree(exampleAccounts(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	padding := NewTreeBuilder(nil).PaddingLeaf()
+	leaves = padded.Leaves()
+	duplicates = padded.DuplicateLeaves()
+	if len(duplicates) != 3 {
+		t.Fatalf("5 balances padded to 8: got %v, want the 3 padding leaves", duplicates)
+	}
+	for _, i := range duplicates {
+		if !bytes.Equal(leaves[i], padding[:]) {
+			t.Fatalf("leaf %d is reported but is not padding", i)
+		}
+	}
+}
+
+// TestResolveRoot checks that the root to verify against is taken from the flag when set and from the first line of stdin otherwise.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestResolveRoot(t *testing.T) {
+	root, err := createMerkleTreeForAccounts(exampleAccounts(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootHex := root.RootHex()
+
+	cases := []struct {
+		name  string
+		flag  string
+		stdin string
+	}{
+		{"flag", rootHex, ""},
+		{"flag over stdin", rootHex, "not a root\n"},
+		{"stdin", "", rootHex + "\n"},
+		{"stdin without newline", "", "  " + rootHex},
+		{"stdin first line", "", rootHex + "\nignored\n"},
+	}
+	for _, c := range cases {
+		got, err := resolveRoot(c.flag, strings.NewReader(c.stdin))
+		if err != nil || got != root.Hash {
+			t.Fatalf("%s: got %x, %v; want %s", c.name, got, err, rootHex)
+		}
+	}
+
+	for _, stdin := range []string{"", "\n", rootHex[:10] + "\n"} {
+		if _, err := resolveRoot("", strings.NewReader(stdin)); err == nil {
+			t.Fatalf("stdin %q: expected an error", stdin)
+		}
+	}
+}
+
+// TestVerifyProofFile checks that a proof file written like -proof verifies against its root from either source and that a tampered proof or another root is rejected.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestVerifyProofFile(t *testing.T) {
+	accounts := exampleAccounts(12)
+	root, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userProof, err := BuildUserProof(root, accounts[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(userProof UserProof) string {
+		data, err := json.Marshal(userProof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := t.TempDir() + "/proof.json"
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	path := write(userProof)
+
+	if _, err := verifyProofFile(path, root.RootHex(), strings.NewReader("")); err != nil {
+		t.Fatalf("root from flag: %v", err)
+	}
+	if got, err := verifyProofFile(path, "", strings.NewReader(root.RootHex()+"\n")); err != nil || got.Identifier != accounts[4].Identifier {
+		t.Fatalf("root from stdin: %+v, %v", got, err)
+	}
+
+	other, err := createMerkleTreeForAccounts(accounts[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyProofFile(path, other.RootHex(), nil); !errors.Is(err, ErrRootMismatch) {
+		t.Fatalf("another root: got %v, want ErrRootMismatch", err)
+	}
+
+	userProof.Balances[2].Proof[0].IsLeft = !userProof.Balances[2].Proof[0].IsLeft
+	if _, err := verifyProofFile(write(userProof), root.RootHex(), nil); !errors.Is(err, ErrRootMismatch) {
+		t.Fatalf("tampered proof: got %v, want ErrRootMismatch", err)
+	}
+	if _, err := verifyProofFile(t.TempDir()+"/missing.json", root.RootHex(), nil); err == nil {
+		t.Fatal("missing file: expected an error")
+	}
+}
+
+// TestSerializedSize checks that the computed binary and JSON sizes match the length of the real encodings for balanced, unbalanced, padded and single-child trees.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestSerializedSize(t *testing.T) {
+	var trees []*MerkleNode
+	for _, count := range []int{0, 1, 3, 7, 200} {
+		root, err := createMerkleTreeForAccounts(exampleAccounts(count))
+		if err != nil {
+			t.Fatal(err)
+		}
+		trees = append(trees, root)
+	}
+	padded, err := createPaddedMerkleTree(exampleAccounts(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trees = append(trees, padded)
+
+	for i, root := range trees {
+		data, err := root.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := SerializedSize(root); got != int64(len(data)) {
+			t.Fatalf("tree %d: binary size %d, encoded %d", i, got, len(data))
+		}
+		if data, err = json.Marshal(root); err != nil {
+			t.Fatal(err)
+		}
+		if got := SerializedJSONSize(root); got != int64(len(data)) {
+			t.Fatalf("tree %d: JSON size %d, encoded %d", i, got, len(data))
+		}
+	}
+
+	lopsided := &MerkleNode{Left: &MerkleNode{}, Right: &MerkleNode{Right: &MerkleNode{}}}
+	for _, root := range []*MerkleNode{lopsided, nil} {
+		data, err := json.Marshal(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := SerializedJSONSize(root); got != int64(len(data)) {
+			t.Fatalf("%s: JSON size %d, encoded %d", data, got, len(data))
+		}
+	}
+	if got := SerializedSize(nil); got != 0 {
+		t.Fatalf("nil tree: binary size %d, want 0", got)
+	}
+}
+
+// TestStreamLevels checks that the root rebuilt from streamed levels matches the tree's root for several shapes and that a tampered or truncated stream is rejected.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestStreamLevels(t *testing.T) {
+	for _, count := range []int{0, 1, 3, 5, 64, 201} {
+		root, err := createMerkleTreeForAccounts(exampleAccounts(count))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stream bytes.Buffer
+		if err := StreamLevels(&stream, root); err != nil {
+			t.Fatal(err)
+		}
+		if markers := strings.Count(stream.String(), "level "); markers != root.Depth() {
+			t.Fatalf("%d accounts: %d level markers, want %d", count, markers, root.Depth())
+		}
+		got, err := RootFromLevels(bytes.NewReader(stream.Bytes()))
+		if err != nil {
+			t.Fatalf("%d accounts: %v", count, err)
+		}
+		if got != root.Hash {
+			t.Fatalf("%d accounts: rebuilt root %x, want %x", count, got, root.Hash)
+		}
+	}
+
+	b := NewTreeBuilder(sha512Hasher{})
+	root, err := b.Build(exampleAccounts(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	if err := StreamLevels(&stream, root); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := b.RootFromLevels(bytes.NewReader(stream.Bytes())); err != nil || got != root.Hash {
+		t.Fatalf("SHA-512/256 tree: got %x, %v; want %x", got, err, root.Hash)
+	}
+	if _, err := RootFromLevels(bytes.NewReader(stream.Bytes())); !errors.Is(err, ErrInvalidTree) {
+		t.Fatalf("SHA-512/256 stream checked with SHA-256: got %v, want ErrInvalidTree", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(stream.String(), "\n"), "\n")
+	tampered := append([]string(nil), lines...)
+	tampered[1] = "leaf " + strings.Repeat("00", 32)
+	truncated := lines[:len(lines)-2]
+	for name, input := range map[string]string{
+		"tampered leaf": strings.Join(tampered, "\n"),
+		"missing root":  strings.Join(truncated, "\n"),
+		"skipped level": strings.Replace(stream.String(), "level 1\n", "level 0\n", 1),
+	} {
+		if _, err := b.RootFromLevels(strings.NewReader(input)); !errors.Is(err, ErrInvalidTree) {
+			t.Fatalf("%s: got %v, want ErrInvalidTree", name, err)
+		}
+	}
+	if _, err := RootFromLevels(strings.NewReader("")); !errors.Is(err, ErrEmptyTree) {
+		t.Fatalf("empty stream: got %v, want ErrEmptyTree", err)
+	}
+}
+
+// TestApplyWeights checks that weighted roots and totals commit to balance times weight, that unweighted builds ignore weights, and that the option round-trips through the builder's JSON.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestApplyWeights(t *testing.T) {
+	plain := exampleAccounts(8)
+	weighted := make([]Account, len(plain))
+	scaled := make([]Account, len(plain))
+	for i, account := range plain {
+		weighted[i] = Account{Identifier: account.Identifier, Balances: append([]Balance(nil), account.Balances...)}
+		scaled[i] = Account{Identifier: account.Identifier, Balances: append([]Balance(nil), account.Balances...)}
+		for j := range account.Balances {
+			if weighted[i].Balances[j].Asset == "XRP" {
+				weighted[i].Balances[j].Weight = 0.5
+				scaled[i].Balances[j].Balance *= 0.5
+			}
+		}
+	}
+
+	unweighted := NewTreeBuilder(nil)
+	applied := NewTreeBuilder(nil)
+	applied.ApplyWeights = true
+	build := func(b *TreeBuilder, accounts []Account) (*MerkleNode, map[string]float64) {
+		root, totals, err := b.BuildWithTotals(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root, totals
+	}
+
+	plainRoot, plainTotals := build(unweighted, plain)
+	ignoredRoot, ignoredTotals := build(unweighted, weighted)
+	weightedRoot, weightedTotals := build(applied, weighted)
+	scaledRoot, _ := build(unweighted, scaled)
+	if ignoredRoot.Hash != plainRoot.Hash {
+		t.Fatal("weights changed the root of an unweighted build")
+	}
+	if weightedRoot.Hash == plainRoot.Hash || weightedRoot.Hash != scaledRoot.Hash {
+		t.Fatalf("weighted root %x, want the root of the pre-scaled balances %x", weightedRoot.Hash, scaledRoot.Hash)
+	}
+	if unchanged, _ := build(applied, plain); unchanged.Hash != plainRoot.Hash {
+		t.Fatal("ApplyWeights changed the root of balances without weights")
+	}
+
+	for _, asset := range []string{"BTC", "XRP"} {
+		want := plainTotals[asset]
+		if asset == "XRP" {
+			want *= 0.5
+		}
+		if math.Abs(weightedTotals[asset]-want) > 1e-9*math.Abs(want) || ignoredTotals[asset] != plainTotals[asset] {
+			t.Fatalf("%s: weighted total %v, unweighted %v; want %v and %v", asset, weightedTotals[asset], ignoredTotals[asset], want, plainTotals[asset])
+		}
+	}
+	sums, err := applied.SumByAsset(weighted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, discrepancies := VerifyAttestedTotals(weightedTotals, sums, 1e-6); !ok {
+		t.Fatalf("SumByAsset disagrees with the committed weighted totals: %v", discrepancies)
+	}
+	if sums, err = unweighted.SumByAsset(weighted); err != nil || sums["XRP"] != plainTotals["XRP"] {
+		t.Fatalf("unweighted SumByAsset: %v, %v", sums, err)
+	}
+
+	weighted[3].Balances[0].Weight = -1
+	if _, err := applied.Build(weighted); err == nil {
+		t.Fatal("a negative weight was accepted")
+	}
+	if _, err := applied.SumByAsset(weighted); err == nil {
+		t.Fatal("SumByAsset accepted a negative weight")
+	}
+
+	data, err := json.Marshal(applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded TreeBuilder
+	if err := json.Unmarshal(data, &loaded); err != nil || !loaded.ApplyWeights {
+		t.Fatalf("ApplyWeights did not round-trip: %s, %v", data, err)
+	}
+}
+
+// TestPairWithZero checks a 3-leaf root against one computed by hand, that zero-paired trees validate and verify their proofs, and that Build, BuildConcurrent and RootOnly agree.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestPairWithZero(t *testing.T) {
+	b := NewTreeBuilder(nil)
+	b.PairWithZero = true
+
+	data := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	node := func(left, right [32]byte) [32]byte {
+		return sha256.Sum256(append(append([]byte{0x01}, left[:]...), right[:]...))
+	}
+	leaf := func(data []byte) [32]byte { return sha256.Sum256(append([]byte{0x00}, data...)) }
+	want := node(node(leaf(data[0]), leaf(data[1])), node(leaf(data[2]), [32]byte{}))
+	root := b.BuildFromLeafBytes(data)
+	if root.Hash != want {
+		t.Fatalf("3-leaf root %x, want %x", root.Hash, want)
+	}
+	if root.Hash == BuildTreeFromLeafBytes(data).Hash {
+		t.Fatal("zero pairing did not change the 3-leaf root")
+	}
+	for _, d := range data {
+		proof, err := GenerateProof(root, leaf(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(proof) != 2 || !VerifyProof(leaf(d), proof, root.Hash) {
+			t.Fatalf("leaf %s: %d-step proof does not verify", d, len(proof))
+		}
+	}
+
+	for _, count := range []int{1, 2, 3, 5, 7} {
+		accounts := exampleAccounts(count)
+		root, err := b.Build(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		concurrent, err := b.BuildConcurrent(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if concurrent.Hash != root.Hash {
+			t.Fatalf("%d accounts: concurrent root %x, want %x", count, concurrent.Hash, root.Hash)
+		}
+		if err := b.Validate(root); err != nil {
+			t.Fatalf("%d accounts: %v", count, err)
+		}
+		for _, hash := range exampleTreeLeaves(t, accounts) {
+			proof, err := GenerateProof(root, hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyProof(hash, proof, root.Hash) {
+				t.Fatalf("%d accounts: proof of %x does not verify", count, hash)
+			}
+		}
+	}
+
+	data = append(data, []byte("d"), []byte("e"))
+	hashes := make([][]byte, len(data))
+	for i, d := range data {
+		h := leaf(d)
+		hashes[i] = h[:]
+	}
+	if only, err := b.RootOnly(hashes); err != nil || only != b.BuildFromLeafBytes(data).Hash {
+		t.Fatalf("RootOnly %x, %v; want %x", only, err, b.BuildFromLeafBytes(data).Hash)
+	}
+
+	encoded, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded TreeBuilder
+	if err := json.Unmarshal(encoded, &loaded); err != nil || !loaded.PairWithZero {
+		t.Fatalf("PairWithZero did not round-trip: %s, %v", encoded, err)
+	}
+}
+
+// TestTotalsDelta checks the per-asset change between two attestations, including an asset only in the later one and one dropped from it.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestTotalsDelta(t *testing.T) {
+	before, err := AttestAccounts(exampleAccounts(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts := exampleAccounts(12)
+	accounts[0].Balances = append(accounts[0].Balances, Balance{Asset: "DOGE", Balance: 42})
+	for i := range accounts {
+		accounts[i].Balances = accounts[i].Balances[1:]
+	}
+	after, err := AttestAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delta := TotalsDelta(before.Totals, after.Totals)
+	if len(delta) != 6 {
+		t.Fatalf("got %d assets, want 6: %v", len(delta), delta)
+	}
+	if delta["DOGE"] != 42 {
+		t.Fatalf("DOGE only in the later totals: delta %v, want 42", delta["DOGE"])
+	}
+	if delta["BTC"] != -before.Totals["BTC"] {
+		t.Fatalf("BTC dropped from the later totals: delta %v, want %v", delta["BTC"], -before.Totals["BTC"])
+	}
+	for _, asset := range []string{"ETH", "USDT"} {
+		if want := after.Totals[asset] - before.Totals[asset]; delta[asset] != want {
+			t.Fatalf("%s: delta %v, want %v", asset, delta[asset], want)
+		}
+	}
+	if delta := TotalsDelta(after.Totals, after.Totals); delta["ETH"] != 0 || delta["DOGE"] != 0 {
+		t.Fatalf("unchanged totals: %v", delta)
+	}
+}
+
+// TestSelfVerifyProofs checks that a builder with SelfVerifyProofs hands out proofs of a sound tree and reports a tree with a corrupted internal hash, which plain GenerateProof does not notice.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestSelfVerifyProofs(t *testing.T) {
+	b := NewTreeBuilder(sha512Hasher{})
+	b.SelfVerifyProofs = true
+	accounts := exampleAccounts(6)
+	root, err := b.Build(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := root.Leaves()
+	for _, leaf := range leaves {
+		if _, err := b.GenerateProof(root, [32]byte(leaf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root.Left.Right.Hash[0] ^= 0xff
+	target := [32]byte(leaves[0])
+	if _, err := GenerateProof(root, target); err != nil {
+		t.Fatalf("plain GenerateProof: %v", err)
+	}
+	if _, err := b.GenerateProof(root, target); !errors.Is(err, ErrInvalidTree) {
+		t.Fatalf("corrupted tree: got %v, want ErrInvalidTree", err)
+	}
+	b.SelfVerifyProofs = false
+	if _, err := b.GenerateProof(root, target); err != nil {
+		t.Fatalf("self-verification off: %v", err)
+	}
+}
+
+// TestLeafPreimage checks that hashing each leaf's preimage under the leaf's hasher gives the hash Leaves reports at the same index.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestLeafPreimage(t *testing.T) {
+	accounts := exampleAccounts(7)
+	root, err := createMerkleTreeForAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, leaf := range root.Leaves() {
+		preimage, err := LeafPreimage(accounts, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if preimage[0] != 0x00 {
+			t.Fatalf("leaf %d: preimage starts with %#x, want the leaf prefix", i, preimage[0])
+		}
+		if hash := sha256.Sum256(preimage); !bytes.Equal(hash[:], leaf) {
+			t.Fatalf("leaf %d: sha256(%s) = %x, want %x", i, preimage[1:], hash, leaf)
+		}
+	}
+
+	b := NewTreeBuilder(sha512Hasher{})
+	b.ApplyWeights = true
+	b.PolicyHash = []byte("policy")
+	accounts[2].Balances[1].Weight = 0.25
+	root, err = b.Build(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := root.Leaves()
+	for i := 0; i < 5*len(accounts); i++ {
+		preimage, err := b.LeafPreimage(accounts, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash := sha512.Sum512_256(preimage); !bytes.Equal(hash[:], leaves[i]) {
+			t.Fatalf("weighted SHA-512/256 leaf %d does not match its preimage %s", i, preimage[1:])
+		}
+	}
+
+	for _, index := range []int{-1, 5 * len(accounts)} {
+		if _, err := LeafPreimage(accounts, index); !errors.Is(err, ErrLeafNotFound) {
+			t.Fatalf("index %d: got %v, want ErrLeafNotFound", index, err)
+		}
+	}
+}
+
+// TestMultiProofSubtreeSiblings checks that a contiguous range of four leaves in a 16-leaf tree is proved by subtree-level sibling hashes, and that an unaligned range mixes leaf-level and subtree-level ones.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestMultiProofSubtreeSiblings(t *testing.T) {
+	data := make([][]byte, 16)
+	for i := range data {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+	root := BuildTreeFromLeafBytes(data)
+	leaves := root.Leaves()
+	targets := func(from, to int) [][32]byte {
+		var hashes [][32]byte
+		for i := from; i < to; i++ {
+			hashes = append(hashes, [32]byte(leaves[i]))
+		}
+		return hashes
+	}
+
+	proof, err := GenerateMultiProof(root, targets(4, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][32]byte{root.Left.Left.Hash, root.Right.Hash}; !reflect.DeepEqual(proof.Hashes, want) {
+		t.Fatalf("aligned range: hashes %x, want the subtree roots %x", proof.Hashes, want)
+	}
+	if !VerifyMultiProof(proof, root.Hash) {
+		t.Fatal("aligned range: multiproof does not verify")
+	}
+
+	proof, err = GenerateMultiProof(root, targets(5, 9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][32]byte{
+		root.Left.Left.Hash,
+		[32]byte(leaves[4]),
+		[32]byte(leaves[9]),
+		root.Right.Left.Right.Hash,
+		root.Right.Right.Hash,
+	}
+	if !reflect.DeepEqual(proof.Hashes, want) {
+		t.Fatalf("unaligned range: hashes %x, want %x", proof.Hashes, want)
+	}
+	if !VerifyMultiProof(proof, root.Hash) {
+		t.Fatal("unaligned range: multiproof does not verify")
+	}
+	proof.Hashes[0][0] ^= 1
+	if VerifyMultiProof(proof, root.Hash) {
+		t.Fatal("multiproof with a tampered subtree hash verifies")
+	}
+}
+
+// TestSnapshotTimeSeries checks that three snapshots added out of order are summarized oldest first with their roots, leaf counts and totals.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestSnapshotTimeSeries(t *testing.T) {
+	if series := NewSnapshotStore().TimeSeries(); series != nil {
+		t.Fatalf("empty store: got %v", series)
+	}
+
+	base := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	store := NewSnapshotStore()
+	want := make(map[int]SnapshotSummary)
+	for _, month := range []int{2, 0, 1} {
+		accounts := generateRandomAccountsSeed(5+month, int64(month+1))
+		root, totals, err := createMerkleTreeWithTotals(accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := base.AddDate(0, month, 0)
+		if err := store.Add(ts, root, accounts); err != nil {
+			t.Fatal(err)
+		}
+		want[month] = SnapshotSummary{Timestamp: ts, Root: root.RootHex(), LeafCount: 5 * (5 + month), Totals: totals}
+	}
+
+	series := store.TimeSeries()
+	if len(series) != 3 {
+		t.Fatalf("got %d summaries, want 3", len(series))
+	}
+	for month, summary := range series {
+		expected := want[month]
+		if !summary.Timestamp.Equal(expected.Timestamp) || summary.Root != expected.Root || summary.LeafCount != expected.LeafCount {
+			t.Fatalf("summary %d: %+v, want %+v", month, summary, expected)
+		}
+		if ok, discrepancies := VerifyAttestedTotals(expected.Totals, summary.Totals, 1e-9); !ok {
+			t.Fatalf("summary %d: totals differ by %v", month, discrepancies)
+		}
+	}
+
+	series[0].Totals["BTC"] = -1
+	if store.TimeSeries()[0].Totals["BTC"] == -1 {
+		t.Fatal("TimeSeries returned the store's own totals map")
+	}
+	invalid := []Account{{Identifier: "a", Balances: []Balance{{Asset: "BTC", Balance: 1, Sign: "owed"}}}}
+	if err := store.Add(base, &MerkleNode{}, invalid); !errors.Is(err, ErrInvalidSign) || len(store.TimeSeries()) != 3 {
+		t.Fatalf("invalid accounts: got %v with %d snapshots", err, len(store.TimeSeries()))
+	}
+}
+
+// TestDiffTreesShapes checks that leaf positions reported by DiffTrees match Leaves for trees whose left subtrees are not perfect: a root that also commits to a policy, a two-level tree and a zero-paired tree.
+//
+// Parameters:
+//   - t: the test context
+//
+// Returns:
+//   None
+func TestDiffTreesShapes(t *testing.T) {
+	check := func(name string, before, after *MerkleNode, want int) {
+		t.Helper()
+		oldLeaves, newLeaves := before.Leaves(), after.Leaves()
+		diffs := DiffTrees(before, after)
+		if len(diffs) != want {
+			t.Fatalf("%s: got %d diffs, want %d", name, len(diffs), want)
+		}
+		for _, d := range diffs {
+			if !bytes.Equal(d.Old, oldLeaves[d.Index]) || !bytes.Equal(d.New, newLeaves[d.Index]) {
+				t.Fatalf("%s: diff at %d does not hold the leaves at that position", name, d.Index)
+			}
+		}
+	}
+
+	accounts := exampleAccounts(7)
+	first, second := NewTreeBuilder(nil), NewTreeBuilder(nil)
+	first.PolicyHash, second.PolicyHash = []byte("policy v1"), []byte("policy v2")
+	before, err := first.Build(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := second.Build(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("PolicyHash", before, after, 1)
+	if d := DiffTrees(before, after)[0]; d.Index != 35 || !bytes.Equal(d.New, func() []byte { h := second.PolicyLeaf(); return h[:] }()) {
+		t.Fatalf("PolicyHash: diff at %d, want the policy leaf at 35", d.Index)
+	}
+
+	first.ReserveAddresses = []string{"bc1a", "bc1b", "bc1c"}
+	second.PolicyHash, second.ReserveAddresses = first.PolicyHash, []string{"bc1a", "bc1b", "bc1d"}
+	if before, err = first.Build(accounts); err != nil {
+		t.Fatal(err)
+	}
+	if after, err = second.Build(accounts); err != nil {
+		t.Fatal(err)
+	}
+	check("ReserveAddresses", before, after, 1)
+
+	changed := exampleAccounts(7)
+	changed[5].Balances[1].Balance += 1
+	for name, b := range map[string]*TreeBuilder{
+		"BuildTwoLevel": NewTreeBuilder(nil),
+		"PairWithZero":  {PairWithZero: true},
+	} {
+		build := b.Build
+		if name == "BuildTwoLevel" {
+			build = b.BuildTwoLevel
+		}
+		if before, err = build(accounts); err != nil {
+			t.Fatal(err)
+		}
+		if after, err = build(changed); err != nil {
+			t.Fatal(err)
+		}
+		check(name, before, after, 1)
+	}
+}